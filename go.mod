@@ -5,6 +5,8 @@ go 1.25.0
 require (
 	cloud.google.com/go/storage v1.55.0
 	github.com/gofrs/uuid v4.2.0+incompatible
+	github.com/googleapis/gax-go/v2 v2.14.2
+	github.com/klauspost/compress v1.18.0
 	github.com/pkg/errors v0.9.1
 	github.com/sirupsen/logrus v1.9.3
 	github.com/spf13/pflag v1.0.5
@@ -12,6 +14,7 @@ require (
 	github.com/vmware-tanzu/velero v0.0.0-20250826085519-79b027577e6a
 	golang.org/x/oauth2 v0.30.0
 	google.golang.org/api v0.241.0
+	google.golang.org/grpc v1.73.0
 	k8s.io/api v0.31.3
 	k8s.io/apimachinery v0.31.3
 )
@@ -54,7 +57,6 @@ require (
 	github.com/google/s2a-go v0.1.9 // indirect
 	github.com/google/uuid v1.6.0 // indirect
 	github.com/googleapis/enterprise-certificate-proxy v0.3.6 // indirect
-	github.com/googleapis/gax-go/v2 v2.14.2 // indirect
 	github.com/hashicorp/go-hclog v0.14.1 // indirect
 	github.com/hashicorp/go-plugin v1.6.0 // indirect
 	github.com/hashicorp/yamux v0.1.1 // indirect
@@ -104,7 +106,6 @@ require (
 	google.golang.org/genproto v0.0.0-20250505200425-f936aa4a68b2 // indirect
 	google.golang.org/genproto/googleapis/api v0.0.0-20250603155806-513f23925822 // indirect
 	google.golang.org/genproto/googleapis/rpc v0.0.0-20250603155806-513f23925822 // indirect
-	google.golang.org/grpc v1.73.0 // indirect
 	google.golang.org/protobuf v1.36.6 // indirect
 	gopkg.in/evanphx/json-patch.v4 v4.12.0 // indirect
 	gopkg.in/inf.v0 v0.9.1 // indirect
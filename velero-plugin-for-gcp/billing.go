@@ -0,0 +1,52 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"cloud.google.com/go/storage"
+	"google.golang.org/api/option"
+)
+
+const (
+	// userProjectConfigKey names the project billed for requests to Requester Pays buckets.
+	userProjectConfigKey = "userProject"
+	// quotaProjectConfigKey names the project that API quota and billing are charged to,
+	// instead of the project of the credentials.
+	quotaProjectConfigKey = "quotaProject"
+)
+
+// userProjectQueryParameter is the query parameter naming the project billed for a
+// request to a Requester Pays bucket.
+const userProjectQueryParameter = "userProject"
+
+// quotaProjectOptions returns the client options that charge API quota to the
+// quotaProject in config, if set.
+func quotaProjectOptions(config map[string]string) []option.ClientOption {
+	if project := config[quotaProjectConfigKey]; project != "" {
+		return []option.ClientOption{option.WithQuotaProject(project)}
+	}
+	return nil
+}
+
+// bucketHandle returns the handle of a bucket, with requests billed to userProject if set.
+func bucketHandle(client *storage.Client, bucket, userProject string) *storage.BucketHandle {
+	handle := client.Bucket(bucket)
+	if userProject != "" {
+		handle = handle.UserProject(userProject)
+	}
+	return handle
+}
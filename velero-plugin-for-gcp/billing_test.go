@@ -0,0 +1,59 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package main
+
+import (
+	"io"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	velerotest "github.com/vmware-tanzu/velero/pkg/test"
+)
+
+func TestRequesterPaysBucket(t *testing.T) {
+	objects := map[string]fakeObject{
+		"backups/b1/b1.tar.gz": {data: []byte("backup contents"), userProject: "billing-project"},
+	}
+	o := newObjectStore(velerotest.NewLogger())
+	o.client = newFakeGCSServer(t, objects)
+	o.bucketWriter = &writer{client: o.client}
+
+	_, err := o.ObjectExists("bucket", "backups/b1/b1.tar.gz")
+	assert.ErrorContains(t, err, "no user project provided")
+
+	o.userProject = "billing-project"
+	o.bucketWriter = &writer{client: o.client, userProject: o.userProject}
+
+	exists, err := o.ObjectExists("bucket", "backups/b1/b1.tar.gz")
+	require.NoError(t, err)
+	assert.True(t, exists)
+
+	r, err := o.GetObject("bucket", "backups/b1/b1.tar.gz")
+	require.NoError(t, err)
+	data, err := io.ReadAll(r)
+	require.NoError(t, err)
+	require.NoError(t, r.Close())
+	assert.Equal(t, "backup contents", string(data))
+
+	require.NoError(t, o.DeleteObject("bucket", "backups/b1/b1.tar.gz"))
+	assert.Empty(t, objects)
+}
+
+func TestQuotaProjectOptions(t *testing.T) {
+	assert.Empty(t, quotaProjectOptions(map[string]string{}))
+	assert.Len(t, quotaProjectOptions(map[string]string{quotaProjectConfigKey: "quota-project"}), 1)
+}
@@ -0,0 +1,141 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+
+	"cloud.google.com/go/storage"
+)
+
+var crc32cTable = crc32.MakeTable(crc32.Castagnoli)
+
+// checksumBufferSize is the size up to which uploads are held back until they are
+// complete, so that their CRC32C is known when the upload starts and GCS rejects the
+// upload if the data it receives doesn't match. It matches the storage client's default
+// chunk size, under which uploads are sent in a single request anyway. Larger uploads
+// are verified against the CRC32C GCS computed once they are committed.
+const checksumBufferSize = 16 * 1024 * 1024
+
+// checksumMismatchError is returned when the CRC32C of an object's data doesn't match
+// the one GCS has for it.
+type checksumMismatchError struct {
+	key      string
+	computed uint32
+	stored   uint32
+}
+
+func (e *checksumMismatchError) Error() string {
+	return fmt.Sprintf("CRC32C mismatch for object %s: computed %s, Cloud Storage has %s, the data was corrupted in transit",
+		e.key, encodeCRC32C(e.computed), encodeCRC32C(e.stored))
+}
+
+// encodeCRC32C formats a CRC32C as GCS displays it.
+func encodeCRC32C(crc uint32) string {
+	return base64.StdEncoding.EncodeToString(binary.BigEndian.AppendUint32(nil, crc))
+}
+
+// checksumWriter computes the CRC32C of the data uploaded through it. The upload is
+// only opened, with open, once the data exceeds checksumBufferSize or the writer is
+// closed, so that the checksum of small objects can be sent along with them.
+type checksumWriter struct {
+	open func(crc32c *uint32) objectWriter
+	// abort cancels the upload.
+	abort context.CancelFunc
+
+	w   objectWriter
+	buf []byte
+	crc uint32
+	// size is the number of bytes written.
+	size int64
+}
+
+func newChecksumWriter(open func(crc32c *uint32) objectWriter, abort context.CancelFunc) *checksumWriter {
+	return &checksumWriter{open: open, abort: abort}
+}
+
+func (c *checksumWriter) Write(p []byte) (int, error) {
+	c.crc = crc32.Update(c.crc, crc32cTable, p)
+	c.size += int64(len(p))
+	if c.w == nil {
+		if len(c.buf)+len(p) <= checksumBufferSize {
+			c.buf = append(c.buf, p...)
+			return len(p), nil
+		}
+		c.w = c.open(nil)
+		if _, err := c.w.Write(c.buf); err != nil {
+			return 0, err
+		}
+		c.buf = nil
+	}
+	return c.w.Write(p)
+}
+
+// Close commits the upload.
+func (c *checksumWriter) Close() error {
+	if c.w == nil {
+		crc := c.crc
+		c.w = c.open(&crc)
+		if _, err := c.w.Write(c.buf); err != nil {
+			c.abort()
+			c.w.Close()
+			return err
+		}
+	}
+	return c.w.Close()
+}
+
+// verify checks the CRC32C GCS computed for the committed object against the one computed
+// while uploading it. It returns the mismatching object's attributes along with the error.
+func (c *checksumWriter) verify(key string) (*storage.ObjectAttrs, error) {
+	attrs := c.w.Attrs()
+	if attrs == nil || attrs.CRC32C == c.crc {
+		return attrs, nil
+	}
+	return attrs, &checksumMismatchError{key: key, computed: c.crc, stored: attrs.CRC32C}
+}
+
+// checksumReader verifies the CRC32C of an object as it is read in full, and returns an
+// error instead of io.EOF if it doesn't match.
+type checksumReader struct {
+	r    io.ReadCloser
+	key  string
+	want uint32
+	crc  uint32
+}
+
+func newChecksumReader(r io.ReadCloser, key string, want uint32) *checksumReader {
+	return &checksumReader{r: r, key: key, want: want}
+}
+
+func (c *checksumReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.crc = crc32.Update(c.crc, crc32cTable, p[:n])
+	if err == io.EOF && c.crc != c.want {
+		return n, &checksumMismatchError{key: c.key, computed: c.crc, stored: c.want}
+	}
+	return n, err
+}
+
+func (c *checksumReader) Close() error {
+	return c.r.Close()
+}
@@ -0,0 +1,133 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package main
+
+import (
+	"bytes"
+	"context"
+	"hash/crc32"
+	"io"
+	"strings"
+	"testing"
+
+	"cloud.google.com/go/storage"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	velerotest "github.com/vmware-tanzu/velero/pkg/test"
+)
+
+type bufferObjectWriter struct {
+	bufferWriteCloser
+}
+
+func (b *bufferObjectWriter) Attrs() *storage.ObjectAttrs {
+	return &storage.ObjectAttrs{CRC32C: crc32.Checksum(b.Bytes(), crc32cTable)}
+}
+
+func TestChecksumWriter(t *testing.T) {
+	for _, size := range []int{0, 10, checksumBufferSize, checksumBufferSize + 1} {
+		data := bytes.Repeat([]byte{'v'}, size)
+
+		out := new(bufferObjectWriter)
+		var sentCRC *uint32
+		var opened int
+		w := newChecksumWriter(func(crc32c *uint32) objectWriter {
+			opened++
+			sentCRC = crc32c
+			return out
+		}, func() {})
+
+		_, err := io.Copy(w, bytes.NewReader(data))
+		require.NoError(t, err)
+		require.NoError(t, w.Close())
+		assert.Equal(t, 1, opened)
+		assert.Equal(t, size, out.Len())
+		assert.True(t, bytes.Equal(data, out.Bytes()))
+
+		// The checksum is sent when the whole object fits in the buffer.
+		if size <= checksumBufferSize {
+			require.NotNil(t, sentCRC, "size %d", size)
+			assert.Equal(t, crc32.Checksum(data, crc32cTable), *sentCRC)
+		} else {
+			assert.Nil(t, sentCRC, "size %d", size)
+		}
+
+		_, err = w.verify("key")
+		assert.NoError(t, err)
+	}
+}
+
+func TestPutObjectChecksum(t *testing.T) {
+	w := newFakeWriter(newMockWriteCloser(nil, nil))
+	o := newObjectStore(velerotest.NewLogger())
+	o.bucketWriter = w
+
+	require.NoError(t, o.PutObject("bucket", "key", strings.NewReader("contents")))
+	require.NotNil(t, w.opts.crc32c)
+	assert.Equal(t, crc32.Checksum([]byte("contents"), crc32cTable), *w.opts.crc32c)
+
+	// An object committed with different contents is deleted.
+	w.wc.attrs = &storage.ObjectAttrs{CRC32C: 1, Generation: 7}
+	err := o.PutObject("bucket", "key", strings.NewReader("contents"))
+	assert.ErrorContains(t, err, "CRC32C mismatch for object key: computed ")
+	assert.Equal(t, []int64{7}, w.deletedGenerations)
+}
+
+func TestChecksumReader(t *testing.T) {
+	data := []byte("backup contents")
+
+	r := newChecksumReader(io.NopCloser(bytes.NewReader(data)), "key", crc32.Checksum(data, crc32cTable))
+	read, err := io.ReadAll(r)
+	require.NoError(t, err)
+	assert.Equal(t, data, read)
+
+	r = newChecksumReader(io.NopCloser(bytes.NewReader(data)), "key", 0)
+	_, err = io.ReadAll(r)
+	var mismatch *checksumMismatchError
+	assert.ErrorAs(t, err, &mismatch)
+}
+
+func TestGetObjectVerifiesChecksum(t *testing.T) {
+	o := newObjectStore(velerotest.NewLogger())
+	o.client = newFakeGCSServer(t, map[string]fakeObject{
+		"intact":    {data: []byte("backup contents")},
+		"corrupted": {data: []byte("backup contents"), crc32c: encodeCRC32C(1)},
+	})
+
+	r, err := o.GetObject("bucket", "intact")
+	require.NoError(t, err)
+	_, err = io.ReadAll(r)
+	assert.NoError(t, err)
+	require.NoError(t, r.Close())
+
+	r, err = o.GetObject("bucket", "corrupted")
+	require.NoError(t, err)
+	_, err = io.ReadAll(r)
+	assert.ErrorContains(t, err, "CRC32C mismatch for object corrupted: computed ")
+	require.NoError(t, r.Close())
+}
+
+func TestChecksumWriterAbortsOnFailedWrite(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	wc := newMockWriteCloser(assert.AnError, nil)
+	wc.ctx = ctx
+	w := newChecksumWriter(func(*uint32) objectWriter { return wc }, cancel)
+
+	_, err := w.Write([]byte("contents"))
+	require.NoError(t, err)
+	assert.Equal(t, assert.AnError, w.Close())
+	assert.ErrorIs(t, wc.ctxErrAtClose, context.Canceled)
+}
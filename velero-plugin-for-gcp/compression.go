@@ -0,0 +1,181 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/pkg/errors"
+)
+
+const compressionConfigKey = "compression"
+
+// compressionMetadataKey records the codec an object was compressed with. The codec
+// isn't set as the object's Content-Encoding, so that GCS never decompresses it on
+// download behind the plugin's back.
+const compressionMetadataKey = "velero-compression"
+
+const (
+	gzipCodec = "gzip"
+	zstdCodec = "zstd"
+)
+
+// compressedSuffixes are the extensions of keys that hold already compressed data.
+var compressedSuffixes = []string{".gz", ".tgz", ".zst", ".zstd", ".bz2", ".xz", ".zip"}
+
+// compressedMagics are the leading bytes of gzip and zstd streams.
+var compressedMagics = [][]byte{{0x1f, 0x8b}, {0x28, 0xb5, 0x2f, 0xfd}}
+
+// parseCompression reads the codec to compress uploads with from the BSL config, or ""
+// if uploads aren't compressed.
+func parseCompression(config map[string]string) (string, error) {
+	switch codec := strings.ToLower(config[compressionConfigKey]); codec {
+	case "", "none":
+		return "", nil
+	case gzipCodec, zstdCodec:
+		return codec, nil
+	default:
+		return "", errors.Errorf("unsupported %s %q, must be gzip, zstd or none", compressionConfigKey, config[compressionConfigKey])
+	}
+}
+
+// isCompressed reports whether the object being uploaded to key, starting with head,
+// already holds compressed data that wouldn't shrink further.
+func isCompressed(key string, head []byte) bool {
+	for _, suffix := range compressedSuffixes {
+		if strings.HasSuffix(key, suffix) {
+			return true
+		}
+	}
+	for _, magic := range compressedMagics {
+		if bytes.HasPrefix(head, magic) {
+			return true
+		}
+	}
+	return false
+}
+
+// compressingWriter compresses the data written to it, and counts the bytes in and out
+// so the compression ratio can be reported.
+type compressingWriter struct {
+	codec   string
+	encoder io.WriteCloser
+	w       io.WriteCloser
+	out     *countingWriter
+	in      int64
+}
+
+func newCompressingWriter(codec string, w io.WriteCloser) (*compressingWriter, error) {
+	c := &compressingWriter{codec: codec, w: w, out: &countingWriter{w: w}}
+	switch codec {
+	case gzipCodec:
+		c.encoder = gzip.NewWriter(c.out)
+	case zstdCodec:
+		encoder, err := zstd.NewWriter(c.out)
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		c.encoder = encoder
+	default:
+		return nil, errors.Errorf("unsupported compression codec %q", codec)
+	}
+	return c, nil
+}
+
+func (c *compressingWriter) Write(p []byte) (int, error) {
+	n, err := c.encoder.Write(p)
+	c.in += int64(n)
+	return n, err
+}
+
+// Close flushes the compressed stream and closes the underlying writer.
+func (c *compressingWriter) Close() error {
+	encoderErr := c.encoder.Close()
+	closeErr := c.w.Close()
+	if encoderErr != nil {
+		return errors.WithStack(encoderErr)
+	}
+	return closeErr
+}
+
+// ratio returns the uncompressed size divided by the compressed size.
+func (c *compressingWriter) ratio() float64 {
+	if c.out.n == 0 {
+		return 0
+	}
+	return float64(c.in) / float64(c.out.n)
+}
+
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// newDecompressingReader returns a reader that decompresses r according to the object's
+// metadata, or r itself if the object isn't compressed. Closing it closes r.
+func newDecompressingReader(key string, metadata map[string]string, r io.ReadCloser) (io.ReadCloser, error) {
+	codec, ok := metadata[compressionMetadataKey]
+	if !ok {
+		return r, nil
+	}
+
+	var decoder io.ReadCloser
+	switch codec {
+	case gzipCodec:
+		gz, err := gzip.NewReader(r)
+		if err != nil {
+			r.Close()
+			return nil, errors.Wrapf(err, "error decompressing object %s", key)
+		}
+		decoder = gz
+	case zstdCodec:
+		zr, err := zstd.NewReader(r, zstd.WithDecoderConcurrency(1))
+		if err != nil {
+			r.Close()
+			return nil, errors.Wrapf(err, "error decompressing object %s", key)
+		}
+		decoder = zr.IOReadCloser()
+	default:
+		r.Close()
+		return nil, errors.Errorf("object %s is compressed with unsupported codec %q", key, codec)
+	}
+	return &decompressingReader{decoder: decoder, r: r}, nil
+}
+
+type decompressingReader struct {
+	decoder io.ReadCloser
+	r       io.ReadCloser
+}
+
+func (d *decompressingReader) Read(p []byte) (int, error) {
+	return d.decoder.Read(p)
+}
+
+func (d *decompressingReader) Close() error {
+	d.decoder.Close()
+	return d.r.Close()
+}
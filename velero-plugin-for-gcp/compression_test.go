@@ -0,0 +1,150 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package main
+
+import (
+	"bytes"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	velerotest "github.com/vmware-tanzu/velero/pkg/test"
+)
+
+func TestParseCompression(t *testing.T) {
+	tests := []struct {
+		value         string
+		expectedCodec string
+		expectedError string
+	}{
+		{value: "", expectedCodec: ""},
+		{value: "none", expectedCodec: ""},
+		{value: "gzip", expectedCodec: gzipCodec},
+		{value: "ZSTD", expectedCodec: zstdCodec},
+		{value: "lz4", expectedError: `unsupported compression "lz4", must be gzip, zstd or none`},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.value, func(t *testing.T) {
+			codec, err := parseCompression(map[string]string{compressionConfigKey: tc.value})
+			if tc.expectedError != "" {
+				assert.EqualError(t, err, tc.expectedError)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tc.expectedCodec, codec)
+		})
+	}
+}
+
+func TestIsCompressed(t *testing.T) {
+	assert.True(t, isCompressed("backups/b1/b1.tar.gz", []byte("data")))
+	assert.True(t, isCompressed("backups/b1/b1-logs", []byte{0x1f, 0x8b, 0x08, 0x00}))
+	assert.True(t, isCompressed("kopia/p123", []byte{0x28, 0xb5, 0x2f, 0xfd}))
+	assert.False(t, isCompressed("backups/b1/velero-backup.json", []byte(`{"ki`)))
+	assert.False(t, isCompressed("empty", nil))
+}
+
+func TestCompressionRoundTrip(t *testing.T) {
+	data := []byte(strings.Repeat(`{"kind": "Pod", "apiVersion": "v1"}`, 1000))
+
+	for _, codec := range []string{gzipCodec, zstdCodec} {
+		t.Run(codec, func(t *testing.T) {
+			out := new(bufferWriteCloser)
+			w, err := newCompressingWriter(codec, out)
+			require.NoError(t, err)
+			_, err = io.Copy(w, bytes.NewReader(data))
+			require.NoError(t, err)
+			require.NoError(t, w.Close())
+			assert.True(t, out.closed)
+			assert.Equal(t, int64(len(data)), w.in)
+			assert.Equal(t, int64(out.Len()), w.out.n)
+			assert.Greater(t, w.ratio(), 10.0)
+
+			r, err := newDecompressingReader("key", map[string]string{compressionMetadataKey: codec}, io.NopCloser(out))
+			require.NoError(t, err)
+			decompressed, err := io.ReadAll(r)
+			require.NoError(t, err)
+			require.NoError(t, r.Close())
+			assert.Equal(t, data, decompressed)
+		})
+	}
+}
+
+func TestDecompressingReaderUncompressed(t *testing.T) {
+	r, err := newDecompressingReader("key", nil, io.NopCloser(strings.NewReader("plain")))
+	require.NoError(t, err)
+	data, err := io.ReadAll(r)
+	require.NoError(t, err)
+	assert.Equal(t, "plain", string(data))
+
+	_, err = newDecompressingReader("key", map[string]string{compressionMetadataKey: "lz4"}, io.NopCloser(strings.NewReader("")))
+	assert.EqualError(t, err, `object key is compressed with unsupported codec "lz4"`)
+}
+
+func TestPutObjectCompression(t *testing.T) {
+	tests := []struct {
+		name          string
+		key           string
+		body          string
+		expectedCodec string
+	}{
+		{name: "metadata is compressed", key: "backups/b1/velero-backup.json", body: `{"kind": "Backup"}`, expectedCodec: zstdCodec},
+		{name: "tarball is skipped", key: "backups/b1/b1.tar.gz", body: "tarball"},
+		{name: "gzip data is skipped", key: "backups/b1/b1-logs", body: "\x1f\x8b\x08\x00logs"},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			w := newFakeWriter(newMockWriteCloser(nil, nil))
+			o := &ObjectStore{log: velerotest.NewLogger(), bucketWriter: w, compression: zstdCodec}
+
+			require.NoError(t, o.PutObject("bucket", tc.key, strings.NewReader(tc.body)))
+			codec, ok := w.opts.metadata[compressionMetadataKey]
+			assert.Equal(t, tc.expectedCodec != "", ok)
+			assert.Equal(t, tc.expectedCodec, codec)
+		})
+	}
+}
+
+func TestGetObjectDecompresses(t *testing.T) {
+	compressed := new(bufferWriteCloser)
+	w, err := newCompressingWriter(gzipCodec, compressed)
+	require.NoError(t, err)
+	_, err = w.Write([]byte("backup contents"))
+	require.NoError(t, err)
+	require.NoError(t, w.Close())
+
+	o := newObjectStore(velerotest.NewLogger())
+	o.client = newFakeGCSServer(t, map[string]fakeObject{
+		"compressed": {data: compressed.Bytes(), metadata: map[string]string{compressionMetadataKey: gzipCodec}},
+		"legacy":     {data: []byte("legacy contents")},
+	})
+
+	for name, expected := range map[string]string{"compressed": "backup contents", "legacy": "legacy contents"} {
+		r, err := o.GetObject("bucket", name)
+		require.NoError(t, err, name)
+		data, err := io.ReadAll(r)
+		require.NoError(t, err, name)
+		require.NoError(t, r.Close())
+		assert.Equal(t, expected, string(data), name)
+	}
+
+	_, err = o.GetObject("bucket", "missing")
+	assert.Error(t, err)
+}
@@ -0,0 +1,101 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"regexp"
+	"strings"
+
+	"github.com/pkg/errors"
+	"golang.org/x/oauth2"
+	"google.golang.org/api/impersonate"
+	"google.golang.org/api/option"
+)
+
+const (
+	impersonateServiceAccountConfigKey = "impersonateServiceAccount"
+	impersonateDelegatesConfigKey      = "impersonateDelegates"
+)
+
+// parseDelegates splits the comma-separated delegation chain from the location's config.
+func parseDelegates(value string) []string {
+	var delegates []string
+	for _, d := range strings.Split(value, ",") {
+		if d = strings.TrimSpace(d); d != "" {
+			delegates = append(delegates, d)
+		}
+	}
+	return delegates
+}
+
+// serviceAccountResourceName returns the IAM resource name of a service account
+// in the form expected by the IAM and IAM credentials APIs.
+func serviceAccountResourceName(serviceAccount string) string {
+	return "projects/-/serviceAccounts/" + serviceAccount
+}
+
+// serviceAccountImpersonationRegexp extracts the service account from a
+// service_account_impersonation_url such as
+// https://iamcredentials.googleapis.com/v1/projects/-/serviceAccounts/SA:generateAccessToken.
+var serviceAccountImpersonationRegexp = regexp.MustCompile(`/serviceAccounts/([^/:]+):generateAccessToken$`)
+
+// impersonatedServiceAccountFromJSON returns the service account that external_account or
+// impersonated_service_account credentials impersonate, or "" if they don't impersonate one.
+func impersonatedServiceAccountFromJSON(credsJSON []byte) (string, error) {
+	var f struct {
+		ServiceAccountImpersonationURL string `json:"service_account_impersonation_url"`
+	}
+	if err := json.Unmarshal(credsJSON, &f); err != nil {
+		return "", errors.Wrap(err, "error parsing credentials JSON")
+	}
+	if f.ServiceAccountImpersonationURL == "" {
+		return "", nil
+	}
+
+	match := serviceAccountImpersonationRegexp.FindStringSubmatch(f.ServiceAccountImpersonationURL)
+	if match == nil {
+		return "", errors.Errorf("unable to parse service account from service_account_impersonation_url %q", f.ServiceAccountImpersonationURL)
+	}
+	return match[1], nil
+}
+
+// impersonatedTokenSource returns a token source for the service account named by
+// impersonateServiceAccount in config, using the credentials in baseOptions (or
+// application default credentials when empty) to impersonate it, optionally through
+// the impersonateDelegates chain. It returns a nil token source when impersonation
+// isn't configured.
+func impersonatedTokenSource(ctx context.Context, config map[string]string, scopes []string, baseOptions ...option.ClientOption) (oauth2.TokenSource, error) {
+	target := config[impersonateServiceAccountConfigKey]
+	if target == "" {
+		if _, ok := config[impersonateDelegatesConfigKey]; ok {
+			return nil, errors.Errorf("%s requires %s to be set", impersonateDelegatesConfigKey, impersonateServiceAccountConfigKey)
+		}
+		return nil, nil
+	}
+
+	ts, err := impersonate.CredentialsTokenSource(ctx, impersonate.CredentialsConfig{
+		TargetPrincipal: target,
+		Scopes:          scopes,
+		Delegates:       parseDelegates(config[impersonateDelegatesConfigKey]),
+	}, baseOptions...)
+	if err != nil {
+		return nil, errors.Wrapf(err, "error creating token source impersonating %s", target)
+	}
+	return ts, nil
+}
@@ -0,0 +1,286 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"maps"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+const credentialsReloadIntervalConfigKey = "credentialsReloadInterval"
+
+// defaultCredentialsReloadInterval is how often the credentials files are checked for
+// changes by default.
+const defaultCredentialsReloadInterval = time.Minute
+
+// parseCredentialsReloadInterval reads how often the credentials files are checked for
+// changes from the location's config. Zero disables reloading.
+func parseCredentialsReloadInterval(config map[string]string) (time.Duration, error) {
+	value, ok := config[credentialsReloadIntervalConfigKey]
+	if !ok {
+		return defaultCredentialsReloadInterval, nil
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		return 0, errors.Wrapf(err, "invalid value for %s", credentialsReloadIntervalConfigKey)
+	}
+	if d < 0 {
+		return 0, errors.Errorf("invalid value for %s: %s must not be negative", credentialsReloadIntervalConfigKey, value)
+	}
+	return d, nil
+}
+
+// credentialsPaths returns the files that the credentials of the location are read
+// from: the credentialsFile in config, otherwise the file that application default
+// credentials are found in, if any. Credentials set inline aren't reloaded, while those
+// in Secret Manager are accessed again with the default credentials when they change.
+func credentialsPaths(config map[string]string) []string {
+	if credentialsFile, ok := config[credentialsFileConfigKey]; ok {
+		return []string{credentialsFile}
+	}
+	if _, ok := config[credentialsBase64ConfigKey]; ok {
+		return nil
+	}
+	if credentialsFile := os.Getenv("GOOGLE_APPLICATION_CREDENTIALS"); credentialsFile != "" {
+		return []string{credentialsFile}
+	}
+	// The well-known file written by gcloud, which is looked up before the metadata
+	// server. It only matters if it appears or changes later.
+	if home := os.Getenv("HOME"); home != "" {
+		return []string{filepath.Join(home, ".config", "gcloud", "application_default_credentials.json")}
+	}
+	return nil
+}
+
+// credentialsWatcher detects changes to the contents of credentials files, such as a
+// mounted secret being rotated. Files are compared by checksum, since secret volumes
+// are updated by swapping symlinks rather than by writing to the files.
+type credentialsWatcher struct {
+	paths    []string
+	interval time.Duration
+	checked  time.Time
+	// sums are the checksums of the files the clients in use were built from, "" for
+	// missing files.
+	sums map[string]string
+}
+
+// newCredentialsWatcher records the current contents of the files at paths. It must be
+// created before the clients are built from them, so that no change goes unnoticed.
+func newCredentialsWatcher(paths []string, interval time.Duration, now time.Time) *credentialsWatcher {
+	w := &credentialsWatcher{paths: paths, interval: interval, checked: now}
+	w.sums = w.read()
+	return w
+}
+
+func (w *credentialsWatcher) read() map[string]string {
+	sums := make(map[string]string, len(w.paths))
+	for _, path := range w.paths {
+		// Unreadable files are treated as missing, and clients are rebuilt once they are
+		// readable again.
+		if b, err := os.ReadFile(path); err == nil {
+			sum := sha256.Sum256(b)
+			sums[path] = hex.EncodeToString(sum[:])
+		} else {
+			sums[path] = ""
+		}
+	}
+	return sums
+}
+
+// changed returns the checksums of the files, and whether they differ from those the
+// clients in use were built from. The files are read at most once per interval.
+func (w *credentialsWatcher) changed(now time.Time) (map[string]string, bool) {
+	if now.Sub(w.checked) < w.interval {
+		return nil, false
+	}
+	w.checked = now
+	sums := w.read()
+	return sums, !maps.Equal(sums, w.sums)
+}
+
+// update records the checksums of the files the clients were rebuilt from.
+func (w *credentialsWatcher) update(sums map[string]string) {
+	w.sums = sums
+}
+
+// reloader swaps the snapshot of a plugin's clients for one rebuilt from its credentials
+// files when they change. Operations use the snapshot that is current when they start,
+// so that those in flight, such as uploads, carry on with the clients they began with.
+// A snapshot that was swapped out is closed once the last of them finishes.
+type reloader[T any] struct {
+	log     logrus.FieldLogger
+	watcher *credentialsWatcher
+	// rebuild returns a copy of the current snapshot with clients built from the
+	// credentials files as they are now.
+	rebuild func(current *T) (*T, error)
+	// close releases the clients of a snapshot that is no longer current, if set. It is
+	// given a copy of the snapshot as it was when it was swapped out.
+	close func(retired *T)
+	// mu is held while the files are checked and the clients rebuilt.
+	mu sync.Mutex
+	// stopped is set once the plugin is initialized again, after which the files are no
+	// longer checked.
+	stopped bool
+
+	// usersMu guards the current snapshot and the use of the snapshots.
+	usersMu sync.Mutex
+	current *T
+	// users counts the operations using each snapshot.
+	users map[*T]int
+	// retired are the snapshots that were swapped out while in use, to close once unused.
+	retired map[*T]*T
+}
+
+func newReloader[T any](log logrus.FieldLogger, watcher *credentialsWatcher, current *T, rebuild func(current *T) (*T, error), close func(retired *T)) *reloader[T] {
+	return &reloader[T]{
+		log:     log,
+		watcher: watcher,
+		rebuild: rebuild,
+		close:   close,
+		current: current,
+		users:   map[*T]int{},
+		retired: map[*T]*T{},
+	}
+}
+
+// active returns the current snapshot, after rebuilding it if the credentials files
+// changed, for plugins whose snapshots have no clients to close.
+func (r *reloader[T]) active() *T {
+	current, release := r.acquire()
+	release()
+	return current
+}
+
+// acquire returns the current snapshot, after rebuilding it if the credentials files
+// changed, and a function to call once the operation using it is done. The previous
+// snapshot stays current if rebuilding fails, and rebuilding is retried at the next check.
+func (r *reloader[T]) acquire() (*T, func()) {
+	r.refresh()
+
+	r.usersMu.Lock()
+	defer r.usersMu.Unlock()
+	current := r.current
+	r.users[current]++
+	var once sync.Once
+	return current, func() {
+		once.Do(func() { r.release(current) })
+	}
+}
+
+// refresh rebuilds the current snapshot if the credentials files changed.
+func (r *reloader[T]) refresh() {
+	// Operations that start while the files are checked use the current snapshot rather
+	// than wait.
+	if !r.mu.TryLock() {
+		return
+	}
+	defer r.mu.Unlock()
+
+	if r.stopped {
+		return
+	}
+	sums, changed := r.watcher.changed(time.Now())
+	if !changed {
+		return
+	}
+
+	log := r.log.WithField("paths", r.watcher.paths)
+	r.usersMu.Lock()
+	current := r.current
+	r.usersMu.Unlock()
+	fresh, err := r.rebuild(current)
+	if err != nil {
+		log.WithError(err).Warn("Error reloading changed credentials, carrying on with the previous ones")
+		return
+	}
+	r.replace(fresh)
+	r.watcher.update(sums)
+	log.Info("Reloaded changed credentials")
+}
+
+// replace makes fresh the current snapshot, and retires the previous one.
+func (r *reloader[T]) replace(fresh *T) {
+	r.usersMu.Lock()
+	previous := r.current
+	r.current = fresh
+	closeNow := r.retire(previous)
+	r.usersMu.Unlock()
+	closeNow()
+}
+
+// retire arranges for a snapshot that is no longer current to be closed once unused, and
+// returns the function that closes it if it already is. usersMu must be held.
+func (r *reloader[T]) retire(snapshot *T) func() {
+	if r.close == nil || snapshot == nil {
+		return func() {}
+	}
+	// The snapshot may be the plugin itself, whose clients are replaced if it is
+	// initialized again.
+	retired := *snapshot
+	if r.users[snapshot] > 0 {
+		r.retired[snapshot] = &retired
+		return func() {}
+	}
+	return func() { r.close(&retired) }
+}
+
+// release records the end of an operation using snapshot, and closes the snapshot if it
+// was retired and this was the last operation using it.
+func (r *reloader[T]) release(snapshot *T) {
+	r.usersMu.Lock()
+	r.users[snapshot]--
+	if r.users[snapshot] > 0 {
+		r.usersMu.Unlock()
+		return
+	}
+	delete(r.users, snapshot)
+	retired, ok := r.retired[snapshot]
+	delete(r.retired, snapshot)
+	r.usersMu.Unlock()
+
+	if ok {
+		r.close(retired)
+	}
+}
+
+// stop stops checking the credentials files, once the plugin is initialized again with a
+// config that the snapshots don't reflect, and retires the current snapshot. It waits
+// for a rebuild in progress.
+func (r *reloader[T]) stop() {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.stopped {
+		return
+	}
+	r.stopped = true
+
+	r.usersMu.Lock()
+	closeNow := r.retire(r.current)
+	r.usersMu.Unlock()
+	closeNow()
+}
@@ -0,0 +1,309 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package main
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	velerotest "github.com/vmware-tanzu/velero/pkg/test"
+)
+
+func TestParseCredentialsReloadInterval(t *testing.T) {
+	tests := []struct {
+		name             string
+		config           map[string]string
+		expectedInterval time.Duration
+		expectedError    string
+	}{
+		{
+			name:             "default",
+			config:           map[string]string{},
+			expectedInterval: defaultCredentialsReloadInterval,
+		},
+		{
+			name:             "disabled",
+			config:           map[string]string{credentialsReloadIntervalConfigKey: "0"},
+			expectedInterval: 0,
+		},
+		{
+			name:             "custom",
+			config:           map[string]string{credentialsReloadIntervalConfigKey: "10s"},
+			expectedInterval: 10 * time.Second,
+		},
+		{
+			name:          "negative",
+			config:        map[string]string{credentialsReloadIntervalConfigKey: "-1m"},
+			expectedError: "invalid value for credentialsReloadInterval: -1m must not be negative",
+		},
+		{
+			name:          "invalid",
+			config:        map[string]string{credentialsReloadIntervalConfigKey: "often"},
+			expectedError: `invalid value for credentialsReloadInterval: time: invalid duration "often"`,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			interval, err := parseCredentialsReloadInterval(tc.config)
+			if tc.expectedError != "" {
+				assert.EqualError(t, err, tc.expectedError)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tc.expectedInterval, interval)
+		})
+	}
+}
+
+func TestCredentialsPaths(t *testing.T) {
+	t.Setenv("GOOGLE_APPLICATION_CREDENTIALS", "/var/run/adc.json")
+	t.Setenv("HOME", "/home/velero")
+	assert.Equal(t, []string{"/credentials/cloud"}, credentialsPaths(map[string]string{credentialsFileConfigKey: "/credentials/cloud"}))
+	assert.Equal(t, []string{"/var/run/adc.json"}, credentialsPaths(map[string]string{}))
+
+	t.Setenv("GOOGLE_APPLICATION_CREDENTIALS", "")
+	assert.Equal(t, []string{"/home/velero/.config/gcloud/application_default_credentials.json"}, credentialsPaths(map[string]string{}))
+	assert.Empty(t, credentialsPaths(map[string]string{credentialsBase64ConfigKey: "e30="}))
+}
+
+func TestCredentialsWatcher(t *testing.T) {
+	path := writeTestCredentials(t, "first")
+	now := time.Now()
+	w := newCredentialsWatcher([]string{path}, time.Minute, now)
+
+	require.NoError(t, os.WriteFile(path, []byte("second"), 0600))
+	_, changed := w.changed(now.Add(time.Second))
+	assert.False(t, changed, "checked before the interval elapsed")
+
+	now = now.Add(time.Minute)
+	sums, changed := w.changed(now)
+	assert.True(t, changed)
+	// Changes are reported until the clients are rebuilt from them.
+	now = now.Add(time.Minute)
+	_, changed = w.changed(now)
+	assert.True(t, changed)
+	w.update(sums)
+	now = now.Add(time.Minute)
+	_, changed = w.changed(now)
+	assert.False(t, changed)
+
+	require.NoError(t, os.Remove(path))
+	now = now.Add(time.Minute)
+	_, changed = w.changed(now)
+	assert.True(t, changed)
+}
+
+// writeServiceAccountKey writes a service account key of email, with a new private key,
+// to path.
+func writeServiceAccountKey(t *testing.T, path, email string) {
+	t.Helper()
+	require.NoError(t, os.WriteFile(path, serviceAccountKeyJSON(t, email, "https://oauth2.googleapis.com/token"), 0600))
+}
+
+// serviceAccountKeyJSON returns a service account key of email, with a new private key,
+// whose access tokens are issued by tokenURI.
+func serviceAccountKeyJSON(t *testing.T, email, tokenURI string) []byte {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	require.NoError(t, err)
+
+	b, err := json.Marshal(map[string]string{
+		"type":           "service_account",
+		"project_id":     "project",
+		"private_key_id": "key",
+		"private_key":    string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})),
+		"client_email":   email,
+		"client_id":      "123",
+		"token_uri":      tokenURI,
+	})
+	require.NoError(t, err)
+	return b
+}
+
+func TestReloaderClosesRetiredSnapshots(t *testing.T) {
+	type snapshot struct{ generation int }
+	path := writeTestCredentials(t, "first")
+	var closed []int
+	r := newReloader(velerotest.NewLogger(), newCredentialsWatcher([]string{path}, time.Nanosecond, time.Now()), &snapshot{generation: 1},
+		func(current *snapshot) (*snapshot, error) {
+			return &snapshot{generation: current.generation + 1}, nil
+		},
+		func(retired *snapshot) {
+			closed = append(closed, retired.generation)
+		})
+
+	first, release := r.acquire()
+	assert.Equal(t, 1, first.generation)
+
+	require.NoError(t, os.WriteFile(path, []byte("second"), 0600))
+	second, releaseSecond := r.acquire()
+	assert.Equal(t, 2, second.generation)
+	// The first snapshot is closed once the operation using it is done.
+	assert.Empty(t, closed)
+	release()
+	assert.Equal(t, []int{1}, closed)
+	release()
+	assert.Equal(t, []int{1}, closed)
+
+	// Snapshots that are unused when they are replaced are closed right away.
+	releaseSecond()
+	require.NoError(t, os.WriteFile(path, []byte("third"), 0600))
+	third, releaseThird := r.acquire()
+	assert.Equal(t, 3, third.generation)
+	assert.Equal(t, []int{1, 2}, closed)
+
+	// Stopping retires the current snapshot.
+	r.stop()
+	assert.Equal(t, []int{1, 2}, closed)
+	releaseThird()
+	assert.Equal(t, []int{1, 2, 3}, closed)
+}
+
+func TestObjectStoreReloadsCredentials(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "credentials.json")
+	writeServiceAccountKey(t, path, "first@project.iam.gserviceaccount.com")
+
+	o := newObjectStore(velerotest.NewLogger())
+	require.NoError(t, o.Init(map[string]string{
+		credentialsFileConfigKey:           path,
+		skipPermissionCheckConfigKey:       "true",
+		credentialsReloadIntervalConfigKey: "1ns",
+	}))
+	signedBy := func(email string) {
+		t.Helper()
+		signedURL, err := o.CreateSignedURL("bucket", "key", time.Minute)
+		require.NoError(t, err)
+		assert.Contains(t, signedURL, url.QueryEscape(email))
+	}
+	signedBy("first@project.iam.gserviceaccount.com")
+	inFlight, release := o.acquire()
+	defer release()
+
+	writeServiceAccountKey(t, path, "second@project.iam.gserviceaccount.com")
+	signedBy("second@project.iam.gserviceaccount.com")
+	current, releaseCurrent := o.acquire()
+	releaseCurrent()
+	assert.NotSame(t, inFlight.client, current.client)
+	// Operations that started before keep the clients they started with.
+	assert.Equal(t, "first@project.iam.gserviceaccount.com", inFlight.googleAccessID)
+
+	// Invalid credentials are ignored until they are fixed.
+	require.NoError(t, os.WriteFile(path, []byte("not JSON"), 0600))
+	signedBy("second@project.iam.gserviceaccount.com")
+	writeServiceAccountKey(t, path, "third@project.iam.gserviceaccount.com")
+	signedBy("third@project.iam.gserviceaccount.com")
+}
+
+func TestObjectStoreCredentialsReloadDisabled(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "credentials.json")
+	writeServiceAccountKey(t, path, "first@project.iam.gserviceaccount.com")
+
+	o := newObjectStore(velerotest.NewLogger())
+	require.NoError(t, o.Init(map[string]string{
+		credentialsFileConfigKey:           path,
+		skipPermissionCheckConfigKey:       "true",
+		credentialsReloadIntervalConfigKey: "0",
+	}))
+	assert.Nil(t, o.reload)
+
+	writeServiceAccountKey(t, path, "second@project.iam.gserviceaccount.com")
+	current, release := o.acquire()
+	defer release()
+	assert.Equal(t, "first@project.iam.gserviceaccount.com", current.googleAccessID)
+}
+
+func TestObjectStoreInitAgainStopsReloading(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "credentials.json")
+	writeServiceAccountKey(t, path, "first@project.iam.gserviceaccount.com")
+
+	o := newObjectStore(velerotest.NewLogger())
+	require.NoError(t, o.Init(map[string]string{
+		credentialsFileConfigKey:           path,
+		skipPermissionCheckConfigKey:       "true",
+		credentialsReloadIntervalConfigKey: "1ns",
+	}))
+	previous := o.reload
+
+	writeServiceAccountKey(t, path, "second@project.iam.gserviceaccount.com")
+	require.NoError(t, o.Init(map[string]string{
+		credentialsFileConfigKey:           path,
+		skipPermissionCheckConfigKey:       "true",
+		credentialsReloadIntervalConfigKey: "0",
+	}))
+	assert.Nil(t, o.reload)
+	current, release := o.acquire()
+	release()
+	assert.Same(t, o, current)
+	assert.Equal(t, "second@project.iam.gserviceaccount.com", current.googleAccessID)
+
+	// The previous configuration's snapshot is no longer rebuilt.
+	writeServiceAccountKey(t, path, "third@project.iam.gserviceaccount.com")
+	assert.Same(t, o, previous.active())
+}
+
+func TestVolumeSnapshotterInitAgainStopsReloading(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "credentials.json")
+	writeServiceAccountKey(t, path, "first@project.iam.gserviceaccount.com")
+
+	b := newVolumeSnapshotter(velerotest.NewLogger())
+	require.NoError(t, b.Init(map[string]string{
+		credentialsFileConfigKey:           path,
+		skipPermissionCheckConfigKey:       "true",
+		credentialsReloadIntervalConfigKey: "1ns",
+	}))
+	require.NotNil(t, b.reload)
+
+	require.NoError(t, b.Init(map[string]string{
+		credentialsFileConfigKey:           path,
+		skipPermissionCheckConfigKey:       "true",
+		credentialsReloadIntervalConfigKey: "0",
+	}))
+	assert.Nil(t, b.reload)
+	assert.Same(t, b, b.active())
+}
+
+func TestVolumeSnapshotterReloadsCredentials(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "credentials.json")
+	writeServiceAccountKey(t, path, "first@project.iam.gserviceaccount.com")
+
+	b := newVolumeSnapshotter(velerotest.NewLogger())
+	require.NoError(t, b.Init(map[string]string{
+		credentialsFileConfigKey:           path,
+		skipPermissionCheckConfigKey:       "true",
+		credentialsReloadIntervalConfigKey: "1ns",
+	}))
+	before := b.active()
+	assert.Same(t, before.gce, b.active().gce)
+
+	writeServiceAccountKey(t, path, "second@project.iam.gserviceaccount.com")
+	after := b.active()
+	assert.NotSame(t, before.gce, after.gce)
+	assert.Equal(t, "project", after.volumeProject)
+	assert.Equal(t, "project", after.snapshotProject)
+}
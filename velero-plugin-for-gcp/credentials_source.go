@@ -0,0 +1,182 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"hash/crc32"
+	"os"
+	"os/exec"
+	"regexp"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"google.golang.org/api/option"
+	"google.golang.org/api/secretmanager/v1"
+)
+
+const (
+	credentialsBase64ConfigKey        = "credentialsBase64"
+	credentialsSecretVersionConfigKey = "credentialsSecretVersion"
+	secretManagerEndpointConfigKey    = "secretManagerEndpoint"
+)
+
+// allowExecutablesEnv is the environment variable that external_account credentials
+// sourced from an executable require to be set to "1". It's left to the operator to set
+// on the Velero deployment, since anyone who can edit a location can set its credentials.
+const allowExecutablesEnv = "GOOGLE_EXTERNAL_ACCOUNT_ALLOW_EXECUTABLES"
+
+// secretVersionRegexp matches the resource name of a Secret Manager secret, optionally
+// regional, with or without a version.
+var secretVersionRegexp = regexp.MustCompile(`^projects/[^/]+/(locations/[^/]+/)?secrets/[^/]+(/versions/[^/]+)?$`)
+
+// credentialsJSON returns the credentials JSON of the location, read from the file
+// named by credentialsFile, decoded from credentialsBase64 or accessed from the Secret
+// Manager secret version named by credentialsSecretVersion. It returns nil if none is
+// set, for application default credentials to be used.
+func credentialsJSON(ctx context.Context, log logrus.FieldLogger, config map[string]string) ([]byte, error) {
+	var set []string
+	for _, key := range []string{credentialsFileConfigKey, credentialsBase64ConfigKey, credentialsSecretVersionConfigKey} {
+		if _, ok := config[key]; ok {
+			set = append(set, key)
+		}
+	}
+	if len(set) > 1 {
+		return nil, errors.Errorf("only one of %s can be set", strings.Join(set, ", "))
+	}
+
+	var b []byte
+	if credentialsFile, ok := config[credentialsFileConfigKey]; ok {
+		var err error
+		if b, err = os.ReadFile(credentialsFile); err != nil {
+			return nil, errors.Wrapf(err, "error reading provided credentials file %v", credentialsFile)
+		}
+	} else if encoded, ok := config[credentialsBase64ConfigKey]; ok {
+		var err error
+		if b, err = base64.StdEncoding.DecodeString(strings.TrimSpace(encoded)); err != nil {
+			return nil, errors.Wrapf(err, "invalid value for %s", credentialsBase64ConfigKey)
+		}
+	} else if name, ok := config[credentialsSecretVersionConfigKey]; ok {
+		var err error
+		if b, err = accessSecretVersion(ctx, name, secretManagerOptions(config)...); err != nil {
+			return nil, err
+		}
+	} else {
+		return nil, nil
+	}
+
+	if err := checkCredentialSource(log, b); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// secretManagerOptions returns the options of the Secret Manager client that secrets
+// are accessed with, using application default credentials.
+func secretManagerOptions(config map[string]string) []option.ClientOption {
+	var clientOptions []option.ClientOption
+	if endpoint, ok := config[secretManagerEndpointConfigKey]; ok {
+		clientOptions = append(clientOptions, option.WithEndpoint(endpoint))
+	}
+	if universeDomain, ok := config[universeDomainKey]; ok {
+		clientOptions = append(clientOptions, option.WithUniverseDomain(universeDomain))
+	}
+	return append(clientOptions, quotaProjectOptions(config)...)
+}
+
+// accessSecretVersion returns the payload of a Secret Manager secret version, the latest
+// one if name has no version.
+func accessSecretVersion(ctx context.Context, name string, clientOptions ...option.ClientOption) ([]byte, error) {
+	if !secretVersionRegexp.MatchString(name) {
+		return nil, errors.Errorf("invalid value for %s: %q is not of the form projects/PROJECT/secrets/SECRET/versions/VERSION", credentialsSecretVersionConfigKey, name)
+	}
+	if !strings.Contains(name, "/versions/") {
+		name += "/versions/latest"
+	}
+
+	svc, err := secretmanager.NewService(ctx, clientOptions...)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	resp, err := svc.Projects.Secrets.Versions.Access(name).Context(ctx).Do()
+	if err != nil {
+		return nil, wrapErrorf(err, "error accessing secret version %s", name)
+	}
+	if resp.Payload == nil {
+		return nil, errors.Errorf("secret version %s has no payload", name)
+	}
+
+	data, err := base64.StdEncoding.DecodeString(resp.Payload.Data)
+	if err != nil {
+		return nil, errors.Wrapf(err, "error decoding the payload of secret version %s", name)
+	}
+	if resp.Payload.DataCrc32c != 0 && int64(crc32.Checksum(data, crc32.MakeTable(crc32.Castagnoli))) != resp.Payload.DataCrc32c {
+		return nil, errors.Errorf("the payload of secret version %s doesn't match its checksum", name)
+	}
+	return data, nil
+}
+
+// credentialSource is the credential_source of external_account credentials, which
+// names where the token exchanged for access tokens comes from.
+type credentialSource struct {
+	File       string `json:"file"`
+	Executable *struct {
+		Command string `json:"command"`
+	} `json:"executable"`
+}
+
+// checkCredentialSource verifies the paths that external_account credentials source
+// their tokens from, since credentials passed inline or from a secret reference files
+// in the pod rather than come with them. Executables are only run if allowExecutablesEnv
+// is set, as they are by the GCP libraries. Other credentials are left to them to
+// validate.
+func checkCredentialSource(log logrus.FieldLogger, credsJSON []byte) error {
+	var f struct {
+		Type             credAccountKeys   `json:"type"`
+		CredentialSource *credentialSource `json:"credential_source"`
+	}
+	if err := json.Unmarshal(credsJSON, &f); err != nil || f.Type != externalAccountKey || f.CredentialSource == nil {
+		return nil
+	}
+	source := f.CredentialSource
+
+	if source.File != "" {
+		// The file, such as a projected service account token, may be written after
+		// the plugin starts, so it's only read when a token is needed.
+		if _, err := os.Stat(source.File); err != nil {
+			log.WithError(err).WithField("path", source.File).Warn("File that the external_account credentials source their token from isn't readable yet")
+		}
+	}
+
+	if source.Executable != nil {
+		if os.Getenv(allowExecutablesEnv) != "1" {
+			return errors.Errorf("external_account credentials source their token from an executable, which requires %s=1 to be set on the Velero deployment", allowExecutablesEnv)
+		}
+
+		command := strings.Fields(source.Executable.Command)
+		if len(command) == 0 {
+			return errors.New("external_account credentials have an executable credential source without a command")
+		}
+		if _, err := exec.LookPath(command[0]); err != nil {
+			return errors.Wrap(err, "error finding the executable that the external_account credentials source their token from")
+		}
+	}
+	return nil
+}
@@ -0,0 +1,280 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"hash/crc32"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	velerotest "github.com/vmware-tanzu/velero/pkg/test"
+	"google.golang.org/api/option"
+)
+
+// newSecretManagerServer returns a stand-in for the Secret Manager API serving secrets,
+// by secret version name, to requests authorized with token, and for the OAuth token
+// endpoint that issues token.
+func newSecretManagerServer(t *testing.T, secrets map[string][]byte, token string) *httptest.Server {
+	t.Helper()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if r.URL.Path == "/token" {
+			json.NewEncoder(w).Encode(map[string]any{"access_token": token, "token_type": "Bearer", "expires_in": 3600})
+			return
+		}
+		if token != "" && r.Header.Get("Authorization") != "Bearer "+token {
+			w.WriteHeader(http.StatusUnauthorized)
+			w.Write([]byte(`{"error": {"code": 401, "message": "unauthenticated"}}`))
+			return
+		}
+
+		name, ok := cutAccessPath(r.URL.Path)
+		data, found := secrets[name]
+		if !ok || !found {
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(`{"error": {"code": 404, "message": "secret version not found"}}`))
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]any{
+			"name": name,
+			"payload": map[string]string{
+				"data":       base64.StdEncoding.EncodeToString(data),
+				"dataCrc32c": strconv.FormatUint(uint64(crc32.Checksum(data, crc32.MakeTable(crc32.Castagnoli))), 10),
+			},
+		})
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+// cutAccessPath returns the secret version name accessed by a request to path.
+func cutAccessPath(path string) (string, bool) {
+	name, ok := strings.CutPrefix(path, "/v1/")
+	if !ok {
+		return "", false
+	}
+	return strings.CutSuffix(name, ":access")
+}
+
+func TestAccessSecretVersion(t *testing.T) {
+	srv := newSecretManagerServer(t, map[string][]byte{
+		"projects/p/secrets/velero/versions/latest": []byte("latest credentials"),
+		"projects/p/secrets/velero/versions/3":      []byte("credentials 3"),
+	}, "")
+	clientOptions := []option.ClientOption{option.WithEndpoint(srv.URL), option.WithoutAuthentication()}
+
+	tests := []struct {
+		name          string
+		secretVersion string
+		expectedData  string
+		expectedError string
+	}{
+		{
+			name:          "latest version by default",
+			secretVersion: "projects/p/secrets/velero",
+			expectedData:  "latest credentials",
+		},
+		{
+			name:          "specific version",
+			secretVersion: "projects/p/secrets/velero/versions/3",
+			expectedData:  "credentials 3",
+		},
+		{
+			name:          "missing version",
+			secretVersion: "projects/p/secrets/velero/versions/4",
+			expectedError: "error accessing secret version projects/p/secrets/velero/versions/4",
+		},
+		{
+			name:          "invalid name",
+			secretVersion: "velero",
+			expectedError: `invalid value for credentialsSecretVersion: "velero" is not of the form projects/PROJECT/secrets/SECRET/versions/VERSION`,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			data, err := accessSecretVersion(context.Background(), tc.secretVersion, clientOptions...)
+			if tc.expectedError != "" {
+				assert.ErrorContains(t, err, tc.expectedError)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tc.expectedData, string(data))
+		})
+	}
+}
+
+func TestAccessSecretVersionChecksumMismatch(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"name": "projects/p/secrets/velero/versions/1", "payload": {"data": "Y3JlZGVudGlhbHM=", "dataCrc32c": "1"}}`))
+	}))
+	defer srv.Close()
+
+	_, err := accessSecretVersion(context.Background(), "projects/p/secrets/velero/versions/1", option.WithEndpoint(srv.URL), option.WithoutAuthentication())
+	assert.EqualError(t, err, "the payload of secret version projects/p/secrets/velero/versions/1 doesn't match its checksum")
+}
+
+func TestCredentialsJSON(t *testing.T) {
+	credentials := `{"type": "authorized_user"}`
+	credentialsFile := writeTestCredentials(t, credentials)
+
+	tests := []struct {
+		name          string
+		config        map[string]string
+		expectedJSON  string
+		expectedError string
+	}{
+		{
+			name:   "application default credentials",
+			config: map[string]string{},
+		},
+		{
+			name:         "file",
+			config:       map[string]string{credentialsFileConfigKey: credentialsFile},
+			expectedJSON: credentials,
+		},
+		{
+			name:         "base64",
+			config:       map[string]string{credentialsBase64ConfigKey: base64.StdEncoding.EncodeToString([]byte(credentials)) + "\n"},
+			expectedJSON: credentials,
+		},
+		{
+			name:          "invalid base64",
+			config:        map[string]string{credentialsBase64ConfigKey: "{not base64}"},
+			expectedError: "invalid value for credentialsBase64: illegal base64 data at input byte 0",
+		},
+		{
+			name: "more than one source",
+			config: map[string]string{
+				credentialsFileConfigKey:          credentialsFile,
+				credentialsSecretVersionConfigKey: "projects/p/secrets/velero",
+			},
+			expectedError: "only one of credentialsFile, credentialsSecretVersion can be set",
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			b, err := credentialsJSON(context.Background(), velerotest.NewLogger(), tc.config)
+			if tc.expectedError != "" {
+				assert.EqualError(t, err, tc.expectedError)
+				return
+			}
+			require.NoError(t, err)
+			if tc.expectedJSON == "" {
+				assert.Nil(t, b)
+			} else {
+				assert.Equal(t, tc.expectedJSON, string(b))
+			}
+		})
+	}
+}
+
+func TestCheckCredentialSource(t *testing.T) {
+	executable := func(command string) string {
+		return `{
+  "type": "external_account",
+  "audience": "//iam.googleapis.com/projects/123/locations/global/workloadIdentityPools/POOL/providers/PROVIDER",
+  "subject_token_type": "urn:ietf:params:oauth:token-type:jwt",
+  "token_url": "https://sts.googleapis.com/v1/token",
+  "credential_source": {"executable": {"command": "` + command + `", "timeout_millis": 5000}}
+}`
+	}
+	sh := filepath.Join(t.TempDir(), "token.sh")
+	require.NoError(t, os.WriteFile(sh, []byte("#!/bin/sh\n"), 0700))
+
+	tests := []struct {
+		name          string
+		credentials   string
+		allowEnv      string
+		expectedError string
+	}{
+		{
+			name:        "service account key",
+			credentials: `{"type": "service_account"}`,
+		},
+		{
+			name: "missing token file",
+			credentials: `{
+  "type": "external_account",
+  "credential_source": {"file": "/var/run/missing/token"}
+}`,
+		},
+		{
+			name:          "executable not allowed",
+			credentials:   executable(sh + " --audience velero"),
+			expectedError: "external_account credentials source their token from an executable, which requires GOOGLE_EXTERNAL_ACCOUNT_ALLOW_EXECUTABLES=1 to be set on the Velero deployment",
+		},
+		{
+			name:        "allowed executable",
+			credentials: executable(sh + " --audience velero"),
+			allowEnv:    "1",
+		},
+		{
+			name:          "missing executable",
+			credentials:   executable("/var/run/missing/token.sh"),
+			allowEnv:      "1",
+			expectedError: `error finding the executable that the external_account credentials source their token from: exec: "/var/run/missing/token.sh": stat /var/run/missing/token.sh: no such file or directory`,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			// Restored once the test ends.
+			t.Setenv(allowExecutablesEnv, tc.allowEnv)
+
+			err := checkCredentialSource(velerotest.NewLogger(), []byte(tc.credentials))
+			if tc.expectedError != "" {
+				assert.EqualError(t, err, tc.expectedError)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tc.allowEnv, os.Getenv(allowExecutablesEnv), "the environment was changed")
+		})
+	}
+}
+
+func TestObjectStoreCredentialsFromSecretManager(t *testing.T) {
+	secrets := map[string][]byte{}
+	srv := newSecretManagerServer(t, secrets, "access-token")
+	secrets["projects/p/secrets/velero/versions/latest"] = serviceAccountKeyJSON(t, "secret@project.iam.gserviceaccount.com", srv.URL+"/token")
+
+	// The secret is accessed with application default credentials.
+	adc := filepath.Join(t.TempDir(), "adc.json")
+	require.NoError(t, os.WriteFile(adc, serviceAccountKeyJSON(t, "velero@project.iam.gserviceaccount.com", srv.URL+"/token"), 0600))
+	t.Setenv("GOOGLE_APPLICATION_CREDENTIALS", adc)
+
+	o := newObjectStore(velerotest.NewLogger())
+	require.NoError(t, o.Init(map[string]string{
+		credentialsSecretVersionConfigKey: "projects/p/secrets/velero",
+		secretManagerEndpointConfigKey:    srv.URL,
+		skipPermissionCheckConfigKey:      "true",
+	}))
+	assert.Equal(t, "secret@project.iam.gserviceaccount.com", o.googleAccessID)
+	assert.NotNil(t, o.privateKey)
+	assert.Equal(t, []string{adc}, o.reload.watcher.paths)
+}
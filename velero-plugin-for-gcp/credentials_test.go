@@ -0,0 +1,76 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/api/option"
+)
+
+const testServiceAccountKey = `{"type": "service_account","project_id": "project-a","private_key_id":"id","private_key":"key","client_email":"a@b.com","client_id":"id","auth_uri":"uri","token_uri":"uri","auth_provider_x509_cert_url":"url","client_x509_cert_url":"url"}`
+
+func writeTestCredentials(t *testing.T, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "credentials.json")
+	require.NoError(t, os.WriteFile(path, []byte(content), 0600))
+	return path
+}
+
+func TestParseDelegates(t *testing.T) {
+	assert.Nil(t, parseDelegates(""))
+	assert.Equal(t, []string{"a@p.iam.gserviceaccount.com", "b@p.iam.gserviceaccount.com"},
+		parseDelegates(" a@p.iam.gserviceaccount.com, ,b@p.iam.gserviceaccount.com"))
+}
+
+func TestImpersonatedTokenSource(t *testing.T) {
+	credentialsFile := writeTestCredentials(t, testServiceAccountKey)
+	scopes := []string{"https://www.googleapis.com/auth/cloud-platform"}
+
+	ts, err := impersonatedTokenSource(context.Background(), map[string]string{}, scopes, option.WithCredentialsFile(credentialsFile))
+	require.NoError(t, err)
+	assert.Nil(t, ts)
+
+	_, err = impersonatedTokenSource(context.Background(), map[string]string{
+		impersonateDelegatesConfigKey: "a@p.iam.gserviceaccount.com",
+	}, scopes, option.WithCredentialsFile(credentialsFile))
+	assert.EqualError(t, err, "impersonateDelegates requires impersonateServiceAccount to be set")
+
+	ts, err = impersonatedTokenSource(context.Background(), map[string]string{
+		impersonateServiceAccountConfigKey: "target@p.iam.gserviceaccount.com",
+		impersonateDelegatesConfigKey:      "a@p.iam.gserviceaccount.com",
+	}, scopes, option.WithCredentialsFile(credentialsFile))
+	require.NoError(t, err)
+	assert.NotNil(t, ts)
+}
+
+func TestImpersonatedServiceAccountFromJSON(t *testing.T) {
+	sa, err := impersonatedServiceAccountFromJSON([]byte(`{"type": "impersonated_service_account", "service_account_impersonation_url": "https://iamcredentials.googleapis.com/v1/projects/-/serviceAccounts/velero@p.iam.gserviceaccount.com:generateAccessToken"}`))
+	require.NoError(t, err)
+	assert.Equal(t, "velero@p.iam.gserviceaccount.com", sa)
+
+	sa, err = impersonatedServiceAccountFromJSON([]byte(`{"type": "authorized_user"}`))
+	require.NoError(t, err)
+	assert.Equal(t, "", sa)
+
+	_, err = impersonatedServiceAccountFromJSON([]byte(`{"service_account_impersonation_url": "https://example.com/bad"}`))
+	assert.Error(t, err)
+}
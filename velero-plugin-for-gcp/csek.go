@@ -0,0 +1,140 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"os"
+	"strings"
+
+	"cloud.google.com/go/storage"
+	"github.com/pkg/errors"
+)
+
+const (
+	customerEncryptionKeyFileConfigKey          = "customerEncryptionKeyFile"
+	previousCustomerEncryptionKeyFilesConfigKey = "previousCustomerEncryptionKeyFiles"
+)
+
+// customerKeys holds the customer-supplied encryption keys (CSEK) of a BSL. New objects
+// are encrypted with the current key; previous keys are kept so that objects written
+// before a rotation can still be read.
+type customerKeys struct {
+	current []byte
+	// bySHA256 maps the base64-encoded SHA256 of every key, as reported by GCS in the
+	// object's attributes, to the key.
+	bySHA256 map[string][]byte
+}
+
+// loadCustomerKeys reads the keys named by the BSL config. It returns nil if no
+// customer-supplied key is configured.
+func loadCustomerKeys(config map[string]string) (*customerKeys, error) {
+	currentFile, ok := config[customerEncryptionKeyFileConfigKey]
+	if !ok {
+		if _, ok := config[previousCustomerEncryptionKeyFilesConfigKey]; ok {
+			return nil, errors.Errorf("%s requires %s to be set", previousCustomerEncryptionKeyFilesConfigKey, customerEncryptionKeyFileConfigKey)
+		}
+		return nil, nil
+	}
+	if _, ok := config[kmsKeyNameConfigKey]; ok {
+		return nil, errors.Errorf("%s and %s cannot both be set", kmsKeyNameConfigKey, customerEncryptionKeyFileConfigKey)
+	}
+
+	k := &customerKeys{bySHA256: map[string][]byte{}}
+	var err error
+	if k.current, err = readCustomerKey(currentFile); err != nil {
+		return nil, err
+	}
+	k.bySHA256[customerKeySHA256(k.current)] = k.current
+
+	for _, file := range strings.Split(config[previousCustomerEncryptionKeyFilesConfigKey], ",") {
+		if file = strings.TrimSpace(file); file == "" {
+			continue
+		}
+		key, err := readCustomerKey(file)
+		if err != nil {
+			return nil, err
+		}
+		k.bySHA256[customerKeySHA256(key)] = key
+	}
+	return k, nil
+}
+
+// readCustomerKey reads a base64-encoded AES-256 key from file.
+func readCustomerKey(file string) ([]byte, error) {
+	b, err := os.ReadFile(file)
+	if err != nil {
+		return nil, errors.Wrapf(err, "error reading customer encryption key file %s", file)
+	}
+	key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(b)))
+	if err != nil {
+		return nil, errors.Wrapf(err, "customer encryption key file %s must contain a base64-encoded key", file)
+	}
+	if len(key) != 32 {
+		return nil, errors.Errorf("customer encryption key in %s must be 32 bytes for AES-256, got %d", file, len(key))
+	}
+	return key, nil
+}
+
+func customerKeySHA256(key []byte) string {
+	sum := sha256.Sum256(key)
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// writeHandle returns obj set up to encrypt with the current key.
+func (k *customerKeys) writeHandle(obj *storage.ObjectHandle) *storage.ObjectHandle {
+	if k == nil {
+		return obj
+	}
+	return obj.Key(k.current)
+}
+
+// readHandle returns obj set up with the key the object was encrypted with, which is
+// looked up from the object's attributes. Objects that aren't encrypted with a
+// customer-supplied key are returned unchanged.
+func (k *customerKeys) readHandle(ctx context.Context, obj *storage.ObjectHandle) (*storage.ObjectHandle, error) {
+	if k == nil {
+		return obj, nil
+	}
+
+	// Metadata can be read without the key, and includes the key's hash.
+	attrs, err := obj.Attrs(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return k.keyedHandle(obj, attrs)
+}
+
+// keyedHandle returns obj set up with the key the object described by attrs was
+// encrypted with.
+func (k *customerKeys) keyedHandle(obj *storage.ObjectHandle, attrs *storage.ObjectAttrs) (*storage.ObjectHandle, error) {
+	if attrs.CustomerKeySHA256 == "" {
+		return obj, nil
+	}
+	if k == nil {
+		return nil, errors.Errorf("object %s is encrypted with a customer-supplied key, but %s is not set", obj.ObjectName(), customerEncryptionKeyFileConfigKey)
+	}
+
+	key, ok := k.bySHA256[attrs.CustomerKeySHA256]
+	if !ok {
+		return nil, errors.Errorf("object %s is encrypted with a customer-supplied key (SHA256 %s) that is neither %s nor in %s",
+			obj.ObjectName(), attrs.CustomerKeySHA256, customerEncryptionKeyFileConfigKey, previousCustomerEncryptionKeyFilesConfigKey)
+	}
+	return obj.Key(key), nil
+}
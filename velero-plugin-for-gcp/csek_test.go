@@ -0,0 +1,116 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"cloud.google.com/go/storage"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/api/option"
+)
+
+func writeTestCustomerKey(t *testing.T, b byte) ([]byte, string) {
+	t.Helper()
+	key := make([]byte, 32)
+	for i := range key {
+		key[i] = b
+	}
+	return key, writeTestCredentials(t, base64.StdEncoding.EncodeToString(key)+"\n")
+}
+
+func TestLoadCustomerKeys(t *testing.T) {
+	current, currentFile := writeTestCustomerKey(t, 1)
+	previous, previousFile := writeTestCustomerKey(t, 2)
+	shortFile := writeTestCredentials(t, base64.StdEncoding.EncodeToString([]byte("short")))
+
+	keys, err := loadCustomerKeys(map[string]string{})
+	require.NoError(t, err)
+	assert.Nil(t, keys)
+
+	keys, err = loadCustomerKeys(map[string]string{
+		customerEncryptionKeyFileConfigKey:          currentFile,
+		previousCustomerEncryptionKeyFilesConfigKey: previousFile + ", ",
+	})
+	require.NoError(t, err)
+	assert.Equal(t, current, keys.current)
+	assert.Equal(t, current, keys.bySHA256[customerKeySHA256(current)])
+	assert.Equal(t, previous, keys.bySHA256[customerKeySHA256(previous)])
+
+	_, err = loadCustomerKeys(map[string]string{customerEncryptionKeyFileConfigKey: shortFile})
+	assert.ErrorContains(t, err, "must be 32 bytes for AES-256, got 5")
+
+	_, err = loadCustomerKeys(map[string]string{
+		customerEncryptionKeyFileConfigKey: currentFile,
+		kmsKeyNameConfigKey:                "projects/p/locations/l/keyRings/r/cryptoKeys/k",
+	})
+	assert.EqualError(t, err, "kmsKeyName and customerEncryptionKeyFile cannot both be set")
+
+	_, err = loadCustomerKeys(map[string]string{previousCustomerEncryptionKeyFilesConfigKey: previousFile})
+	assert.EqualError(t, err, "previousCustomerEncryptionKeyFiles requires customerEncryptionKeyFile to be set")
+}
+
+func TestCustomerKeysReadHandle(t *testing.T) {
+	_, currentFile := writeTestCustomerKey(t, 1)
+	previous, previousFile := writeTestCustomerKey(t, 2)
+	keys, err := loadCustomerKeys(map[string]string{
+		customerEncryptionKeyFileConfigKey:          currentFile,
+		previousCustomerEncryptionKeyFilesConfigKey: previousFile,
+	})
+	require.NoError(t, err)
+
+	// objects maps object names to the SHA256 of the key they are encrypted with.
+	objects := map[string]string{
+		"plain":    "",
+		"previous": customerKeySHA256(previous),
+		"unknown":  customerKeySHA256(make([]byte, 32)),
+	}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for name, sha := range objects {
+			if r.URL.Path != "/storage/v1/b/bucket/o/"+name {
+				continue
+			}
+			encryption := ""
+			if sha != "" {
+				encryption = fmt.Sprintf(`, "customerEncryption": {"encryptionAlgorithm": "AES256", "keySha256": %q}`, sha)
+			}
+			fmt.Fprintf(w, `{"bucket": "bucket", "name": %q%s}`, name, encryption)
+			return
+		}
+		http.NotFound(w, r)
+	}))
+	defer srv.Close()
+
+	client, err := storage.NewClient(context.Background(), option.WithEndpoint(srv.URL+"/storage/v1/"), option.WithoutAuthentication())
+	require.NoError(t, err)
+
+	for _, name := range []string{"plain", "previous"} {
+		_, err := keys.readHandle(context.Background(), client.Bucket("bucket").Object(name))
+		assert.NoError(t, err, name)
+	}
+
+	_, err = keys.readHandle(context.Background(), client.Bucket("bucket").Object("unknown"))
+	assert.ErrorContains(t, err, "object unknown is encrypted with a customer-supplied key")
+
+	_, err = keys.readHandle(context.Background(), client.Bucket("bucket").Object("missing"))
+	assert.ErrorIs(t, err, storage.ErrObjectNotExist)
+}
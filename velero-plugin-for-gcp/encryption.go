@@ -0,0 +1,423 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+	"google.golang.org/api/cloudkms/v1"
+	"google.golang.org/api/option"
+)
+
+const (
+	clientSideEncryptionKeyFileConfigKey    = "clientSideEncryptionKeyFile"
+	clientSideEncryptionKMSKeyNameConfigKey = "clientSideEncryptionKMSKeyName"
+)
+
+// Metadata set on client-side encrypted objects. Objects without encryptionMetadataKey
+// are read as they are stored.
+const (
+	encryptionMetadataKey           = "velero-encryption"
+	encryptionKeyIDMetadataKey      = "velero-encryption-key-id"
+	encryptionWrappedKeyMetadataKey = "velero-encryption-wrapped-key"
+	encryptionNonceMetadataKey      = "velero-encryption-nonce-prefix"
+	encryptionChunkSizeMetadataKey  = "velero-encryption-chunk-size"
+
+	encryptionAlgorithm = "AES256-GCM-STREAM-v1"
+)
+
+const (
+	// encryptionChunkSize is the size of the plaintext sealed in each chunk.
+	encryptionChunkSize = 64 * 1024
+	// maxEncryptionChunkSize bounds the chunk size read from metadata.
+	maxEncryptionChunkSize = 16 * 1024 * 1024
+
+	// A chunk's nonce is the object's random prefix, followed by the big-endian chunk
+	// index and a byte set to 1 on the last chunk only, so that chunks can't be
+	// reordered, dropped or truncated without failing authentication.
+	encryptionNoncePrefixSize = 7
+)
+
+// keyWrapper protects the data keys of encrypted objects with a key encryption key.
+type keyWrapper interface {
+	// keyID identifies the key encryption key, and is stored with each object.
+	keyID() string
+	wrapKey(ctx context.Context, dataKey []byte) ([]byte, error)
+	unwrapKey(ctx context.Context, keyID string, wrapped []byte) ([]byte, error)
+}
+
+// clientEncryption encrypts objects before they are uploaded, so that their contents
+// can't be read with access to the bucket alone. Each object is encrypted with its own
+// data key, which is stored wrapped in the object's metadata.
+type clientEncryption struct {
+	wrapper keyWrapper
+}
+
+// newClientEncryption sets up the encryption configured on the BSL. It returns nil if
+// client-side encryption isn't configured. baseOptions carry the credentials to call
+// Cloud KMS with, unless a service account is impersonated.
+func newClientEncryption(ctx context.Context, config map[string]string, baseOptions []option.ClientOption) (*clientEncryption, error) {
+	keyFile, hasKeyFile := config[clientSideEncryptionKeyFileConfigKey]
+	kmsKeyName, hasKMSKey := config[clientSideEncryptionKMSKeyNameConfigKey]
+
+	switch {
+	case hasKeyFile && hasKMSKey:
+		return nil, errors.Errorf("%s and %s cannot both be set", clientSideEncryptionKeyFileConfigKey, clientSideEncryptionKMSKeyNameConfigKey)
+	case hasKeyFile:
+		wrapper, err := newLocalKeyWrapper(keyFile)
+		if err != nil {
+			return nil, err
+		}
+		return &clientEncryption{wrapper: wrapper}, nil
+	case hasKMSKey:
+		kmsOptions := append([]option.ClientOption{option.WithScopes(cloudkms.CloudkmsScope)}, baseOptions...)
+		ts, err := impersonatedTokenSource(ctx, config, []string{cloudkms.CloudkmsScope}, baseOptions...)
+		if err != nil {
+			return nil, err
+		}
+		if ts != nil {
+			kmsOptions = []option.ClientOption{option.WithTokenSource(ts)}
+		}
+		svc, err := cloudkms.NewService(ctx, kmsOptions...)
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		return &clientEncryption{wrapper: &kmsKeyWrapper{svc: svc, keyName: kmsKeyName}}, nil
+	}
+	return nil, nil
+}
+
+// objectEncryptor encrypts a single object.
+type objectEncryptor struct {
+	aead     cipher.AEAD
+	prefix   []byte
+	metadata map[string]string
+}
+
+// newObjectEncryptor generates and wraps the data key of a new object.
+func (e *clientEncryption) newObjectEncryptor(ctx context.Context) (*objectEncryptor, error) {
+	dataKey := make([]byte, 32)
+	prefix := make([]byte, encryptionNoncePrefixSize)
+	for _, b := range [][]byte{dataKey, prefix} {
+		if _, err := rand.Read(b); err != nil {
+			return nil, errors.WithStack(err)
+		}
+	}
+
+	wrapped, err := e.wrapper.wrapKey(ctx, dataKey)
+	if err != nil {
+		return nil, errors.Wrap(err, "error wrapping data encryption key")
+	}
+	aead, err := newGCM(dataKey)
+	if err != nil {
+		return nil, err
+	}
+
+	return &objectEncryptor{
+		aead:   aead,
+		prefix: prefix,
+		metadata: map[string]string{
+			encryptionMetadataKey:           encryptionAlgorithm,
+			encryptionKeyIDMetadataKey:      e.wrapper.keyID(),
+			encryptionWrappedKeyMetadataKey: base64.StdEncoding.EncodeToString(wrapped),
+			encryptionNonceMetadataKey:      base64.StdEncoding.EncodeToString(prefix),
+			encryptionChunkSizeMetadataKey:  strconv.Itoa(encryptionChunkSize),
+		},
+	}, nil
+}
+
+// writer returns a writer that encrypts to w. Closing it writes the last chunk and closes w.
+func (oe *objectEncryptor) writer(w io.WriteCloser) io.WriteCloser {
+	return &encryptingWriter{
+		w:         w,
+		aead:      oe.aead,
+		prefix:    oe.prefix,
+		chunkSize: encryptionChunkSize,
+		buf:       make([]byte, 0, encryptionChunkSize),
+	}
+}
+
+// newDecryptingReader returns a reader that decrypts r according to the object's
+// metadata, or r itself if the object isn't client-side encrypted.
+func (e *clientEncryption) newDecryptingReader(ctx context.Context, key string, metadata map[string]string, r io.ReadCloser) (io.ReadCloser, error) {
+	algorithm, ok := metadata[encryptionMetadataKey]
+	if !ok {
+		return r, nil
+	}
+
+	reader, err := e.decryptingReader(ctx, algorithm, metadata, r)
+	if err != nil {
+		r.Close()
+		return nil, errors.Wrapf(err, "error decrypting object %s", key)
+	}
+	return reader, nil
+}
+
+func (e *clientEncryption) decryptingReader(ctx context.Context, algorithm string, metadata map[string]string, r io.ReadCloser) (io.ReadCloser, error) {
+	if algorithm != encryptionAlgorithm {
+		return nil, errors.Errorf("unsupported encryption algorithm %q", algorithm)
+	}
+	wrapped, err := base64.StdEncoding.DecodeString(metadata[encryptionWrappedKeyMetadataKey])
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid wrapped data key")
+	}
+	prefix, err := base64.StdEncoding.DecodeString(metadata[encryptionNonceMetadataKey])
+	if err != nil || len(prefix) != encryptionNoncePrefixSize {
+		return nil, errors.New("invalid nonce prefix")
+	}
+	chunkSize, err := strconv.Atoi(metadata[encryptionChunkSizeMetadataKey])
+	if err != nil || chunkSize <= 0 || chunkSize > maxEncryptionChunkSize {
+		return nil, errors.Errorf("invalid chunk size %q", metadata[encryptionChunkSizeMetadataKey])
+	}
+
+	dataKey, err := e.wrapper.unwrapKey(ctx, metadata[encryptionKeyIDMetadataKey], wrapped)
+	if err != nil {
+		return nil, errors.Wrap(err, "error unwrapping data encryption key")
+	}
+	aead, err := newGCM(dataKey)
+	if err != nil {
+		return nil, err
+	}
+
+	sealedSize := chunkSize + aead.Overhead()
+	return &decryptingReader{
+		r:         r,
+		br:        bufio.NewReaderSize(r, sealedSize+1),
+		aead:      aead,
+		prefix:    prefix,
+		sealed:    make([]byte, sealedSize),
+		plaintext: make([]byte, 0, chunkSize),
+	}, nil
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	aead, err := cipher.NewGCM(block)
+	return aead, errors.WithStack(err)
+}
+
+func chunkNonce(prefix []byte, index uint32, last bool) []byte {
+	nonce := make([]byte, 0, encryptionNoncePrefixSize+5)
+	nonce = append(nonce, prefix...)
+	nonce = binary.BigEndian.AppendUint32(nonce, index)
+	if last {
+		return append(nonce, 1)
+	}
+	return append(nonce, 0)
+}
+
+// encryptingWriter seals the data written to it in chunks. A full chunk is only sealed
+// once more data arrives, since the last chunk is sealed differently.
+type encryptingWriter struct {
+	w         io.WriteCloser
+	aead      cipher.AEAD
+	prefix    []byte
+	index     uint32
+	chunkSize int
+	buf       []byte
+	sealed    []byte
+}
+
+func (e *encryptingWriter) Write(p []byte) (int, error) {
+	var n int
+	for len(p) > 0 {
+		if len(e.buf) == e.chunkSize {
+			if err := e.seal(false); err != nil {
+				return n, err
+			}
+		}
+		c := copy(e.buf[len(e.buf):e.chunkSize], p)
+		e.buf = e.buf[:len(e.buf)+c]
+		p = p[c:]
+		n += c
+	}
+	return n, nil
+}
+
+func (e *encryptingWriter) seal(last bool) error {
+	if e.index == ^uint32(0) {
+		return errors.New("object is too large to encrypt")
+	}
+	e.sealed = e.aead.Seal(e.sealed[:0], chunkNonce(e.prefix, e.index, last), e.buf, nil)
+	e.index++
+	e.buf = e.buf[:0]
+	_, err := e.w.Write(e.sealed)
+	return err
+}
+
+func (e *encryptingWriter) Close() error {
+	sealErr := e.seal(true)
+	closeErr := e.w.Close()
+	if sealErr != nil {
+		return sealErr
+	}
+	return closeErr
+}
+
+// decryptingReader opens the chunks written by encryptingWriter.
+type decryptingReader struct {
+	r         io.ReadCloser
+	br        *bufio.Reader
+	aead      cipher.AEAD
+	prefix    []byte
+	index     uint32
+	sealed    []byte
+	plaintext []byte
+	pos       int
+	done      bool
+}
+
+func (d *decryptingReader) Read(p []byte) (int, error) {
+	for d.pos == len(d.plaintext) {
+		if d.done {
+			return 0, io.EOF
+		}
+		if err := d.open(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, d.plaintext[d.pos:])
+	d.pos += n
+	return n, nil
+}
+
+// open reads and authenticates the next chunk.
+func (d *decryptingReader) open() error {
+	n, err := io.ReadFull(d.br, d.sealed)
+	var last bool
+	switch {
+	case err == io.EOF || err == io.ErrUnexpectedEOF:
+		last = true
+	case err != nil:
+		return err
+	default:
+		// A full chunk is the last one if nothing follows it.
+		if _, err := d.br.Peek(1); err == io.EOF {
+			last = true
+		} else if err != nil {
+			return err
+		}
+	}
+
+	if n < d.aead.Overhead() {
+		return errors.New("encrypted object is truncated")
+	}
+	d.plaintext, err = d.aead.Open(d.plaintext[:0], chunkNonce(d.prefix, d.index, last), d.sealed[:n], nil)
+	if err != nil {
+		return errors.New("encrypted object failed authentication: it is corrupted or truncated")
+	}
+	d.index++
+	d.pos = 0
+	d.done = last
+	return nil
+}
+
+func (d *decryptingReader) Close() error {
+	return d.r.Close()
+}
+
+// localKeyWrapper wraps data keys with AES-256-GCM using a key read from a file.
+type localKeyWrapper struct {
+	id   string
+	aead cipher.AEAD
+}
+
+func newLocalKeyWrapper(file string) (*localKeyWrapper, error) {
+	key, err := readCustomerKey(file)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	// Identify the key by its hash, so objects encrypted with another key are reported
+	// as such rather than as corrupted.
+	return &localKeyWrapper{id: "local:" + customerKeySHA256(key), aead: aead}, nil
+}
+
+func (l *localKeyWrapper) keyID() string {
+	return l.id
+}
+
+func (l *localKeyWrapper) wrapKey(_ context.Context, dataKey []byte) ([]byte, error) {
+	nonce := make([]byte, l.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return l.aead.Seal(nonce, nonce, dataKey, nil), nil
+}
+
+func (l *localKeyWrapper) unwrapKey(_ context.Context, keyID string, wrapped []byte) ([]byte, error) {
+	if keyID != l.id {
+		return nil, errors.Errorf("object was encrypted with key %s, but %s is configured", keyID, l.id)
+	}
+	if len(wrapped) < l.aead.NonceSize() {
+		return nil, errors.New("wrapped data key is truncated")
+	}
+	nonce, sealed := wrapped[:l.aead.NonceSize()], wrapped[l.aead.NonceSize():]
+	dataKey, err := l.aead.Open(nil, nonce, sealed, nil)
+	return dataKey, errors.WithStack(err)
+}
+
+// kmsKeyWrapper wraps data keys with a Cloud KMS symmetric key. Objects record the key
+// they were wrapped with, so they stay readable after the BSL switches to another key.
+type kmsKeyWrapper struct {
+	svc     *cloudkms.Service
+	keyName string
+}
+
+func (k *kmsKeyWrapper) keyID() string {
+	return "kms:" + k.keyName
+}
+
+func (k *kmsKeyWrapper) wrapKey(ctx context.Context, dataKey []byte) ([]byte, error) {
+	resp, err := k.svc.Projects.Locations.KeyRings.CryptoKeys.Encrypt(k.keyName, &cloudkms.EncryptRequest{
+		Plaintext: base64.StdEncoding.EncodeToString(dataKey),
+	}).Context(ctx).Do()
+	if err != nil {
+		return nil, wrapError(err)
+	}
+	return base64.StdEncoding.DecodeString(resp.Ciphertext)
+}
+
+func (k *kmsKeyWrapper) unwrapKey(ctx context.Context, keyID string, wrapped []byte) ([]byte, error) {
+	keyName, ok := strings.CutPrefix(keyID, "kms:")
+	if !ok {
+		return nil, errors.Errorf("object was encrypted with key %s, but %s is configured", keyID, k.keyID())
+	}
+	resp, err := k.svc.Projects.Locations.KeyRings.CryptoKeys.Decrypt(keyName, &cloudkms.DecryptRequest{
+		Ciphertext: base64.StdEncoding.EncodeToString(wrapped),
+	}).Context(ctx).Do()
+	if err != nil {
+		return nil, wrapError(err)
+	}
+	return base64.StdEncoding.DecodeString(resp.Plaintext)
+}
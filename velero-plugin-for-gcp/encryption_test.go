@@ -0,0 +1,215 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	velerotest "github.com/vmware-tanzu/velero/pkg/test"
+	"google.golang.org/api/cloudkms/v1"
+	"google.golang.org/api/option"
+)
+
+// bufferWriteCloser records the data uploaded through it.
+type bufferWriteCloser struct {
+	bytes.Buffer
+	closed bool
+}
+
+func (b *bufferWriteCloser) Close() error {
+	b.closed = true
+	return nil
+}
+
+func newTestClientEncryption(t *testing.T, keyByte byte) *clientEncryption {
+	t.Helper()
+	_, keyFile := writeTestCustomerKey(t, keyByte)
+	e, err := newClientEncryption(context.Background(), map[string]string{clientSideEncryptionKeyFileConfigKey: keyFile}, nil)
+	require.NoError(t, err)
+	return e
+}
+
+// encryptTestObject encrypts data as PutObject would, returning the stored bytes and metadata.
+func encryptTestObject(t *testing.T, e *clientEncryption, data []byte) ([]byte, map[string]string) {
+	t.Helper()
+	encryptor, err := e.newObjectEncryptor(context.Background())
+	require.NoError(t, err)
+
+	out := new(bufferWriteCloser)
+	w := encryptor.writer(out)
+	_, err = io.Copy(w, bytes.NewReader(data))
+	require.NoError(t, err)
+	require.NoError(t, w.Close())
+	require.True(t, out.closed)
+	return out.Bytes(), encryptor.metadata
+}
+
+func decryptTestObject(e *clientEncryption, stored []byte, metadata map[string]string) ([]byte, error) {
+	r, err := e.newDecryptingReader(context.Background(), "backups/b1.tar.gz", metadata, io.NopCloser(bytes.NewReader(stored)))
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return io.ReadAll(r)
+}
+
+func TestClientEncryptionRoundTrip(t *testing.T) {
+	e := newTestClientEncryption(t, 1)
+
+	for _, size := range []int{0, 1, encryptionChunkSize - 1, encryptionChunkSize, encryptionChunkSize + 1, 3*encryptionChunkSize + 17} {
+		data := make([]byte, size)
+		_, err := rand.Read(data)
+		require.NoError(t, err)
+
+		stored, metadata := encryptTestObject(t, e, data)
+		assert.Equal(t, encryptionAlgorithm, metadata[encryptionMetadataKey])
+		// Shorter plaintexts may appear in the ciphertext by chance.
+		if size >= 16 {
+			assert.NotContains(t, string(stored), string(data[:min(size, 64)]))
+		}
+
+		decrypted, err := decryptTestObject(e, stored, metadata)
+		require.NoError(t, err, "size %d", size)
+		assert.Equal(t, data, decrypted, "size %d", size)
+	}
+}
+
+func TestClientEncryptionDetectsTampering(t *testing.T) {
+	e := newTestClientEncryption(t, 1)
+	data := bytes.Repeat([]byte("velero"), encryptionChunkSize)
+	stored, metadata := encryptTestObject(t, e, data)
+	sealedChunk := encryptionChunkSize + 16
+
+	flipped := bytes.Clone(stored)
+	flipped[10] ^= 1
+
+	tests := []struct {
+		name   string
+		stored []byte
+	}{
+		{name: "modified byte", stored: flipped},
+		{name: "truncated at a chunk boundary", stored: stored[:2*sealedChunk]},
+		{name: "truncated mid-chunk", stored: stored[:2*sealedChunk+100]},
+		{name: "chunks reordered", stored: append(append(bytes.Clone(stored[sealedChunk:2*sealedChunk]), stored[:sealedChunk]...), stored[2*sealedChunk:]...)},
+		{name: "empty", stored: nil},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := decryptTestObject(e, tc.stored, metadata)
+			assert.Error(t, err)
+		})
+	}
+}
+
+func TestClientEncryptionReadsUnencryptedObjects(t *testing.T) {
+	e := newTestClientEncryption(t, 1)
+
+	decrypted, err := decryptTestObject(e, []byte("legacy backup"), map[string]string{"other": "value"})
+	require.NoError(t, err)
+	assert.Equal(t, "legacy backup", string(decrypted))
+}
+
+func TestClientEncryptionWrongKey(t *testing.T) {
+	stored, metadata := encryptTestObject(t, newTestClientEncryption(t, 1), []byte("backup"))
+
+	_, err := decryptTestObject(newTestClientEncryption(t, 2), stored, metadata)
+	assert.ErrorContains(t, err, "error decrypting object backups/b1.tar.gz: error unwrapping data encryption key: object was encrypted with key local:")
+}
+
+func TestNewClientEncryption(t *testing.T) {
+	_, keyFile := writeTestCustomerKey(t, 1)
+
+	e, err := newClientEncryption(context.Background(), map[string]string{}, nil)
+	require.NoError(t, err)
+	assert.Nil(t, e)
+
+	_, err = newClientEncryption(context.Background(), map[string]string{
+		clientSideEncryptionKeyFileConfigKey:    keyFile,
+		clientSideEncryptionKMSKeyNameConfigKey: "projects/p/locations/l/keyRings/r/cryptoKeys/k",
+	}, nil)
+	assert.EqualError(t, err, "clientSideEncryptionKeyFile and clientSideEncryptionKMSKeyName cannot both be set")
+}
+
+func TestKMSKeyWrapper(t *testing.T) {
+	const keyName = "projects/p/locations/l/keyRings/r/cryptoKeys/k"
+
+	// The fake KMS "encrypts" by prefixing the plaintext with the key name.
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var resp interface{}
+		switch {
+		case r.URL.Path == "/v1/"+keyName+":encrypt":
+			var req cloudkms.EncryptRequest
+			require.NoError(t, json.NewDecoder(r.Body).Decode(&req))
+			plaintext, err := base64.StdEncoding.DecodeString(req.Plaintext)
+			require.NoError(t, err)
+			resp = cloudkms.EncryptResponse{Ciphertext: base64.StdEncoding.EncodeToString(append([]byte(keyName), plaintext...))}
+		case r.URL.Path == "/v1/"+keyName+":decrypt":
+			var req cloudkms.DecryptRequest
+			require.NoError(t, json.NewDecoder(r.Body).Decode(&req))
+			ciphertext, err := base64.StdEncoding.DecodeString(req.Ciphertext)
+			require.NoError(t, err)
+			resp = cloudkms.DecryptResponse{Plaintext: base64.StdEncoding.EncodeToString([]byte(strings.TrimPrefix(string(ciphertext), keyName)))}
+		default:
+			http.Error(w, `{"error": {"code": 404, "message": "not found"}}`, http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		require.NoError(t, json.NewEncoder(w).Encode(resp))
+	}))
+	defer srv.Close()
+
+	e, err := newClientEncryption(context.Background(), map[string]string{clientSideEncryptionKMSKeyNameConfigKey: keyName},
+		[]option.ClientOption{option.WithEndpoint(srv.URL), option.WithoutAuthentication()})
+	require.NoError(t, err)
+
+	stored, metadata := encryptTestObject(t, e, []byte("backup"))
+	assert.Equal(t, "kms:"+keyName, metadata[encryptionKeyIDMetadataKey])
+
+	decrypted, err := decryptTestObject(e, stored, metadata)
+	require.NoError(t, err)
+	assert.Equal(t, "backup", string(decrypted))
+}
+
+func TestPutObjectClientEncryption(t *testing.T) {
+	e := newTestClientEncryption(t, 1)
+	w := newFakeWriter(newMockWriteCloser(nil, nil))
+	o := &ObjectStore{log: velerotest.NewLogger(), bucketWriter: w, encryption: e}
+
+	require.NoError(t, o.PutObject("bucket", "backups/b1.tar.gz", strings.NewReader("backup")))
+	assert.Equal(t, encryptionAlgorithm, w.opts.metadata[encryptionMetadataKey])
+	assert.True(t, strings.HasPrefix(w.opts.metadata[encryptionKeyIDMetadataKey], "local:"))
+}
+
+func TestCreateSignedURLClientEncryption(t *testing.T) {
+	o := newObjectStore(velerotest.NewLogger())
+	o.googleAccessID = "velero@p.iam.gserviceaccount.com"
+	o.encryption = newTestClientEncryption(t, 1)
+
+	_, err := o.CreateSignedURL("bucket", "backups/b1.tar.gz", time.Minute)
+	assert.EqualError(t, err, "signed URLs are not supported with client-side encryption, since they would serve the encrypted contents of the object")
+}
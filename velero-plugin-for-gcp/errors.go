@@ -0,0 +1,248 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+
+	"github.com/googleapis/gax-go/v2/apierror"
+	"github.com/pkg/errors"
+	"google.golang.org/api/googleapi"
+	"google.golang.org/grpc/codes"
+)
+
+type errorCategory string
+
+const (
+	errorCategoryPermission         errorCategory = "permission denied"
+	errorCategoryAuthentication     errorCategory = "authentication failed"
+	errorCategoryVPCServiceControls errorCategory = "blocked by VPC Service Controls"
+	errorCategoryOrgPolicy          errorCategory = "blocked by organization policy"
+	errorCategoryKMS                errorCategory = "Cloud KMS key unusable"
+	errorCategoryQuota              errorCategory = "quota or rate limit exceeded"
+	errorCategoryNotFound           errorCategory = "not found"
+	errorCategoryPrecondition       errorCategory = "precondition failed"
+)
+
+// permissionRegexp matches IAM permission names such as "storage.objects.create"
+// or "compute.snapshots.setLabels" in GCP error messages.
+var permissionRegexp = regexp.MustCompile(`\b(?:storage|compute|iam|cloudkms|resourcemanager|serviceusage)\.[a-zA-Z]+\.[a-zA-Z]+\b`)
+
+// gcpError is a Google API error that has been classified so operators can tell,
+// for example, a missing IAM permission from a VPC Service Controls violation.
+type gcpError struct {
+	category   errorCategory
+	permission string
+	hint       string
+	err        error
+}
+
+func (e *gcpError) Error() string {
+	msg := string(e.category)
+	if e.permission != "" {
+		msg += fmt.Sprintf(" (missing permission %s)", e.permission)
+	}
+	if e.hint != "" {
+		msg += " - " + e.hint
+	}
+	return msg + ": " + e.err.Error()
+}
+
+func (e *gcpError) Unwrap() error {
+	return e.err
+}
+
+// classifyError inspects the reasons, details and status code of a Google API
+// error and returns a *gcpError describing it. Errors that are not Google API
+// errors, or that cannot be classified, are returned unchanged.
+func classifyError(err error) error {
+	if err == nil {
+		return nil
+	}
+	var classified *gcpError
+	if errors.As(err, &classified) {
+		return err
+	}
+
+	apiErr, ok := apierror.FromError(err)
+	if !ok {
+		return err
+	}
+
+	code := apiErr.HTTPCode()
+	if code == -1 && apiErr.GRPCStatus() != nil {
+		code = httpCodeFromGRPC(apiErr.GRPCStatus().Code())
+	}
+
+	reasons := []string{apiErr.Reason()}
+	message := apiErr.Error()
+	var gErr *googleapi.Error
+	if errors.As(err, &gErr) {
+		for _, item := range gErr.Errors {
+			reasons = append(reasons, item.Reason)
+		}
+		message = gErr.Message + " " + gErr.Body
+	}
+	hasReason := func(candidates ...string) bool {
+		for _, r := range reasons {
+			for _, c := range candidates {
+				if r != "" && strings.EqualFold(r, c) {
+					return true
+				}
+			}
+		}
+		return false
+	}
+	lowerMessage := strings.ToLower(message)
+
+	permission := apiErr.Metadata()["permission"]
+	if permission == "" {
+		permission = findPermission(message)
+	}
+
+	switch {
+	case hasReason("SECURITY_POLICY_VIOLATED", "vpcServiceControls") ||
+		strings.Contains(lowerMessage, "vpcservicecontrolsuniqueidentifier") ||
+		strings.Contains(lowerMessage, "vpc service controls"):
+		return &gcpError{
+			category: errorCategoryVPCServiceControls,
+			hint:     "add an ingress/egress rule to the service perimeter protecting the project, or run Velero inside the perimeter",
+			err:      err,
+		}
+	case hasReason("orgPolicyConstraintFailed", "ORG_POLICY_CONSTRAINT_FAILED") ||
+		strings.Contains(lowerMessage, "constraints/") ||
+		strings.Contains(lowerMessage, "organization policy"):
+		return &gcpError{
+			category: errorCategoryOrgPolicy,
+			hint:     "review the organization policy constraint named in the error, or request an exemption for this resource",
+			err:      err,
+		}
+	case strings.Contains(lowerMessage, "cloud kms") || strings.HasPrefix(permission, "cloudkms.") ||
+		strings.Contains(strings.ToLower(strings.Join(reasons, " ")), "kms"):
+		return &gcpError{
+			category:   errorCategoryKMS,
+			permission: permission,
+			hint:       "make sure the key is enabled and the Cloud Storage/Compute Engine service agent has roles/cloudkms.cryptoKeyEncrypterDecrypter on it",
+			err:        err,
+		}
+	case code == http.StatusTooManyRequests ||
+		hasReason("rateLimitExceeded", "userRateLimitExceeded", "quotaExceeded", "RATE_LIMIT_EXCEEDED", "RESOURCE_EXHAUSTED"):
+		return &gcpError{
+			category: errorCategoryQuota,
+			hint:     "reduce the request rate or request a quota increase for the project",
+			err:      err,
+		}
+	case code == http.StatusUnauthorized:
+		return &gcpError{
+			category: errorCategoryAuthentication,
+			hint:     "check that the credentials are valid and have not been revoked or expired",
+			err:      err,
+		}
+	case code == http.StatusForbidden || hasReason("forbidden", "insufficientPermissions", "IAM_PERMISSION_DENIED"):
+		hint := "grant the Velero identity a role that includes the missing permission"
+		if permission == "" {
+			hint = "grant the Velero identity the permissions needed for this operation"
+		}
+		return &gcpError{
+			category:   errorCategoryPermission,
+			permission: permission,
+			hint:       hint,
+			err:        err,
+		}
+	case code == http.StatusNotFound:
+		return &gcpError{
+			category: errorCategoryNotFound,
+			hint:     "check that the bucket, object, disk or snapshot name and project are correct",
+			err:      err,
+		}
+	case code == http.StatusPreconditionFailed || hasReason("conditionNotMet", "FAILED_PRECONDITION"):
+		return &gcpError{
+			category: errorCategoryPrecondition,
+			hint:     "the resource was modified concurrently or is not in the expected state",
+			err:      err,
+		}
+	}
+
+	return err
+}
+
+// findPermission returns the first IAM permission name mentioned in msg, skipping
+// hostnames such as "storage.googleapis.com" or "iam.gserviceaccount.com" that
+// have the same shape.
+func findPermission(msg string) string {
+	for _, candidate := range permissionRegexp.FindAllString(msg, -1) {
+		if !strings.HasSuffix(candidate, ".com") {
+			return candidate
+		}
+	}
+	return ""
+}
+
+// httpCodeFromGRPC maps the gRPC codes relevant to classification onto their HTTP equivalents.
+func httpCodeFromGRPC(code codes.Code) int {
+	switch code {
+	case codes.PermissionDenied:
+		return http.StatusForbidden
+	case codes.Unauthenticated:
+		return http.StatusUnauthorized
+	case codes.NotFound:
+		return http.StatusNotFound
+	case codes.ResourceExhausted:
+		return http.StatusTooManyRequests
+	case codes.FailedPrecondition:
+		return http.StatusPreconditionFailed
+	default:
+		return -1
+	}
+}
+
+// wrapError classifies err and annotates it with a stack trace.
+func wrapError(err error) error {
+	if err == nil {
+		return nil
+	}
+	return errors.WithStack(classifyError(err))
+}
+
+// wrapErrorf classifies err and annotates it with a message and a stack trace.
+func wrapErrorf(err error, format string, args ...interface{}) error {
+	if err == nil {
+		return nil
+	}
+	return errors.Wrapf(classifyError(err), format, args...)
+}
+
+// isErrorCategory reports whether err was classified into the given category.
+func isErrorCategory(err error, category errorCategory) bool {
+	var classified *gcpError
+	if !errors.As(classifyError(err), &classified) {
+		return false
+	}
+	return classified.category == category
+}
+
+// isMissingPermission reports whether err is a permission error caused by the given IAM permission.
+func isMissingPermission(err error, permission string) bool {
+	var classified *gcpError
+	if !errors.As(classifyError(err), &classified) {
+		return false
+	}
+	return classified.category == errorCategoryPermission && classified.permission == permission
+}
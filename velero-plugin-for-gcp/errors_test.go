@@ -0,0 +1,148 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package main
+
+import (
+	"errors"
+	"net/http"
+	"testing"
+
+	"cloud.google.com/go/storage"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/api/googleapi"
+)
+
+func TestClassifyError(t *testing.T) {
+	tests := []struct {
+		name               string
+		err                error
+		expectedCategory   errorCategory
+		expectedPermission string
+	}{
+		{
+			name: "storage permission denied",
+			err: &googleapi.Error{
+				Code:    http.StatusForbidden,
+				Message: "velero@my-project.iam.gserviceaccount.com does not have storage.objects.create access to the Google Cloud Storage object.",
+				Errors:  []googleapi.ErrorItem{{Reason: "forbidden"}},
+			},
+			expectedCategory:   errorCategoryPermission,
+			expectedPermission: "storage.objects.create",
+		},
+		{
+			name: "compute permission denied",
+			err: &googleapi.Error{
+				Code:    http.StatusForbidden,
+				Message: "Required 'compute.snapshots.setLabels' permission for 'projects/p/global/snapshots/s'",
+			},
+			expectedCategory:   errorCategoryPermission,
+			expectedPermission: "compute.snapshots.setLabels",
+		},
+		{
+			name: "permission error ignores API hostnames",
+			err: &googleapi.Error{
+				Code:    http.StatusForbidden,
+				Message: "Caller does not have permission on storage.googleapis.com",
+			},
+			expectedCategory: errorCategoryPermission,
+		},
+		{
+			name: "VPC Service Controls",
+			err: &googleapi.Error{
+				Code:    http.StatusForbidden,
+				Message: "Request is prohibited by organization's policy. vpcServiceControlsUniqueIdentifier: abc123",
+				Errors:  []googleapi.ErrorItem{{Reason: "vpcServiceControls"}},
+			},
+			expectedCategory: errorCategoryVPCServiceControls,
+		},
+		{
+			name: "organization policy",
+			err: &googleapi.Error{
+				Code:    http.StatusPreconditionFailed,
+				Message: "Constraint constraints/gcp.resourceLocations violated for 'projects/p' attempting to create a snapshot.",
+			},
+			expectedCategory: errorCategoryOrgPolicy,
+		},
+		{
+			name: "disabled Cloud KMS key",
+			err: &googleapi.Error{
+				Code:    http.StatusBadRequest,
+				Message: "The Cloud KMS key projects/p/locations/l/keyRings/r/cryptoKeys/k is disabled.",
+			},
+			expectedCategory: errorCategoryKMS,
+		},
+		{
+			name: "rate limited",
+			err: &googleapi.Error{
+				Code:   http.StatusForbidden,
+				Errors: []googleapi.ErrorItem{{Reason: "userRateLimitExceeded"}},
+			},
+			expectedCategory: errorCategoryQuota,
+		},
+		{
+			name:             "not found",
+			err:              &googleapi.Error{Code: http.StatusNotFound},
+			expectedCategory: errorCategoryNotFound,
+		},
+		{
+			name:             "precondition",
+			err:              &googleapi.Error{Code: http.StatusPreconditionFailed, Errors: []googleapi.ErrorItem{{Reason: "conditionNotMet"}}},
+			expectedCategory: errorCategoryPrecondition,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			err := classifyError(tc.err)
+
+			var classified *gcpError
+			require.True(t, errors.As(err, &classified))
+			assert.Equal(t, tc.expectedCategory, classified.category)
+			assert.Equal(t, tc.expectedPermission, classified.permission)
+			assert.NotEmpty(t, classified.hint)
+			assert.Contains(t, err.Error(), string(tc.expectedCategory))
+		})
+	}
+}
+
+func TestClassifyErrorPassthrough(t *testing.T) {
+	plain := errors.New("bad")
+	assert.Equal(t, plain, classifyError(plain))
+	assert.Nil(t, classifyError(nil))
+
+	unknown := &googleapi.Error{Code: http.StatusInternalServerError}
+	assert.Equal(t, error(unknown), classifyError(unknown))
+
+	// storage.ErrObjectNotExist must still be detectable after wrapping
+	assert.True(t, errors.Is(wrapError(storage.ErrObjectNotExist), storage.ErrObjectNotExist))
+}
+
+func TestIsLabelPermissionError(t *testing.T) {
+	labelErr := &googleapi.Error{
+		Code:    http.StatusForbidden,
+		Message: "Required 'compute.snapshots.setLabels' permission for 'projects/p/global/snapshots/s'",
+	}
+	otherErr := &googleapi.Error{
+		Code:    http.StatusForbidden,
+		Message: "Required 'compute.snapshots.create' permission for 'projects/p/global/snapshots/s'",
+	}
+
+	assert.True(t, isLabelPermissionError(labelErr))
+	assert.False(t, isLabelPermissionError(otherErr))
+	assert.False(t, isLabelPermissionError(errors.New("label")))
+	assert.False(t, isLabelPermissionError(nil))
+}
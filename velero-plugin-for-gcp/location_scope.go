@@ -0,0 +1,171 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/google"
+	"golang.org/x/oauth2/google/downscope"
+	"google.golang.org/api/option"
+)
+
+const (
+	downscopeCredentialsConfigKey = "downscopeCredentials"
+	enforceLocationScopeConfigKey = "enforceLocationScope"
+)
+
+// cloudPlatformScope is the OAuth scope that credentials must be issued for to be downscoped.
+const cloudPlatformScope = "https://www.googleapis.com/auth/cloud-platform"
+
+// downscopedRole is the role whose permissions downscoped credentials keep on the objects
+// under the BSL prefix. It lets holds be set, with storage.objects.update, but not object
+// retention configurations, which need storage.objects.setRetention. Credential access
+// boundaries only take roles, so downscopedRetentionRole, which also grants it, is used
+// instead when object retention is set.
+const (
+	downscopedRole          = "roles/storage.objectUser"
+	downscopedRetentionRole = "roles/storage.objectAdmin"
+)
+
+// locationScope describes the isolation of the object store to the bucket and prefix of
+// its BSL, both in the credentials it accesses GCS with and in the arguments it accepts.
+type locationScope struct {
+	bucket string
+	// prefix is the BSL prefix, ending with a slash, or "" for the whole bucket.
+	prefix string
+	// downscope restricts the credentials with a credential access boundary.
+	downscope bool
+	// enforce rejects bucket and key arguments outside of the scope.
+	enforce bool
+	// objectRetention is whether uploads set an object retention configuration.
+	objectRetention bool
+}
+
+// parseLocationScope reads the scope settings from the BSL config. Both require the
+// bucket to be set.
+func parseLocationScope(config map[string]string) (locationScope, error) {
+	s := locationScope{bucket: config["bucket"]}
+	if prefix := strings.Trim(config["prefix"], "/"); prefix != "" {
+		s.prefix = prefix + "/"
+	}
+
+	for key, enabled := range map[string]*bool{
+		downscopeCredentialsConfigKey: &s.downscope,
+		enforceLocationScopeConfigKey: &s.enforce,
+	} {
+		value, ok := config[key]
+		if !ok {
+			continue
+		}
+		parsed, err := strconv.ParseBool(value)
+		if err != nil {
+			return s, errors.Wrapf(err, "invalid value for %s", key)
+		}
+		if parsed && s.bucket == "" {
+			return s, errors.Errorf("%s requires the bucket of the location", key)
+		}
+		*enabled = parsed
+	}
+	return s, nil
+}
+
+// check returns an error if an operation on key, or on the keys starting with key for
+// listings, in bucket falls outside of the scope enforced.
+func (s locationScope) check(bucket, key string) error {
+	if !s.enforce {
+		return nil
+	}
+	if bucket != s.bucket {
+		return errors.Errorf("bucket %s is outside of the location's scope, which is limited to bucket %s", bucket, s.bucket)
+	}
+	// The prefix itself is listed without its trailing slash by some callers.
+	if !strings.HasPrefix(key, s.prefix) && key != strings.TrimSuffix(s.prefix, "/") {
+		return errors.Errorf("key %s is outside of the location's scope, which is limited to prefix %s of bucket %s", key, s.prefix, s.bucket)
+	}
+	return nil
+}
+
+// accessBoundary returns the credential access boundary that limits credentials to
+// the objects under the prefix, and to listings of them.
+func (s locationScope) accessBoundary() []downscope.AccessBoundaryRule {
+	rule := downscope.AccessBoundaryRule{
+		AvailableResource:    "//storage.googleapis.com/projects/_/buckets/" + s.bucket,
+		AvailablePermissions: []string{"inRole:" + s.role()},
+	}
+	if s.prefix != "" {
+		prefix := celString(s.prefix)
+		rule.Condition = &downscope.AvailabilityCondition{
+			Title: "Velero backup storage location prefix",
+			Expression: fmt.Sprintf("resource.name.startsWith(%s) || api.getAttribute('storage.googleapis.com/objectListPrefix', '').startsWith(%s)",
+				celString("projects/_/buckets/"+s.bucket+"/objects/"+s.prefix), prefix),
+		}
+	}
+	return []downscope.AccessBoundaryRule{rule}
+}
+
+// role returns the role whose permissions downscoped credentials keep.
+func (s locationScope) role() string {
+	if s.objectRetention {
+		return downscopedRetentionRole
+	}
+	return downscopedRole
+}
+
+// celString quotes s as a string literal of the Common Expression Language that IAM
+// conditions are written in.
+func celString(s string) string {
+	return "'" + strings.NewReplacer(`\`, `\\`, `'`, `\'`).Replace(s) + "'"
+}
+
+// downscopedTokenSource returns a token source of credentials limited to the scope of the
+// location. The credentials configured, or application default credentials, are
+// exchanged for downscoped tokens, which requires them to carry the cloud-platform scope.
+func (s locationScope) downscopedTokenSource(ctx context.Context, config map[string]string, credsJSON []byte, baseOptions []option.ClientOption) (oauth2.TokenSource, error) {
+	root, err := impersonatedTokenSource(ctx, config, []string{cloudPlatformScope}, baseOptions...)
+	if err != nil {
+		return nil, err
+	}
+	if root == nil {
+		var creds *google.Credentials
+		if credsJSON != nil {
+			creds, err = google.CredentialsFromJSON(ctx, credsJSON, cloudPlatformScope)
+		} else {
+			creds, err = google.FindDefaultCredentials(ctx, cloudPlatformScope)
+		}
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		root = creds.TokenSource
+	}
+
+	ts, err := downscope.NewTokenSource(ctx, downscope.DownscopingConfig{
+		RootSource:     root,
+		Rules:          s.accessBoundary(),
+		UniverseDomain: config[universeDomainKey],
+	})
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	// Downscoped tokens aren't cached by their token source.
+	return oauth2.ReuseTokenSource(nil, ts), nil
+}
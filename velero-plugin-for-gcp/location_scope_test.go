@@ -0,0 +1,233 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"maps"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	velerotest "github.com/vmware-tanzu/velero/pkg/test"
+	"golang.org/x/oauth2/google/downscope"
+)
+
+func TestParseLocationScope(t *testing.T) {
+	tests := []struct {
+		name          string
+		config        map[string]string
+		expectedScope locationScope
+		expectedError string
+	}{
+		{
+			name:          "disabled by default",
+			config:        map[string]string{"bucket": "bucket"},
+			expectedScope: locationScope{bucket: "bucket"},
+		},
+		{
+			name: "both enabled under a prefix",
+			config: map[string]string{
+				"bucket":                      "bucket",
+				"prefix":                      "/tenant-a",
+				downscopeCredentialsConfigKey: "true",
+				enforceLocationScopeConfigKey: "true",
+			},
+			expectedScope: locationScope{bucket: "bucket", prefix: "tenant-a/", downscope: true, enforce: true},
+		},
+		{
+			name:          "invalid boolean",
+			config:        map[string]string{"bucket": "bucket", enforceLocationScopeConfigKey: "strict"},
+			expectedError: `invalid value for enforceLocationScope: strconv.ParseBool: parsing "strict": invalid syntax`,
+		},
+		{
+			name:          "bucket required",
+			config:        map[string]string{downscopeCredentialsConfigKey: "true"},
+			expectedError: "downscopeCredentials requires the bucket of the location",
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			scope, err := parseLocationScope(tc.config)
+			if tc.expectedError != "" {
+				assert.EqualError(t, err, tc.expectedError)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tc.expectedScope, scope)
+		})
+	}
+}
+
+func TestLocationScopeCheck(t *testing.T) {
+	tests := []struct {
+		name          string
+		scope         locationScope
+		bucket        string
+		key           string
+		expectedError string
+	}{
+		{
+			name:   "not enforced",
+			scope:  locationScope{bucket: "bucket", prefix: "tenant-a/"},
+			bucket: "other",
+			key:    "tenant-b/backups/b1/b1.tar.gz",
+		},
+		{
+			name:   "key under the prefix",
+			scope:  locationScope{bucket: "bucket", prefix: "tenant-a/", enforce: true},
+			bucket: "bucket",
+			key:    "tenant-a/backups/b1/b1.tar.gz",
+		},
+		{
+			name:   "the prefix itself",
+			scope:  locationScope{bucket: "bucket", prefix: "tenant-a/", enforce: true},
+			bucket: "bucket",
+			key:    "tenant-a",
+		},
+		{
+			name:   "any key without a prefix",
+			scope:  locationScope{bucket: "bucket", enforce: true},
+			bucket: "bucket",
+			key:    "backups/b1/b1.tar.gz",
+		},
+		{
+			name:          "other bucket",
+			scope:         locationScope{bucket: "bucket", prefix: "tenant-a/", enforce: true},
+			bucket:        "other",
+			key:           "tenant-a/backups/b1/b1.tar.gz",
+			expectedError: "bucket other is outside of the location's scope, which is limited to bucket bucket",
+		},
+		{
+			name:          "other prefix",
+			scope:         locationScope{bucket: "bucket", prefix: "tenant-a/", enforce: true},
+			bucket:        "bucket",
+			key:           "tenant-ab/backups/b1/b1.tar.gz",
+			expectedError: "key tenant-ab/backups/b1/b1.tar.gz is outside of the location's scope, which is limited to prefix tenant-a/ of bucket bucket",
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			err := tc.scope.check(tc.bucket, tc.key)
+			if tc.expectedError != "" {
+				assert.EqualError(t, err, tc.expectedError)
+			} else {
+				assert.NoError(t, err)
+			}
+		})
+	}
+}
+
+func TestLocationScopeAccessBoundary(t *testing.T) {
+	assert.Equal(t, []downscope.AccessBoundaryRule{{
+		AvailableResource:    "//storage.googleapis.com/projects/_/buckets/bucket",
+		AvailablePermissions: []string{"inRole:roles/storage.objectUser"},
+	}}, locationScope{bucket: "bucket"}.accessBoundary())
+
+	// Object retention configurations need storage.objects.setRetention.
+	assert.Equal(t, []string{"inRole:roles/storage.objectAdmin"},
+		locationScope{bucket: "bucket", objectRetention: true}.accessBoundary()[0].AvailablePermissions)
+
+	rules := locationScope{bucket: "bucket", prefix: "tenant-'a'/"}.accessBoundary()
+	require.Len(t, rules, 1)
+	require.NotNil(t, rules[0].Condition)
+	assert.Equal(t,
+		`resource.name.startsWith('projects/_/buckets/bucket/objects/tenant-\'a\'/') || api.getAttribute('storage.googleapis.com/objectListPrefix', '').startsWith('tenant-\'a\'/')`,
+		rules[0].Condition.Expression)
+}
+
+func TestObjectStoreRejectsArgumentsOutsideScope(t *testing.T) {
+	bucket := newMemoryBucket()
+	o := newObjectStore(velerotest.NewLogger())
+	o.bucketWriter = bucket
+	o.scope = locationScope{bucket: "bucket", prefix: "tenant-a/", enforce: true}
+
+	assert.EqualError(t, o.PutObject("bucket", "tenant-b/backups/b1/b1.tar.gz", bytes.NewReader([]byte("data"))),
+		"key tenant-b/backups/b1/b1.tar.gz is outside of the location's scope, which is limited to prefix tenant-a/ of bucket bucket")
+	_, err := o.GetObject("other", "tenant-a/backups/b1/b1.tar.gz")
+	assert.EqualError(t, err, "bucket other is outside of the location's scope, which is limited to bucket bucket")
+	_, err = o.ListObjects("bucket", "tenant-b/")
+	assert.Error(t, err)
+	_, err = o.ListCommonPrefixes("bucket", "", "/")
+	assert.Error(t, err)
+	assert.Error(t, o.DeleteObject("bucket", "tenant-b/backups/b1/b1.tar.gz"))
+	assert.Empty(t, bucket.keys())
+
+	require.NoError(t, o.PutObject("bucket", "tenant-a/backups/b1/b1.tar.gz", bytes.NewReader([]byte("data"))))
+	assert.Equal(t, []string{"tenant-a/backups/b1/b1.tar.gz"}, bucket.keys())
+}
+
+func TestInitDownscopesToRoleAllowingRetention(t *testing.T) {
+	// The bucket has object retention enabled, which Init verifies before downscoping.
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		switch r.URL.Path {
+		case "/token":
+			json.NewEncoder(w).Encode(map[string]any{"access_token": "access-token", "token_type": "Bearer", "expires_in": 3600})
+		case "/storage/v1/b/bucket":
+			w.Write([]byte(`{"name": "bucket", "objectRetention": {"mode": "Enabled"}}`))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer srv.Close()
+	credentialsFile := writeTestCredentials(t, string(serviceAccountKeyJSON(t, "velero@project.iam.gserviceaccount.com", srv.URL+"/token")))
+
+	tests := []struct {
+		name         string
+		config       map[string]string
+		expectedRole string
+	}{
+		{
+			name:         "holds",
+			config:       map[string]string{objectHoldConfigKey: "eventBased"},
+			expectedRole: "roles/storage.objectUser",
+		},
+		{
+			name: "object retention",
+			config: map[string]string{
+				objectRetentionModeConfigKey:     "Unlocked",
+				objectRetentionDurationConfigKey: "30d",
+				objectHoldConfigKey:              "temporary",
+			},
+			expectedRole: "roles/storage.objectAdmin",
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			config := map[string]string{
+				"bucket":                      "bucket",
+				"prefix":                      "tenant-a",
+				credentialsFileConfigKey:      credentialsFile,
+				storeEndpointConfigKey:        srv.URL + "/storage/v1/",
+				skipPermissionCheckConfigKey:  "true",
+				downscopeCredentialsConfigKey: "true",
+			}
+			maps.Copy(config, tc.config)
+
+			o := newObjectStore(velerotest.NewLogger())
+			require.NoError(t, o.Init(config))
+			assert.True(t, o.scope.downscope)
+			assert.Equal(t, []string{"inRole:" + tc.expectedRole}, o.scope.accessBoundary()[0].AvailablePermissions)
+		})
+	}
+}
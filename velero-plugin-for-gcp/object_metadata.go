@@ -0,0 +1,97 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"mime"
+	"path"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+const objectMetadataConfigKey = "objectMetadata"
+
+// reservedMetadataKeys are the metadata keys the plugin sets itself.
+var reservedMetadataKeys = []string{
+	encryptionMetadataKey,
+	encryptionKeyIDMetadataKey,
+	encryptionWrappedKeyMetadataKey,
+	encryptionNonceMetadataKey,
+	encryptionChunkSizeMetadataKey,
+	compressionMetadataKey,
+}
+
+// contentTypes maps the extensions of the files Velero writes to their content types.
+// Other extensions are looked up with the mime package.
+var contentTypes = map[string]string{
+	".json": "application/json",
+	".yaml": "application/yaml",
+	".yml":  "application/yaml",
+	".txt":  "text/plain",
+	".log":  "text/plain",
+	".tar":  "application/x-tar",
+	".gz":   "application/gzip",
+	".tgz":  "application/gzip",
+	".zst":  "application/zstd",
+}
+
+// parseObjectMetadata reads the static metadata to set on every uploaded object from the
+// BSL config, as comma-separated key=value pairs.
+func parseObjectMetadata(config map[string]string) (map[string]string, error) {
+	value, ok := config[objectMetadataConfigKey]
+	if !ok {
+		return nil, nil
+	}
+
+	metadata := map[string]string{}
+	for _, pair := range strings.Split(value, ",") {
+		if pair = strings.TrimSpace(pair); pair == "" {
+			continue
+		}
+		k, v, ok := strings.Cut(pair, "=")
+		k = strings.TrimSpace(k)
+		if !ok || k == "" {
+			return nil, errors.Errorf("invalid %s entry %q, must be key=value", objectMetadataConfigKey, pair)
+		}
+		for _, reserved := range reservedMetadataKeys {
+			if strings.EqualFold(k, reserved) {
+				return nil, errors.Errorf("%s cannot set %s, which is reserved for the plugin", objectMetadataConfigKey, k)
+			}
+		}
+		metadata[k] = strings.TrimSpace(v)
+	}
+	return metadata, nil
+}
+
+// contentTypeFor infers the content type of an object stored as is from its key. Gzipped
+// files such as Velero's .json.gz files are typed as gzip files, without a gzip content
+// encoding: GCS would decompress them when they are downloaded, such as through the
+// signed URLs of download requests, while Velero expects them to be gzipped.
+func contentTypeFor(key string) string {
+	return extensionContentType(strings.ToLower(path.Ext(key)))
+}
+
+func extensionContentType(ext string) string {
+	if ext == "" {
+		return ""
+	}
+	if t, ok := contentTypes[ext]; ok {
+		return t
+	}
+	return mime.TypeByExtension(ext)
+}
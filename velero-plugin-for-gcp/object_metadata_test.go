@@ -0,0 +1,136 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/storage"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	velerotest "github.com/vmware-tanzu/velero/pkg/test"
+	"google.golang.org/api/option"
+)
+
+func TestParseObjectMetadata(t *testing.T) {
+	tests := []struct {
+		name             string
+		config           map[string]string
+		expectedMetadata map[string]string
+		expectedError    string
+	}{
+		{
+			name:   "not set",
+			config: map[string]string{},
+		},
+		{
+			name:             "pairs",
+			config:           map[string]string{objectMetadataConfigKey: "cluster=prod-east, team = platform,,empty="},
+			expectedMetadata: map[string]string{"cluster": "prod-east", "team": "platform", "empty": ""},
+		},
+		{
+			name:          "missing value separator",
+			config:        map[string]string{objectMetadataConfigKey: "cluster"},
+			expectedError: `invalid objectMetadata entry "cluster", must be key=value`,
+		},
+		{
+			name:          "reserved key",
+			config:        map[string]string{objectMetadataConfigKey: "velero-compression=none"},
+			expectedError: "objectMetadata cannot set velero-compression, which is reserved for the plugin",
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			metadata, err := parseObjectMetadata(tc.config)
+			if tc.expectedError != "" {
+				assert.EqualError(t, err, tc.expectedError)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tc.expectedMetadata, metadata)
+		})
+	}
+}
+
+func TestContentTypeFor(t *testing.T) {
+	tests := []struct {
+		key                 string
+		expectedContentType string
+	}{
+		{key: "backups/b1/velero-backup.json", expectedContentType: "application/json"},
+		{key: "backups/b1/b1-resource-list.json.gz", expectedContentType: "application/gzip"},
+		{key: "backups/b1/b1.tar.gz", expectedContentType: "application/gzip"},
+		{key: "backups/b1/b1-logs.gz", expectedContentType: "application/gzip"},
+		{key: "restores/r1/restore-r1-results.gz", expectedContentType: "application/gzip"},
+		{key: "kopia/ns/p0123", expectedContentType: ""},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.key, func(t *testing.T) {
+			assert.Equal(t, tc.expectedContentType, contentTypeFor(tc.key))
+		})
+	}
+}
+
+func TestPutObjectMetadata(t *testing.T) {
+	w := newFakeWriter(newMockWriteCloser(nil, nil))
+	o := newObjectStore(velerotest.NewLogger())
+	o.bucketWriter = w
+	o.objectMetadata = map[string]string{"cluster": "prod-east"}
+
+	require.NoError(t, o.PutObject("bucket", "backups/b1/b1-resource-list.json.gz", strings.NewReader("contents")))
+	assert.Equal(t, map[string]string{"cluster": "prod-east"}, w.opts.metadata)
+	assert.Equal(t, "application/gzip", w.opts.contentType)
+
+	// Data compressed by the plugin isn't described by the key.
+	o.compression = gzipCodec
+	require.NoError(t, o.PutObject("bucket", "backups/b1/velero-backup.json", strings.NewReader("contents")))
+	assert.Equal(t, map[string]string{"cluster": "prod-east", compressionMetadataKey: gzipCodec}, w.opts.metadata)
+	assert.Equal(t, "application/octet-stream", w.opts.contentType)
+}
+
+// Velero's download requests gunzip what the signed URL serves, which GCS would already
+// have decompressed for objects with a gzip content encoding.
+func TestWriterGzippedDocumentHasNoContentEncoding(t *testing.T) {
+	client, err := storage.NewClient(context.Background(), option.WithoutAuthentication())
+	require.NoError(t, err)
+	w := &writer{client: client}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	key := "backups/b1/b1-resource-list.json.gz"
+	sw := w.getWriteCloser(ctx, "bucket", key, writeOptions{contentType: contentTypeFor(key)}).(*storage.Writer)
+	assert.Equal(t, "application/gzip", sw.ContentType)
+	assert.Empty(t, sw.ContentEncoding)
+}
+
+func TestWriterCustomTime(t *testing.T) {
+	client, err := storage.NewClient(context.Background(), option.WithoutAuthentication())
+	require.NoError(t, err)
+	w := &writer{client: client}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	before := time.Now()
+	sw := w.getWriteCloser(ctx, "bucket", "backups/b1/b1.tar.gz", writeOptions{contentType: "application/gzip"}).(*storage.Writer)
+	assert.False(t, sw.CustomTime.Before(before))
+	assert.False(t, sw.CustomTime.After(time.Now()))
+	assert.Equal(t, "application/gzip", sw.ContentType)
+}
@@ -17,11 +17,13 @@ limitations under the License.
 package main
 
 import (
+	"bufio"
 	"context"
 	"encoding/base64"
 	"encoding/json"
+	"fmt"
 	"io"
-	"os"
+	"slices"
 	"time"
 
 	"cloud.google.com/go/storage"
@@ -43,27 +45,164 @@ const (
 	universeDomainKey        = "universeDomain"
 )
 
+// writeOptions are per-upload settings for the object written by bucketWriter.getWriteCloser.
+type writeOptions struct {
+	// conds, if not nil, makes the upload conditional.
+	conds    *storage.Conditions
+	metadata map[string]string
+	// crc32c, if not nil, is sent for GCS to reject the upload if the data doesn't match.
+	crc32c      *uint32
+	contentType string
+	// temporary marks objects that only exist while an upload is in progress, such as
+	// the parts of a parallel upload. They get none of the attributes of backup objects.
+	temporary bool
+}
+
+// objectWriter uploads an object. Attrs returns the attributes of the object once the
+// writer has been closed successfully.
+type objectWriter interface {
+	io.WriteCloser
+	Attrs() *storage.ObjectAttrs
+}
+
 // bucketWriter wraps the GCP SDK functions for accessing object store so they can be faked for testing.
 type bucketWriter interface {
 	// getWriteCloser returns an io.WriteCloser that can be used to upload data to the specified bucket for the specified key.
-	getWriteCloser(bucket, key string) io.WriteCloser
-	getAttrs(bucket, key string) (*storage.ObjectAttrs, error)
+	// Cancelling ctx before the writer is closed aborts the upload.
+	getWriteCloser(ctx context.Context, bucket, key string, opts writeOptions) objectWriter
+	getAttrs(ctx context.Context, bucket, key string) (*storage.ObjectAttrs, error)
+	// compose concatenates up to 32 source objects into the specified key.
+	compose(ctx context.Context, bucket, key string, sources []string, opts writeOptions) (*storage.ObjectAttrs, error)
+	// copyGeneration copies the specified generation of an object to dst, keeping its
+	// attributes, if dst meets conds.
+	copyGeneration(ctx context.Context, bucket, key string, generation int64, dst string, conds storage.Conditions) (*storage.ObjectAttrs, error)
+	// deleteGeneration deletes the specified generation of an object.
+	deleteGeneration(ctx context.Context, bucket, key string, generation int64) error
+	// deleteIf deletes the current version of an object if it meets conds. Unlike
+	// deleteGeneration, this leaves a noncurrent or soft-deleted version in buckets with
+	// object versioning or soft delete.
+	deleteIf(ctx context.Context, bucket, key string, conds storage.Conditions) error
+	// listObjects returns the attributes of the objects whose names start with prefix.
+	listObjects(ctx context.Context, bucket, prefix string) ([]*storage.ObjectAttrs, error)
+	// testPermissions returns the subset of permissions the caller holds on the specified bucket.
+	testPermissions(ctx context.Context, bucket string, permissions []string) ([]string, error)
+	getBucketAttrs(ctx context.Context, bucket string) (*storage.BucketAttrs, error)
 }
 
 type writer struct {
-	client     *storage.Client
-	kmsKeyName string
+	client         *storage.Client
+	kmsKeyName     string
+	customerKeys   *customerKeys
+	retention      retentionConfig
+	storageClasses storageClassRules
+	userProject    string
 }
 
-func (w *writer) getWriteCloser(bucket, key string) io.WriteCloser {
-	writer := w.client.Bucket(bucket).Object(key).NewWriter(context.Background())
-	writer.KMSKeyName = w.kmsKeyName
+// bucketHandle returns the handle of a bucket, billed to userProject if set.
+func (w *writer) bucketHandle(bucket string) *storage.BucketHandle {
+	return bucketHandle(w.client, bucket, w.userProject)
+}
+
+func (w *writer) getWriteCloser(ctx context.Context, bucket, key string, opts writeOptions) objectWriter {
+	obj := w.customerKeys.writeHandle(w.bucketHandle(bucket).Object(key))
+	if opts.conds != nil {
+		obj = obj.If(*opts.conds)
+	}
+	writer := obj.NewWriter(ctx)
+	w.applyAttrs(&writer.ObjectAttrs, key, opts)
+	if opts.crc32c != nil {
+		writer.CRC32C = *opts.crc32c
+		writer.SendCRC32C = true
+	}
 
 	return writer
 }
 
-func (w *writer) getAttrs(bucket, key string) (*storage.ObjectAttrs, error) {
-	return w.client.Bucket(bucket).Object(key).Attrs(context.Background())
+func (w *writer) compose(ctx context.Context, bucket, key string, sources []string, opts writeOptions) (*storage.ObjectAttrs, error) {
+	// Sources are decrypted with the destination's customer-supplied key.
+	dst := w.customerKeys.writeHandle(w.bucketHandle(bucket).Object(key))
+	if opts.conds != nil {
+		dst = dst.If(*opts.conds)
+	}
+	srcs := make([]*storage.ObjectHandle, 0, len(sources))
+	for _, source := range sources {
+		srcs = append(srcs, w.bucketHandle(bucket).Object(source))
+	}
+
+	composer := dst.ComposerFrom(srcs...)
+	w.applyAttrs(&composer.ObjectAttrs, key, opts)
+	if opts.crc32c != nil {
+		composer.CRC32C = *opts.crc32c
+		composer.SendCRC32C = true
+	}
+	return composer.Run(ctx)
+}
+
+// applyAttrs sets the attributes of an object being written to key.
+func (w *writer) applyAttrs(attrs *storage.ObjectAttrs, key string, opts writeOptions) {
+	attrs.KMSKeyName = w.kmsKeyName
+	if opts.temporary {
+		// Avoid the minimum storage duration of colder classes.
+		attrs.StorageClass = "STANDARD"
+		return
+	}
+
+	attrs.Metadata = opts.metadata
+	attrs.ContentType = opts.contentType
+	attrs.StorageClass = w.storageClasses.classFor(key)
+	now := time.Now()
+	// Lets lifecycle rules on daysSinceCustomTime expire backups by the time they were taken.
+	attrs.CustomTime = now
+	w.retention.apply(attrs, key, now)
+}
+
+func (w *writer) getAttrs(ctx context.Context, bucket, key string) (*storage.ObjectAttrs, error) {
+	obj, err := w.customerKeys.readHandle(ctx, w.bucketHandle(bucket).Object(key))
+	if err != nil {
+		return nil, err
+	}
+	return obj.Attrs(ctx)
+}
+
+func (w *writer) copyGeneration(ctx context.Context, bucket, key string, generation int64, dst string, conds storage.Conditions) (*storage.ObjectAttrs, error) {
+	src, err := w.customerKeys.readHandle(ctx, w.bucketHandle(bucket).Object(key).Generation(generation))
+	if err != nil {
+		return nil, err
+	}
+	copier := w.customerKeys.writeHandle(w.bucketHandle(bucket).Object(dst)).If(conds).CopierFrom(src)
+	copier.DestinationKMSKeyName = w.kmsKeyName
+	return copier.Run(ctx)
+}
+
+func (w *writer) deleteGeneration(ctx context.Context, bucket, key string, generation int64) error {
+	return w.bucketHandle(bucket).Object(key).Generation(generation).Delete(ctx)
+}
+
+func (w *writer) deleteIf(ctx context.Context, bucket, key string, conds storage.Conditions) error {
+	return w.bucketHandle(bucket).Object(key).If(conds).Delete(ctx)
+}
+
+func (w *writer) listObjects(ctx context.Context, bucket, prefix string) ([]*storage.ObjectAttrs, error) {
+	var objects []*storage.ObjectAttrs
+	iter := w.bucketHandle(bucket).Objects(ctx, &storage.Query{Prefix: prefix})
+	for {
+		attrs, err := iter.Next()
+		if err == iterator.Done {
+			return objects, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		objects = append(objects, attrs)
+	}
+}
+
+func (w *writer) testPermissions(ctx context.Context, bucket string, permissions []string) ([]string, error) {
+	return w.bucketHandle(bucket).IAM().TestPermissions(ctx, permissions)
+}
+
+func (w *writer) getBucketAttrs(ctx context.Context, bucket string) (*storage.BucketAttrs, error) {
+	return w.bucketHandle(bucket).Attrs(ctx)
 }
 
 type ObjectStore struct {
@@ -74,30 +213,97 @@ type ObjectStore struct {
 	bucketWriter   bucketWriter
 	iamSvc         *iamcredentials.Service
 	fileCredType   credAccountKeys
+	// delegates is the delegation chain used when signing as an impersonated service account.
+	delegates []string
+	// iamClientOptions are the options used to create iamSvc.
+	iamClientOptions []option.ClientOption
+	signedURL        signedURLConfig
+	timeouts         objectStoreTimeouts
+	retry            retryConfig
+	customerKeys     *customerKeys
+	// encryption, if not nil, encrypts objects on the client side.
+	encryption *clientEncryption
+	// compression is the codec uploads are compressed with, or "" for none.
+	compression    string
+	storageClasses storageClassRules
+	// objectMetadata is the static metadata set on every uploaded object.
+	objectMetadata  map[string]string
+	parallelUploads parallelUploadConfig
+	downloads       downloadConfig
+	staging         stagingConfig
+	writeOnce       writeOnceConfig
+	trash           trashConfig
+	scope           locationScope
+	// userProject is the project billed for requests to Requester Pays buckets.
+	userProject string
+	// transport is the API that GCS is accessed with, before any fallback to HTTP.
+	transport string
+	// replication, if not nil, mirrors writes to a secondary bucket.
+	replication *replication
+	// reload, if not nil, holds the object store with the clients built from the
+	// current contents of the credentials files.
+	reload *reloader[ObjectStore]
+	// stopSweeps, if not nil, stops the sweeps of hidden directories started by Init.
+	stopSweeps context.CancelFunc
 }
 
 func newObjectStore(logger logrus.FieldLogger) *ObjectStore {
 	return &ObjectStore{log: logger}
 }
 
+// acquire returns the object store to run an operation with, whose clients use the
+// latest credentials, and a function to call once the operation is done with them.
+func (o *ObjectStore) acquire() (*ObjectStore, func()) {
+	if o.reload == nil {
+		return o, func() {}
+	}
+	return o.reload.acquire()
+}
+
+// closeClients closes the storage client of a snapshot of the object store that is no
+// longer in use.
+func (o *ObjectStore) closeClients() {
+	if o.client == nil {
+		return
+	}
+	if err := o.client.Close(); err != nil {
+		o.log.WithError(err).Debug("Error closing the storage client of replaced credentials")
+	}
+}
+
+// bucketHandle returns the handle of a bucket, billed to userProject if set.
+func (o *ObjectStore) bucketHandle(bucket string) *storage.BucketHandle {
+	return bucketHandle(o.client, bucket, o.userProject)
+}
+
 type credAccountKeys string
 
 // From https://github.com/golang/oauth2/blob/d3ed0bb246c8d3c75b63937d9a5eecff9c74d7fe/google/google.go#L95
 const (
-	serviceAccountKey  credAccountKeys = "service_account"
-	externalAccountKey credAccountKeys = "external_account"
+	serviceAccountKey             credAccountKeys = "service_account"
+	externalAccountKey            credAccountKeys = "external_account"
+	authorizedUserKey             credAccountKeys = "authorized_user"
+	impersonatedServiceAccountKey credAccountKeys = "impersonated_service_account"
 )
 
 func getSecretAccountTypeKey(secretByte []byte) (credAccountKeys, error) {
-	var f map[string]interface{}
+	var f struct {
+		Type interface{} `json:"type"`
+	}
 	if err := json.Unmarshal(secretByte, &f); err != nil {
 		return "", err
 	}
-	// following will panic if cannot cast to credAccountKeys
-	return credAccountKeys(f["type"].(string)), nil
+	credType, ok := f.Type.(string)
+	if !ok || credType == "" {
+		return "", errors.New("credentials JSON does not contain a \"type\" string")
+	}
+	return credAccountKeys(credType), nil
 }
 
 func (o *ObjectStore) Init(config map[string]string) error {
+	// The object store may be initialized again with another config.
+	o.stop()
+
 	if err := veleroplugin.ValidateObjectStoreConfigKeys(
 		config,
 		kmsKeyNameConfigKey,
@@ -105,9 +311,221 @@ func (o *ObjectStore) Init(config map[string]string) error {
 		credentialsFileConfigKey,
 		storeEndpointConfigKey,
 		universeDomainKey,
+		skipPermissionCheckConfigKey,
+		impersonateServiceAccountConfigKey,
+		impersonateDelegatesConfigKey,
+		signedURLSchemeConfigKey,
+		signedURLHostnameConfigKey,
+		signedURLStyleConfigKey,
+		signedURLBucketBoundHostnameConfigKey,
+		signedURLInsecureConfigKey,
+		signedURLContentDispositionConfigKey,
+		signedURLContentTypeConfigKey,
+		requestTimeoutConfigKey,
+		uploadTimeoutConfigKey,
+		downloadTimeoutConfigKey,
+		listTimeoutConfigKey,
+		downloadIdleTimeoutConfigKey,
+		retryPolicyConfigKey,
+		retryMaxAttemptsConfigKey,
+		retryInitialBackoffConfigKey,
+		retryMaxBackoffConfigKey,
+		retryBackoffMultiplierConfigKey,
+		objectRetentionModeConfigKey,
+		objectRetentionDurationConfigKey,
+		objectHoldConfigKey,
+		bucketRetentionPolicyConfigKey,
+		customerEncryptionKeyFileConfigKey,
+		previousCustomerEncryptionKeyFilesConfigKey,
+		clientSideEncryptionKeyFileConfigKey,
+		clientSideEncryptionKMSKeyNameConfigKey,
+		compressionConfigKey,
+		storageClassRulesConfigKey,
+		objectMetadataConfigKey,
+		parallelUploadThresholdConfigKey,
+		parallelUploadPartSizeConfigKey,
+		parallelUploadConcurrencyConfigKey,
+		parallelUploadMaxMemoryConfigKey,
+		parallelDownloadThresholdConfigKey,
+		parallelDownloadPartSizeConfigKey,
+		parallelDownloadConcurrencyConfigKey,
+		downloadMaxResumesConfigKey,
+		atomicUploadsConfigKey,
+		stagingMaxAgeConfigKey,
+		stagingSweepIntervalConfigKey,
+		writeOnceConfigKey,
+		mutableKeysConfigKey,
+		secondaryBucketConfigKey,
+		secondaryCredentialsFileConfigKey,
+		secondaryStoreEndpointConfigKey,
+		softDeleteConfigKey,
+		trashRetentionConfigKey,
+		trashPurgeIntervalConfigKey,
+		downscopeCredentialsConfigKey,
+		enforceLocationScopeConfigKey,
+		userProjectConfigKey,
+		quotaProjectConfigKey,
+		credentialsReloadIntervalConfigKey,
+		credentialsBase64ConfigKey,
+		credentialsSecretVersionConfigKey,
+		secretManagerEndpointConfigKey,
+		transportConfigKey,
 	); err != nil {
 		return err
 	}
+
+	checkPermissions, err := permissionCheckEnabled(config)
+	if err != nil {
+		return err
+	}
+
+	o.signedURL, err = parseSignedURLConfig(config)
+	if err != nil {
+		return err
+	}
+
+	o.timeouts, err = parseTimeouts(config)
+	if err != nil {
+		return err
+	}
+
+	o.retry, err = parseRetryConfig(config)
+	if err != nil {
+		return err
+	}
+
+	retention, err := parseRetentionConfig(config)
+	if err != nil {
+		return err
+	}
+
+	o.customerKeys, err = loadCustomerKeys(config)
+	if err != nil {
+		return err
+	}
+
+	o.compression, err = parseCompression(config)
+	if err != nil {
+		return err
+	}
+
+	o.storageClasses, err = parseStorageClassRules(config)
+	if err != nil {
+		return err
+	}
+
+	o.objectMetadata, err = parseObjectMetadata(config)
+	if err != nil {
+		return err
+	}
+
+	o.parallelUploads, err = parseParallelUploadConfig(config)
+	if err != nil {
+		return err
+	}
+
+	o.downloads, err = parseDownloadConfig(config)
+	if err != nil {
+		return err
+	}
+
+	o.staging, err = parseStagingConfig(config, o.timeouts.upload, o.parallelUploads.threshold > 0)
+	if err != nil {
+		return err
+	}
+
+	o.writeOnce, err = parseWriteOnceConfig(config)
+	if err != nil {
+		return err
+	}
+	retention.rewritten = o.writeOnce
+
+	o.trash, err = parseTrashConfig(config)
+	if err != nil {
+		return err
+	}
+
+	o.scope, err = parseLocationScope(config)
+	if err != nil {
+		return err
+	}
+	o.scope.objectRetention = retention.mode != ""
+
+	o.transport, err = parseTransport(config)
+	if err != nil {
+		return err
+	}
+	if o.transport == transportGRPC && retention.mode != "" {
+		// Objects written over gRPC can't be given a retention configuration.
+		o.log.WithField(objectRetentionModeConfigKey, retention.mode).Warn("Object retention isn't supported with gRPC, accessing GCS over HTTP")
+		o.transport = transportHTTP
+	}
+
+	reloadInterval, err := parseCredentialsReloadInterval(config)
+	if err != nil {
+		return err
+	}
+	watcher := newCredentialsWatcher(credentialsPaths(config), reloadInterval, time.Now())
+
+	if err := o.initClients(config, retention, true, checkPermissions); err != nil {
+		return err
+	}
+	if reloadInterval > 0 {
+		// The clients are rebuilt on a copy, so that operations in flight keep theirs.
+		// The bucket's retention and permissions were verified already.
+		o.reload = newReloader(o.log, watcher, o, func(current *ObjectStore) (*ObjectStore, error) {
+			fresh := *current
+			if err := fresh.initClients(config, retention, false, false); err != nil {
+				if fresh.client != current.client {
+					fresh.closeClients()
+				}
+				return nil, err
+			}
+			return &fresh, nil
+		}, (*ObjectStore).closeClients)
+	}
+
+	if bucket := config["bucket"]; bucket != "" && (o.staging.sweep || o.trash.enabled) {
+		var ctx context.Context
+		ctx, o.stopSweeps = context.WithCancel(context.Background())
+		if o.staging.sweep {
+			o.startSweep(ctx, bucket, o.staging.prefix, o.staging.sweepInterval, (*ObjectStore).sweepStaging)
+		}
+		if o.trash.enabled {
+			o.startSweep(ctx, bucket, o.trash.prefix, o.trash.purgeInterval, (*ObjectStore).purgeTrash)
+		}
+	}
+
+	o.replication, err = newReplication(o.log, config)
+	if err != nil {
+		// Stop the sweeps and reloading started above.
+		o.stop()
+		return err
+	}
+	return nil
+}
+
+// stop stops the sweeps started by Init and the reloading of credentials, and releases
+// the clients of the secondary bucket, before the object store is initialized again or
+// when Init fails. The reloader closes the current clients once they are unused.
+func (o *ObjectStore) stop() {
+	o.reload.stop()
+	o.reload = nil
+	if o.stopSweeps != nil {
+		o.stopSweeps()
+		o.stopSweeps = nil
+	}
+	o.replication.close()
+	o.replication = nil
+}
+
+// initClients builds the clients of the object store, and the material URLs are signed
+// with, from its credentials. The bucket's retention and the permissions of the
+// credentials are checked before any downscoping, if requested.
+func (o *ObjectStore) initClients(config map[string]string, retention retentionConfig, verifyRetention, checkPermissions bool) error {
+	o.googleAccessID, o.privateKey, o.iamSvc = "", nil, nil
+	o.fileCredType, o.delegates, o.iamClientOptions = "", nil, nil
+
 	// Find default token source to extract the GoogleAccessID
 	ctx := context.Background()
 
@@ -117,43 +535,54 @@ func (o *ObjectStore) Init(config map[string]string) error {
 
 	// Credentials to use when creating signed URLs.
 	var creds *google.Credentials
-	var err error
-
-	// Prioritize the credentials file path in config, if it exists
-	if credentialsFile, ok := config[credentialsFileConfigKey]; ok {
-		b, err := os.ReadFile(credentialsFile)
-		if err != nil {
-			return errors.Wrapf(err, "error reading provided credentials file %v", credentialsFile)
-		}
+	// Options carrying the credentials to authenticate with, before any impersonation.
+	var baseOptions []option.ClientOption
 
-		creds, err = google.CredentialsFromJSON(ctx, b)
+	// Prioritize the credentials in config, if any
+	credsJSON, err := credentialsJSON(ctx, o.log, config)
+	if err != nil {
+		return err
+	}
+	if credsJSON != nil {
+		creds, err = google.CredentialsFromJSON(ctx, credsJSON)
 		if err != nil {
 			return errors.WithStack(err)
 		}
 
-		// If using a credentials file, we also need to pass it when creating the client.
-		clientOptions = append(clientOptions, option.WithCredentialsFile(credentialsFile))
+		// If using credentials from the config, we also need to pass them when creating the client.
+		baseOptions = append(baseOptions, option.WithCredentialsJSON(credsJSON))
 	} else {
-		// If a credentials file does not exist in the config, fall back to
+		// If no credentials are set in the config, fall back to
 		// loading default credentials for signed URLs.
 		creds, err = google.FindDefaultCredentials(ctx)
-	}
-
-	if err != nil {
-		return errors.WithStack(err)
-	}
-
-	// if using a endpoint, we need to pass it when creating the object store client
-	if endpoint, ok := config[storeEndpointConfigKey]; ok {
-		clientOptions = append(clientOptions, option.WithEndpoint(endpoint))
+		if err != nil {
+			return errors.WithStack(err)
+		}
 	}
 
 	// if using a universeDomain, we need to pass it when creating the object store client
 	if universeDomain, ok := config[universeDomainKey]; ok {
 		clientOptions = append(clientOptions, option.WithUniverseDomain(universeDomain))
 	}
+	clientOptions = append(clientOptions, quotaProjectOptions(config)...)
+	o.userProject = config[userProjectConfigKey]
+
+	// Options that don't carry credentials, for a downscoped client. The storeEndpoint
+	// is added for the transport the client is created with.
+	commonOptions := slices.Clip(clientOptions)
+
+	ts, err := impersonatedTokenSource(ctx, config, []string{storage.ScopeReadWrite}, baseOptions...)
+	if err != nil {
+		return err
+	}
 
-	if creds.JSON != nil {
+	if ts != nil {
+		// Access the bucket as the impersonated service account, and sign URLs as it
+		// through the IAM credentials API.
+		clientOptions = append(clientOptions, option.WithTokenSource(ts))
+		err = o.initFromImpersonation(ctx, config, baseOptions)
+	} else if creds.JSON != nil {
+		clientOptions = append(clientOptions, baseOptions...)
 		o.fileCredType, err = getSecretAccountTypeKey(creds.JSON)
 		if err != nil {
 			return errors.WithStack(err)
@@ -161,6 +590,10 @@ func (o *ObjectStore) Init(config map[string]string) error {
 		if o.fileCredType == serviceAccountKey {
 			// Using Credentials File
 			err = o.initFromKeyFile(creds)
+		} else {
+			// external_account, authorized_user or impersonated_service_account credentials
+			// carry no private key, so URLs are signed through the IAM credentials API.
+			err = o.initFromCredentialsJSON(ctx, creds.JSON, config, baseOptions)
 		}
 	} else {
 		// Using compute engine credentials. Use this if workload identity is enabled.
@@ -171,19 +604,112 @@ func (o *ObjectStore) Init(config map[string]string) error {
 		return errors.WithStack(err)
 	}
 
-	client, err := storage.NewClient(ctx, clientOptions...)
+	o.encryption, err = newClientEncryption(ctx, config, baseOptions)
 	if err != nil {
-		return errors.WithStack(err)
+		return err
+	}
+
+	transport := o.transport
+	client, err := o.newStorageClient(ctx, config, transport, clientOptions)
+	if err != nil {
+		return err
+	}
+	if transport == transportGRPC && !o.grpcSupported(client, config["bucket"]) {
+		client.Close()
+		transport = transportHTTP
+		if client, err = o.newStorageClient(ctx, config, transport, clientOptions); err != nil {
+			return err
+		}
 	}
 	o.client = client
 
-	o.bucketWriter = &writer{
-		client:     o.client,
-		kmsKeyName: config[kmsKeyNameConfigKey],
+	w := &writer{
+		client:         o.client,
+		kmsKeyName:     config[kmsKeyNameConfigKey],
+		customerKeys:   o.customerKeys,
+		retention:      retention,
+		storageClasses: o.storageClasses,
+		userProject:    o.userProject,
+	}
+	o.bucketWriter = w
+
+	if verifyRetention {
+		if err := o.verifyBucketRetention(config["bucket"], retention); err != nil {
+			return err
+		}
+	}
+
+	if checkPermissions {
+		if err := o.checkPermissions(config["bucket"], retention); err != nil {
+			return err
+		}
+	}
+
+	// The checks above read the bucket's metadata and IAM policy, which downscoped
+	// credentials don't give access to.
+	if o.scope.downscope {
+		ts, err := o.scope.downscopedTokenSource(ctx, config, creds.JSON, baseOptions)
+		if err != nil {
+			return err
+		}
+		client, err := o.newStorageClient(ctx, config, transport, append(commonOptions, option.WithTokenSource(ts)))
+		if err != nil {
+			return err
+		}
+		// The client used for the checks isn't needed anymore.
+		o.client.Close()
+		o.client, w.client = client, client
+	}
+	return nil
+}
+
+// checkPermissions verifies up front that the identity in use holds the permissions the
+// object store needs, so a misconfigured BSL becomes unavailable immediately rather
+// than failing the first backup. Uploading with retention or holds needs more permissions.
+func (o *ObjectStore) checkPermissions(bucket string, retention retentionConfig) error {
+	if bucket != "" {
+		ctx, cancel := operationContext(o.timeouts.request)
+		defer cancel()
+
+		required := append(append([]string(nil), objectStorePermissions...), retention.permissions()...)
+		granted, err := o.bucketWriter.testPermissions(ctx, bucket, required)
+		if err != nil {
+			return wrapErrorf(err, "error checking permissions on bucket %s", bucket)
+		}
+		if err := checkGrantedPermissions("bucket "+bucket, required, granted); err != nil {
+			return err
+		}
+	}
+
+	// Signed URLs are created through the IAM credentials API when there is no private key.
+	// A delegation chain can't be verified with a single call, so it is left to SignBytes.
+	// Only download requests need signed URLs, so the location stays usable without them.
+	if o.iamSvc != nil && o.privateKey == nil && len(o.delegates) == 0 {
+		ctx, cancel := operationContext(o.timeouts.request)
+		defer cancel()
+		if err := checkSignBlobPermission(ctx, o.googleAccessID, o.iamClientOptions...); err != nil {
+			o.log.WithError(err).WithField("serviceAccount", o.googleAccessID).Warn("Signed URLs can't be created, so downloads of backup logs and details will fail")
+		}
 	}
 	return nil
 }
 
+// verifyBucketRetention checks that the bucket supports the retention configured on the BSL.
+func (o *ObjectStore) verifyBucketRetention(bucket string, retention retentionConfig) error {
+	if bucket == "" || (retention.mode == "" && retention.bucketPolicy == "") {
+		return nil
+	}
+
+	ctx, cancel := operationContext(o.timeouts.request)
+	defer cancel()
+
+	attrs, err := o.bucketWriter.getBucketAttrs(ctx, bucket)
+	if err != nil {
+		return wrapErrorf(err, "error getting attributes of bucket %s", bucket)
+	}
+	return retention.verifyBucket(bucket, attrs)
+}
+
 // This function is used to populate the googleAccessID and privateKey fields when using a service account credentials file.
 // it will error if credential file is not for a service account.
 // Do not run this function if using non SA credentials such as external_account.
@@ -215,61 +741,371 @@ func (o *ObjectStore) initFromComputeEngine(config map[string]string) error {
 	return err
 }
 
+// initFromCredentialsJSON determines the service account to sign URLs as when the
+// credentials have no private key: the serviceAccount config item if set, otherwise the
+// service account that external_account or impersonated_service_account credentials
+// impersonate. Signing is left disabled if there is neither.
+func (o *ObjectStore) initFromCredentialsJSON(ctx context.Context, credsJSON []byte, config map[string]string, baseOptions []option.ClientOption) error {
+	o.googleAccessID = config[serviceAccountConfigKey]
+	if o.googleAccessID == "" {
+		serviceAccount, err := impersonatedServiceAccountFromJSON(credsJSON)
+		if err != nil {
+			return err
+		}
+		o.googleAccessID = serviceAccount
+	}
+	if o.googleAccessID == "" {
+		return nil
+	}
+
+	var err error
+	o.iamClientOptions = baseOptions
+	o.iamSvc, err = iamcredentials.NewService(ctx, baseOptions...)
+	return err
+}
+
+// initFromImpersonation sets up signing as the impersonated service account. The base
+// credentials sign through the IAM credentials API, following the delegation chain if any.
+func (o *ObjectStore) initFromImpersonation(ctx context.Context, config map[string]string, baseOptions []option.ClientOption) error {
+	var err error
+	o.googleAccessID = config[impersonateServiceAccountConfigKey]
+	o.delegates = parseDelegates(config[impersonateDelegatesConfigKey])
+	o.iamClientOptions = baseOptions
+	o.iamSvc, err = iamcredentials.NewService(ctx, baseOptions...)
+	return err
+}
+
 func (o *ObjectStore) PutObject(bucket, key string, body io.Reader) error {
-	w := o.bucketWriter.getWriteCloser(bucket, key)
+	// The upload carries on with these clients if the credentials are reloaded meanwhile.
+	o, release := o.acquire()
+	defer release()
+	if err := o.scope.check(bucket, key); err != nil {
+		return err
+	}
+	if o.replication != nil {
+		return o.replication.put(key, body, func(body io.Reader) error {
+			return o.putObject(bucket, key, body)
+		})
+	}
+	return o.putObject(bucket, key, body)
+}
+
+func (o *ObjectStore) putObject(bucket, key string, body io.Reader) error {
+	// The context must outlive Close(), which is where the upload is committed.
+	ctx, cancel := operationContext(o.timeouts.upload)
+	defer cancel()
+
+	var opts writeOptions
+	// Atomic uploads are only published if the object wasn't written meanwhile.
+	if o.retry.conditionalWrites || o.staging.enabled || o.writeOnce.enabled {
+		var err error
+		if opts.conds, err = o.uploadConditions(ctx, bucket, key); err != nil {
+			return err
+		}
+	}
+
+	opts.metadata = map[string]string{}
+	for k, v := range o.objectMetadata {
+		opts.metadata[k] = v
+	}
+
+	var encryptor *objectEncryptor
+	if o.encryption != nil {
+		var err error
+		if encryptor, err = o.encryption.newObjectEncryptor(ctx); err != nil {
+			return wrapTimeoutError(ctx, err, o.timeouts.upload, "upload of %s", key)
+		}
+		for k, v := range encryptor.metadata {
+			opts.metadata[k] = v
+		}
+	}
+
+	var compress bool
+	if o.compression != "" {
+		br := bufio.NewReader(body)
+		// An error is returned again when the body is copied.
+		head, _ := br.Peek(4)
+		body = br
+		if compress = !isCompressed(key, head); compress {
+			opts.metadata[compressionMetadataKey] = o.compression
+		}
+	}
+
+	// The content type only describes the data if it is stored as is.
+	if encryptor == nil && !compress {
+		opts.contentType = contentTypeFor(key)
+	} else {
+		opts.contentType = "application/octet-stream"
+	}
+
+	// Atomic uploads are written to a staging key first, as temporary objects.
+	target, targetOpts := key, &opts
+	if o.staging.enabled {
+		var err error
+		if target, err = o.staging.stagingKey(key); err != nil {
+			return err
+		}
+		targetOpts = &writeOptions{temporary: true}
+	}
+
+	var uploadID string
+	if o.parallelUploads.threshold > 0 {
+		var err error
+		if uploadID, err = newUploadID(); err != nil {
+			return err
+		}
+	}
+
+	// Data is compressed before it is encrypted, since ciphertext doesn't compress. The
+	// checksum covers the data as it is stored.
+	uploader := newChecksumWriter(func(crc32c *uint32) objectWriter {
+		targetOpts.crc32c = crc32c
+		// Uploads small enough for their checksum to be sent upfront are never split.
+		if crc32c == nil && o.parallelUploads.threshold > 0 {
+			return newCompositeWriter(ctx, o.log, o.bucketWriter, bucket, target, o.staging.prefix, uploadID, *targetOpts, o.parallelUploads, o.timeouts.request)
+		}
+		return o.bucketWriter.getWriteCloser(ctx, bucket, target, *targetOpts)
+	}, cancel)
+	var w io.WriteCloser = uploader
+	if encryptor != nil {
+		w = encryptor.writer(w)
+	}
+	var compressor *compressingWriter
+	if compress {
+		var err error
+		if compressor, err = newCompressingWriter(o.compression, w); err != nil {
+			cancel()
+			w.Close()
+			return err
+		}
+		w = compressor
+	}
 
 	// The writer returned by NewWriter is asynchronous, so errors aren't guaranteed
 	// until Close() is called
 	_, copyErr := io.Copy(w, body)
+	if copyErr != nil {
+		// Abort the upload before closing, so that Close() doesn't commit what has been
+		// written so far as a truncated object.
+		cancel()
+	}
 
 	// Ensure we close w and report errors properly
 	closeErr := w.Close()
 	if copyErr != nil {
-		return copyErr
+		return wrapTimeoutError(ctx, classifyError(copyErr), o.timeouts.upload, "upload of %s", key)
+	}
+
+	if closeErr == nil {
+		attrs, err := uploader.verify(key)
+		if err != nil {
+			// Don't leave the corrupted object behind.
+			if deleteErr := o.bucketWriter.deleteGeneration(ctx, bucket, target, attrs.Generation); deleteErr != nil {
+				o.log.WithError(deleteErr).WithField("key", target).Error("Error deleting object uploaded with a checksum mismatch")
+			}
+			return errors.WithStack(err)
+		}
+		if target != key {
+			opts.crc32c = &uploader.crc
+			if attrs, err = o.publish(ctx, bucket, key, attrs, uploader.size, opts); err != nil {
+				return wrapTimeoutError(ctx, err, o.timeouts.upload, "upload of %s", key)
+			}
+		}
+		if len(o.storageClasses.rules) > 0 && attrs != nil {
+			o.log.WithFields(logrus.Fields{"key": key, "storageClass": attrs.StorageClass}).Info("Uploaded object")
+		}
+	}
+
+	if closeErr == nil && compressor != nil {
+		o.log.WithFields(logrus.Fields{
+			"key":               key,
+			"codec":             o.compression,
+			"uncompressedBytes": compressor.in,
+			"compressedBytes":   compressor.out.n,
+			"ratio":             fmt.Sprintf("%.2f", compressor.ratio()),
+		}).Info("Uploaded compressed object")
+	}
+
+	if conflict := o.writeConflict(bucket, target, targetOpts.conds, closeErr); conflict != nil {
+		return errors.WithStack(conflict)
 	}
+	return wrapTimeoutError(ctx, classifyError(closeErr), o.timeouts.upload, "upload of %s", key)
+}
 
-	return closeErr
+// uploadConditions returns a precondition on the current generation of the object, so that
+// the upload is idempotent and can be retried without overwriting a concurrent write. With
+// write-once protection, uploads to existing objects that aren't mutable are rejected.
+func (o *ObjectStore) uploadConditions(ctx context.Context, bucket, key string) (*storage.Conditions, error) {
+	attrs, err := o.bucketWriter.getAttrs(ctx, bucket, key)
+	if errors.Is(err, storage.ErrObjectNotExist) {
+		return &storage.Conditions{DoesNotExist: true}, nil
+	}
+	if err != nil {
+		return nil, wrapErrorf(err, "error getting the current generation of %s", key)
+	}
+	if o.writeOnce.enabled && !o.writeOnce.isMutable(key) {
+		return nil, errors.WithStack(&writeConflictError{key: key, found: attrs.Generation})
+	}
+	return &storage.Conditions{GenerationMatch: attrs.Generation}, nil
 }
 
 func (o *ObjectStore) ObjectExists(bucket, key string) (bool, error) {
-	if _, err := o.bucketWriter.getAttrs(bucket, key); err != nil {
+	o, release := o.acquire()
+	defer release()
+	if err := o.scope.check(bucket, key); err != nil {
+		return false, err
+	}
+	exists, err := o.objectExists(bucket, key)
+	if o.replication.failover(err, "exists", key) {
+		return o.replication.secondary.ObjectExists(o.replication.bucket, key)
+	}
+	return exists, err
+}
+
+func (o *ObjectStore) objectExists(bucket, key string) (bool, error) {
+	ctx, cancel := operationContext(o.timeouts.request)
+	defer cancel()
+
+	if _, err := o.bucketWriter.getAttrs(ctx, bucket, key); err != nil {
 		if errors.Is(err, storage.ErrObjectNotExist) {
 			return false, nil
 		}
-		return false, errors.WithStack(err)
+		return false, wrapError(err)
 	}
 
 	return true, nil
 }
 
 func (o *ObjectStore) GetObject(bucket, key string) (io.ReadCloser, error) {
-	r, err := o.client.Bucket(bucket).Object(key).NewReader(context.Background())
+	o, release := o.acquire()
+	if err := o.scope.check(bucket, key); err != nil {
+		release()
+		return nil, err
+	}
+	r, err := o.getObject(bucket, key)
+	if err != nil {
+		release()
+		if o.replication.failover(err, "download", key) {
+			return o.replication.secondary.GetObject(o.replication.bucket, key)
+		}
+		return nil, err
+	}
+	// The download carries on with these clients until the reader is closed.
+	return &releasingReader{ReadCloser: r, release: release}, nil
+}
+
+// releasingReader releases the clients an object is read with once it is closed.
+type releasingReader struct {
+	io.ReadCloser
+	release func()
+}
+
+func (r *releasingReader) Close() error {
+	err := r.ReadCloser.Close()
+	r.release()
+	return err
+}
+
+func (o *ObjectStore) getObject(bucket, key string) (io.ReadCloser, error) {
+	// The context lives as long as the returned reader and is released when it's closed.
+	ctx, cancel := operationContext(o.timeouts.download)
+
+	r, err := o.newObjectReader(ctx, bucket, key)
+	if err != nil {
+		cancel()
+		return nil, wrapTimeoutError(ctx, wrapError(err), o.timeouts.download, "download of %s", key)
+	}
+
+	return newIdleTimeoutReader(r, cancel, o.timeouts.downloadIdle), nil
+}
+
+// newObjectReader opens the object for reading with the customer-supplied key it is
+// encrypted with, if any, and decrypts and decompresses it as its metadata describes.
+func (o *ObjectStore) newObjectReader(ctx context.Context, bucket, key string) (io.ReadCloser, error) {
+	obj := o.bucketHandle(bucket).Object(key)
+
+	// Read the generation the metadata describes, in case the object is overwritten meanwhile.
+	attrs, err := obj.Attrs(ctx)
+	if err != nil {
+		return nil, err
+	}
+	// Read objects that were uploaded with a gzip content encoding as they are stored,
+	// rather than have GCS decompress them.
+	obj, err = o.customerKeys.keyedHandle(obj.Generation(attrs.Generation).ReadCompressed(true), attrs)
 	if err != nil {
-		return nil, errors.WithStack(err)
+		return nil, err
+	}
+
+	// Reads are resumed, and large objects read in parallel, from the generation pinned
+	// above.
+	open := func(ctx context.Context, offset, length int64) (io.ReadCloser, error) {
+		if offset == 0 && length == attrs.Size {
+			// Read the whole object as such, so that the storage client verifies it.
+			length = -1
+		}
+		return obj.NewRangeReader(ctx, offset, length)
+	}
+	r, err := newRangedReader(ctx, o.log.WithField("key", key), attrs.Size, open, o.downloads)
+	if err != nil {
+		return nil, err
+	}
+	// GCS only returns the CRC32C of objects encrypted with a customer-supplied key when
+	// given the key. The storage client verifies those itself when they are read in full
+	// in a single request.
+	if attrs.CustomerKeySHA256 == "" {
+		r = newChecksumReader(r, key, attrs.CRC32C)
+	}
+
+	if o.encryption != nil {
+		if r, err = o.encryption.newDecryptingReader(ctx, key, attrs.Metadata, r); err != nil {
+			return nil, err
+		}
+	} else if _, ok := attrs.Metadata[encryptionMetadataKey]; ok {
+		r.Close()
+		return nil, errors.Errorf("object %s is encrypted on the client side, but neither %s nor %s is set",
+			key, clientSideEncryptionKeyFileConfigKey, clientSideEncryptionKMSKeyNameConfigKey)
 	}
 
-	return r, nil
+	// Objects are decompressed whatever the current compression setting, which only
+	// applies to uploads.
+	return newDecompressingReader(key, attrs.Metadata, r)
 }
 
 func (o *ObjectStore) ListCommonPrefixes(bucket, prefix, delimiter string) ([]string, error) {
+	o, release := o.acquire()
+	defer release()
+	if err := o.scope.check(bucket, prefix); err != nil {
+		return nil, err
+	}
+	res, err := o.listCommonPrefixes(bucket, prefix, delimiter)
+	if o.replication.failover(err, "list", prefix) {
+		return o.replication.secondary.ListCommonPrefixes(o.replication.bucket, prefix, delimiter)
+	}
+	return res, err
+}
+
+func (o *ObjectStore) listCommonPrefixes(bucket, prefix, delimiter string) ([]string, error) {
 	q := &storage.Query{
 		Prefix:    prefix,
 		Delimiter: delimiter,
 	}
 
-	iter := o.client.Bucket(bucket).Objects(context.Background(), q)
+	ctx, cancel := operationContext(o.timeouts.list)
+	defer cancel()
+
+	iter := o.bucketHandle(bucket).Objects(ctx, q)
 
 	var res []string
 	for {
 		obj, err := iter.Next()
 		if err != nil && err != iterator.Done {
-			return nil, errors.WithStack(err)
+			return nil, wrapTimeoutError(ctx, wrapError(err), o.timeouts.list, "listing of %s", prefix)
 		}
 		if err == iterator.Done {
 			break
 		}
 
-		if obj.Prefix != "" {
+		if obj.Prefix != "" && !o.isHidden(obj.Prefix) {
 			res = append(res, obj.Prefix)
 		}
 	}
@@ -278,13 +1114,29 @@ func (o *ObjectStore) ListCommonPrefixes(bucket, prefix, delimiter string) ([]st
 }
 
 func (o *ObjectStore) ListObjects(bucket, prefix string) ([]string, error) {
+	o, release := o.acquire()
+	defer release()
+	if err := o.scope.check(bucket, prefix); err != nil {
+		return nil, err
+	}
+	res, err := o.listObjects(bucket, prefix)
+	if o.replication.failover(err, "list", prefix) {
+		return o.replication.secondary.ListObjects(o.replication.bucket, prefix)
+	}
+	return res, err
+}
+
+func (o *ObjectStore) listObjects(bucket, prefix string) ([]string, error) {
 	q := &storage.Query{
 		Prefix: prefix,
 	}
 
 	var res []string
 
-	iter := o.client.Bucket(bucket).Objects(context.Background(), q)
+	ctx, cancel := operationContext(o.timeouts.list)
+	defer cancel()
+
+	iter := o.bucketHandle(bucket).Objects(ctx, q)
 
 	for {
 		obj, err := iter.Next()
@@ -292,15 +1144,71 @@ func (o *ObjectStore) ListObjects(bucket, prefix string) ([]string, error) {
 			return res, nil
 		}
 		if err != nil {
-			return nil, errors.WithStack(err)
+			return nil, wrapTimeoutError(ctx, wrapError(err), o.timeouts.list, "listing of %s", prefix)
 		}
 
+		if o.isHidden(obj.Name) {
+			continue
+		}
 		res = append(res, obj.Name)
 	}
 }
 
+// isHidden returns whether name is, or is a directory of, the staged uploads or trashed
+// objects that the object store keeps under the BSL prefix, which listings skip.
+func (o *ObjectStore) isHidden(name string) bool {
+	return o.staging.isStaging(name) || o.trash.isTrash(name)
+}
+
 func (o *ObjectStore) DeleteObject(bucket, key string) error {
-	return errors.Wrapf(o.client.Bucket(bucket).Object(key).Delete(context.Background()), "error deleting object %s", key)
+	o, release := o.acquire()
+	defer release()
+	if err := o.scope.check(bucket, key); err != nil {
+		return err
+	}
+	if err := o.deleteObject(bucket, key); err != nil {
+		return err
+	}
+	if o.replication != nil {
+		o.replication.delete(key)
+	}
+	return nil
+}
+
+func (o *ObjectStore) deleteObject(bucket, key string) error {
+	ctx, cancel := operationContext(o.timeouts.request)
+	defer cancel()
+
+	var err error
+	switch {
+	case o.trash.enabled:
+		err = o.trashObject(ctx, bucket, key)
+	case o.retry.conditionalWrites:
+		err = o.deleteCurrentGeneration(ctx, bucket, key)
+	default:
+		// Deleting doesn't require the customer-supplied key the object is encrypted with.
+		err = o.bucketHandle(bucket).Object(key).Delete(ctx)
+	}
+	if err != nil && !errors.Is(err, storage.ErrObjectNotExist) {
+		// Explain the failure if the object is retained or held.
+		if attrs, attrsErr := o.bucketWriter.getAttrs(ctx, bucket, key); attrsErr == nil {
+			if retainedErr := retentionError(key, attrs, time.Now(), classifyError(err)); retainedErr != nil {
+				return errors.WithStack(retainedErr)
+			}
+		}
+	}
+	return wrapErrorf(err, "error deleting object %s", key)
+}
+
+// deleteCurrentGeneration deletes the current version of the object at key on the
+// condition that it's still the same generation, so that the client can retry the
+// deletion without deleting an object written meanwhile.
+func (o *ObjectStore) deleteCurrentGeneration(ctx context.Context, bucket, key string) error {
+	attrs, err := o.bucketWriter.getAttrs(ctx, bucket, key)
+	if err != nil {
+		return err
+	}
+	return o.bucketWriter.deleteIf(ctx, bucket, key, storage.Conditions{GenerationMatch: attrs.Generation})
 }
 
 /*
@@ -308,28 +1216,45 @@ func (o *ObjectStore) DeleteObject(bucket, key string) error {
  * https://cloud.google.com/iam/credentials/reference/rest/v1/projects.serviceAccounts/signBlob
  */
 func (o *ObjectStore) SignBytes(bytes []byte) ([]byte, error) {
-	name := "projects/-/serviceAccounts/" + o.googleAccessID
-	resp, err := o.iamSvc.Projects.ServiceAccounts.SignBlob(name, &iamcredentials.SignBlobRequest{
+	req := &iamcredentials.SignBlobRequest{
 		Payload: base64.StdEncoding.EncodeToString(bytes),
-	}).Context(context.Background()).Do()
+	}
+	for _, d := range o.delegates {
+		req.Delegates = append(req.Delegates, serviceAccountResourceName(d))
+	}
+	ctx, cancel := operationContext(o.timeouts.request)
+	defer cancel()
+
+	resp, err := o.iamSvc.Projects.ServiceAccounts.SignBlob(serviceAccountResourceName(o.googleAccessID), req).Context(ctx).Do()
 
 	if err != nil {
-		return nil, err
+		return nil, wrapError(err)
 	}
 	return base64.StdEncoding.DecodeString(resp.SignedBlob)
 }
 
 func (o *ObjectStore) CreateSignedURL(bucket, key string, ttl time.Duration) (string, error) {
-	// googleAccessID is initialized from ServiceAccount key file and compute engine credentials.
-	// If using external_account credentials, googleAccessID will be empty and we cannot create signed URL.
+	o, release := o.acquire()
+	defer release()
+	if err := o.scope.check(bucket, key); err != nil {
+		return "", err
+	}
+	// googleAccessID is initialized from the service account key file, the service account
+	// impersonated by the credentials or the configuration. If using external_account or
+	// authorized_user credentials without any of those, we cannot create signed URL.
+	if o.encryption != nil {
+		return "", errors.New("signed URLs are not supported with client-side encryption, since they would serve the encrypted contents of the object")
+	}
 	if o.googleAccessID == "" {
-		return "", errors.New("GoogleAccessID is empty, perhaps using external_account credentials, cannot create signed URL")
+		return "", errors.Errorf("no service account to sign as (credentials type %q), cannot create signed URL; set %s or %s in the BackupStorageLocation config",
+			o.fileCredType, serviceAccountConfigKey, impersonateServiceAccountConfigKey)
 	}
 	options := storage.SignedURLOptions{
 		GoogleAccessID: o.googleAccessID,
 		Method:         "GET",
 		Expires:        time.Now().Add(ttl),
 	}
+	o.signedURL.apply(&options)
 
 	if o.privateKey == nil {
 		options.SignBytes = o.SignBytes
@@ -337,5 +1262,9 @@ func (o *ObjectStore) CreateSignedURL(bucket, key string, ttl time.Duration) (st
 		options.PrivateKey = o.privateKey
 	}
 
-	return storage.SignedURL(bucket, key, &options)
+	signedURL, err := storage.SignedURL(bucket, key, &options)
+	if err != nil {
+		return "", err
+	}
+	return o.signedURL.finish(signedURL)
 }
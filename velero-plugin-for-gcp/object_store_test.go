@@ -16,24 +16,50 @@ limitations under the License.
 package main
 
 import (
+	"bytes"
+	"context"
+	"encoding/json"
 	"errors"
-	"io"
+	"fmt"
+	"hash/crc32"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"cloud.google.com/go/storage"
 	pkgerrors "github.com/pkg/errors"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 	velerotest "github.com/vmware-tanzu/velero/pkg/test"
+	"google.golang.org/api/googleapi"
+	"google.golang.org/api/option"
 )
 
 type mockWriteCloser struct {
 	closeErr error
 	writeErr error
+
+	// ctx is the upload context, and ctxErrAtClose its error when Close was called.
+	ctx           context.Context
+	ctxErrAtClose error
+
+	// attrs are the attributes of the uploaded object.
+	attrs *storage.ObjectAttrs
+}
+
+func (m *mockWriteCloser) Attrs() *storage.ObjectAttrs {
+	return m.attrs
 }
 
 func (m *mockWriteCloser) Close() error {
+	if m.ctx != nil {
+		m.ctxErrAtClose = m.ctx.Err()
+	}
 	return m.closeErr
 }
 
@@ -49,20 +75,347 @@ type fakeWriter struct {
 	wc *mockWriteCloser
 
 	attrsErr error
+
+	grantedPermissions []string
+	permissionsErr     error
+
+	attrs *storage.ObjectAttrs
+	opts  writeOptions
+
+	bucketAttrs    *storage.BucketAttrs
+	bucketAttrsErr error
+
+	deletedGenerations []int64
 }
 
 func newFakeWriter(wc *mockWriteCloser) *fakeWriter {
 	return &fakeWriter{wc: wc}
 }
 
-func (fw *fakeWriter) getWriteCloser(bucket, name string) io.WriteCloser {
+func (fw *fakeWriter) getWriteCloser(ctx context.Context, bucket, name string, opts writeOptions) objectWriter {
+	fw.wc.ctx = ctx
+	fw.opts = opts
 	return fw.wc
 }
 
-func (fw *fakeWriter) getAttrs(bucket, key string) (*storage.ObjectAttrs, error) {
+func (fw *fakeWriter) getAttrs(ctx context.Context, bucket, key string) (*storage.ObjectAttrs, error) {
+	if fw.attrs != nil {
+		return fw.attrs, fw.attrsErr
+	}
 	return new(storage.ObjectAttrs), fw.attrsErr
 }
 
+func (fw *fakeWriter) compose(ctx context.Context, bucket, key string, sources []string, opts writeOptions) (*storage.ObjectAttrs, error) {
+	fw.opts = opts
+	return fw.wc.attrs, nil
+}
+
+func (fw *fakeWriter) copyGeneration(ctx context.Context, bucket, key string, generation int64, dst string, conds storage.Conditions) (*storage.ObjectAttrs, error) {
+	return nil, nil
+}
+
+func (fw *fakeWriter) deleteGeneration(ctx context.Context, bucket, key string, generation int64) error {
+	fw.deletedGenerations = append(fw.deletedGenerations, generation)
+	return nil
+}
+
+func (fw *fakeWriter) deleteIf(ctx context.Context, bucket, key string, conds storage.Conditions) error {
+	return nil
+}
+
+func (fw *fakeWriter) listObjects(ctx context.Context, bucket, prefix string) ([]*storage.ObjectAttrs, error) {
+	return nil, nil
+}
+
+func (fw *fakeWriter) getBucketAttrs(ctx context.Context, bucket string) (*storage.BucketAttrs, error) {
+	return fw.bucketAttrs, fw.bucketAttrsErr
+}
+
+func (fw *fakeWriter) testPermissions(ctx context.Context, bucket string, permissions []string) ([]string, error) {
+	return fw.grantedPermissions, fw.permissionsErr
+}
+
+// memoryBucket is a bucketWriter that keeps objects in memory.
+type memoryBucket struct {
+	mu      sync.Mutex
+	objects map[string]*memoryObject
+	// failKeys makes uploads to, and deletions of, the keys for which it returns true fail.
+	failKeys func(key string) bool
+	// composed records the sources of each compose.
+	composed [][]string
+	nextGen  int64
+}
+
+type memoryObject struct {
+	data  []byte
+	attrs storage.ObjectAttrs
+}
+
+func newMemoryBucket() *memoryBucket {
+	return &memoryBucket{objects: map[string]*memoryObject{}}
+}
+
+func (m *memoryBucket) keys() []string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var keys []string
+	for key := range m.objects {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func (m *memoryBucket) data(key string) []byte {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if obj, ok := m.objects[key]; ok {
+		return obj.data
+	}
+	return nil
+}
+
+// put stores an object and returns its attributes.
+func (m *memoryBucket) put(key string, data []byte, opts writeOptions) (*storage.ObjectAttrs, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.failKeys != nil && m.failKeys(key) {
+		return nil, errors.New("upload failed")
+	}
+	if opts.conds != nil {
+		existing, ok := m.objects[key]
+		if (opts.conds.DoesNotExist && ok) || (opts.conds.GenerationMatch != 0 && (!ok || existing.attrs.Generation != opts.conds.GenerationMatch)) {
+			return nil, &googleapi.Error{Code: http.StatusPreconditionFailed, Message: "conditionNotMet"}
+		}
+	}
+	m.nextGen++
+	obj := &memoryObject{data: data, attrs: storage.ObjectAttrs{
+		Name:       key,
+		Generation: m.nextGen,
+		Size:       int64(len(data)),
+		Metadata:   opts.metadata,
+		CRC32C:     crc32.Checksum(data, crc32cTable),
+		Created:    time.Now(),
+	}}
+	m.objects[key] = obj
+	attrs := obj.attrs
+	return &attrs, nil
+}
+
+func (m *memoryBucket) getWriteCloser(ctx context.Context, bucket, key string, opts writeOptions) objectWriter {
+	return &memoryWriter{ctx: ctx, bucket: m, key: key, opts: opts}
+}
+
+func (m *memoryBucket) getAttrs(ctx context.Context, bucket, key string) (*storage.ObjectAttrs, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	obj, ok := m.objects[key]
+	if !ok {
+		return nil, storage.ErrObjectNotExist
+	}
+	attrs := obj.attrs
+	return &attrs, nil
+}
+
+func (m *memoryBucket) compose(ctx context.Context, bucket, key string, sources []string, opts writeOptions) (*storage.ObjectAttrs, error) {
+	if len(sources) > maxComposeSources {
+		return nil, errors.New("too many sources")
+	}
+	var data []byte
+	m.mu.Lock()
+	for _, source := range sources {
+		obj, ok := m.objects[source]
+		if !ok {
+			m.mu.Unlock()
+			return nil, storage.ErrObjectNotExist
+		}
+		data = append(data, obj.data...)
+	}
+	m.composed = append(m.composed, sources)
+	m.mu.Unlock()
+	return m.put(key, data, opts)
+}
+
+func (m *memoryBucket) copyGeneration(ctx context.Context, bucket, key string, generation int64, dst string, conds storage.Conditions) (*storage.ObjectAttrs, error) {
+	m.mu.Lock()
+	obj, ok := m.objects[key]
+	if !ok || obj.attrs.Generation != generation {
+		m.mu.Unlock()
+		return nil, storage.ErrObjectNotExist
+	}
+	data, metadata := obj.data, obj.attrs.Metadata
+	m.mu.Unlock()
+	return m.put(dst, data, writeOptions{conds: &conds, metadata: metadata})
+}
+
+func (m *memoryBucket) deleteGeneration(ctx context.Context, bucket, key string, generation int64) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	obj, ok := m.objects[key]
+	if !ok || obj.attrs.Generation != generation {
+		return storage.ErrObjectNotExist
+	}
+	delete(m.objects, key)
+	return nil
+}
+
+func (m *memoryBucket) deleteIf(ctx context.Context, bucket, key string, conds storage.Conditions) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.failKeys != nil && m.failKeys(key) {
+		return errors.New("delete failed")
+	}
+	obj, ok := m.objects[key]
+	if !ok {
+		return storage.ErrObjectNotExist
+	}
+	if conds.GenerationMatch != 0 && obj.attrs.Generation != conds.GenerationMatch {
+		return &googleapi.Error{Code: http.StatusPreconditionFailed, Message: "conditionNotMet"}
+	}
+	delete(m.objects, key)
+	return nil
+}
+
+func (m *memoryBucket) listObjects(ctx context.Context, bucket, prefix string) ([]*storage.ObjectAttrs, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var objects []*storage.ObjectAttrs
+	for key, obj := range m.objects {
+		if strings.HasPrefix(key, prefix) {
+			attrs := obj.attrs
+			objects = append(objects, &attrs)
+		}
+	}
+	return objects, nil
+}
+
+func (m *memoryBucket) testPermissions(ctx context.Context, bucket string, permissions []string) ([]string, error) {
+	return permissions, nil
+}
+
+func (m *memoryBucket) getBucketAttrs(ctx context.Context, bucket string) (*storage.BucketAttrs, error) {
+	return &storage.BucketAttrs{Name: bucket}, nil
+}
+
+type memoryWriter struct {
+	ctx    context.Context
+	bucket *memoryBucket
+	key    string
+	opts   writeOptions
+	buf    bytes.Buffer
+	attrs  *storage.ObjectAttrs
+}
+
+func (w *memoryWriter) Write(p []byte) (int, error) {
+	if err := w.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return w.buf.Write(p)
+}
+
+func (w *memoryWriter) Close() error {
+	if err := w.ctx.Err(); err != nil {
+		return err
+	}
+	if w.opts.crc32c != nil && *w.opts.crc32c != crc32.Checksum(w.buf.Bytes(), crc32cTable) {
+		return errors.New("CRC32C mismatch")
+	}
+	attrs, err := w.bucket.put(w.key, w.buf.Bytes(), w.opts)
+	w.attrs = attrs
+	return err
+}
+
+func (w *memoryWriter) Attrs() *storage.ObjectAttrs {
+	return w.attrs
+}
+
+// fakeObject is an object served by newFakeGCSServer.
+type fakeObject struct {
+	data     []byte
+	metadata map[string]string
+	// crc32c, if set, is returned instead of the CRC32C of data.
+	crc32c string
+	// status, if set, is the status of every response about the object.
+	status int
+	// userProject, if set, is the project requests must be billed to, as for objects in a
+	// Requester Pays bucket.
+	userProject string
+}
+
+// newFakeGCSServer serves the attributes and contents of the objects of a bucket named
+// "bucket", and deletes them, and returns a storage client for it.
+func newFakeGCSServer(t *testing.T, objects map[string]fakeObject) *storage.Client {
+	t.Helper()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		name, isAttrs := strings.CutPrefix(r.URL.Path, "/storage/v1/b/bucket/o/")
+		if !isAttrs {
+			name = strings.TrimPrefix(r.URL.Path, "/bucket/")
+		}
+		obj, ok := objects[name]
+		if !ok {
+			http.Error(w, `{"error": {"code": 404, "message": "not found"}}`, http.StatusNotFound)
+			return
+		}
+		if obj.status != 0 {
+			http.Error(w, fmt.Sprintf(`{"error": {"code": %d, "message": "failed"}}`, obj.status), obj.status)
+			return
+		}
+		// The JSON API takes the user project as a query parameter, and the XML API as a header.
+		if obj.userProject != "" && r.URL.Query().Get("userProject") != obj.userProject && r.Header.Get("X-Goog-User-Project") != obj.userProject {
+			http.Error(w, `{"error": {"code": 400, "message": "Bucket is a requester pays bucket but no user project provided."}}`, http.StatusBadRequest)
+			return
+		}
+		if r.Method == http.MethodDelete {
+			delete(objects, name)
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+
+		if isAttrs && r.URL.Query().Get("alt") != "media" {
+			crc := obj.crc32c
+			if crc == "" {
+				crc = encodeCRC32C(crc32.Checksum(obj.data, crc32cTable))
+			}
+			w.Header().Set("Content-Type", "application/json")
+			require.NoError(t, json.NewEncoder(w).Encode(map[string]interface{}{
+				"bucket":     "bucket",
+				"name":       name,
+				"generation": "1",
+				"size":       strconv.Itoa(len(obj.data)),
+				"metadata":   obj.metadata,
+				"crc32c":     crc,
+			}))
+			return
+		}
+		if r.URL.Query().Get("generation") != "1" {
+			http.Error(w, "reads must be pinned to the object's generation", http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("X-Goog-Generation", "1")
+		data, status := obj.data, http.StatusOK
+		if rangeHeader, ok := strings.CutPrefix(r.Header.Get("Range"), "bytes="); ok {
+			from, to, _ := strings.Cut(rangeHeader, "-")
+			start, err := strconv.Atoi(from)
+			require.NoError(t, err)
+			end := len(obj.data) - 1
+			if to != "" {
+				end, err = strconv.Atoi(to)
+				require.NoError(t, err)
+			}
+			data, status = obj.data[start:end+1], http.StatusPartialContent
+			w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, end, len(obj.data)))
+		}
+		w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+		w.WriteHeader(status)
+		w.Write(data)
+	}))
+	t.Cleanup(srv.Close)
+
+	client, err := storage.NewClient(context.Background(), option.WithEndpoint(srv.URL+"/storage/v1/"), option.WithoutAuthentication())
+	require.NoError(t, err)
+	return client
+}
+
 func TestPutObject(t *testing.T) {
 	tests := []struct {
 		name        string
@@ -102,6 +455,59 @@ func TestPutObject(t *testing.T) {
 
 			err := o.PutObject("bucket", "key", strings.NewReader("contents"))
 			assert.Equal(t, test.expectedErr, err)
+
+			// A failed copy must abort the upload rather than commit a truncated object.
+			if test.writeErr != nil {
+				assert.ErrorIs(t, wc.ctxErrAtClose, context.Canceled)
+			} else {
+				assert.NoError(t, wc.ctxErrAtClose)
+			}
+		})
+	}
+}
+
+func TestPutObjectConditionalUpload(t *testing.T) {
+	tests := []struct {
+		name          string
+		attrs         *storage.ObjectAttrs
+		attrsErr      error
+		expectedConds *storage.Conditions
+		expectedErr   string
+	}{
+		{
+			name:          "new object must not exist",
+			attrsErr:      storage.ErrObjectNotExist,
+			expectedConds: &storage.Conditions{DoesNotExist: true},
+		},
+		{
+			name:          "existing object must keep its generation",
+			attrs:         &storage.ObjectAttrs{Generation: 42},
+			expectedConds: &storage.Conditions{GenerationMatch: 42},
+		},
+		{
+			name:        "errors getting the generation are returned",
+			attrsErr:    errors.New("bad"),
+			expectedErr: "error getting the current generation of key: bad",
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			w := newFakeWriter(newMockWriteCloser(nil, nil))
+			w.attrs = tc.attrs
+			w.attrsErr = tc.attrsErr
+
+			o := newObjectStore(velerotest.NewLogger())
+			o.bucketWriter = w
+			o.retry.conditionalWrites = true
+
+			err := o.PutObject("bucket", "key", strings.NewReader("contents"))
+			if tc.expectedErr != "" {
+				assert.EqualError(t, err, tc.expectedErr)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tc.expectedConds, w.opts.conds)
 		})
 	}
 }
@@ -208,6 +614,33 @@ func Test_getSecretAccountKey(t *testing.T) {
 			want:    externalAccountKey,
 			wantErr: false,
 		},
+		{
+			name: "get secret impersonated service account key",
+			args: args{
+				secretByte: []byte(`{
+  "type": "impersonated_service_account",
+  "service_account_impersonation_url": "https://iamcredentials.googleapis.com/v1/projects/-/serviceAccounts/SA@PROJECT_ID.iam.gserviceaccount.com:generateAccessToken",
+  "source_credentials": {"type": "authorized_user"}
+}
+`),
+			},
+			want:    impersonatedServiceAccountKey,
+			wantErr: false,
+		},
+		{
+			name: "missing type returns an error",
+			args: args{
+				secretByte: []byte(`{"client_email": "SERVICE_ACCOUNT_EMAIL"}`),
+			},
+			wantErr: true,
+		},
+		{
+			name: "non-string type returns an error",
+			args: args{
+				secretByte: []byte(`{"type": 1}`),
+			},
+			wantErr: true,
+		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
@@ -222,3 +655,70 @@ func Test_getSecretAccountKey(t *testing.T) {
 		})
 	}
 }
+
+func TestInitSigningIdentity(t *testing.T) {
+	externalAccount := `{
+  "type": "external_account",
+  "audience": "//iam.googleapis.com/projects/123/locations/global/workloadIdentityPools/POOL/providers/PROVIDER",
+  "subject_token_type": "urn:ietf:params:oauth:token-type:jwt",
+  "token_url": "https://sts.googleapis.com/v1/token",
+  "service_account_impersonation_url": "https://iamcredentials.googleapis.com/v1/projects/-/serviceAccounts/velero@p.iam.gserviceaccount.com:generateAccessToken",
+  "credential_source": {"file": "/var/run/token"}
+}`
+	externalAccountNoImpersonation := `{
+  "type": "external_account",
+  "audience": "//iam.googleapis.com/projects/123/locations/global/workloadIdentityPools/POOL/providers/PROVIDER",
+  "subject_token_type": "urn:ietf:params:oauth:token-type:jwt",
+  "token_url": "https://sts.googleapis.com/v1/token",
+  "credential_source": {"file": "/var/run/token"}
+}`
+
+	tests := []struct {
+		name                   string
+		credentials            string
+		config                 map[string]string
+		expectedGoogleAccessID string
+		expectedSignURLError   bool
+	}{
+		{
+			name:                   "external_account with service account impersonation",
+			credentials:            externalAccount,
+			expectedGoogleAccessID: "velero@p.iam.gserviceaccount.com",
+		},
+		{
+			name:                   "serviceAccount config takes precedence",
+			credentials:            externalAccount,
+			config:                 map[string]string{serviceAccountConfigKey: "other@p.iam.gserviceaccount.com"},
+			expectedGoogleAccessID: "other@p.iam.gserviceaccount.com",
+		},
+		{
+			name:                 "external_account without a service account cannot sign",
+			credentials:          externalAccountNoImpersonation,
+			expectedSignURLError: true,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			config := map[string]string{
+				credentialsFileConfigKey:     writeTestCredentials(t, tc.credentials),
+				skipPermissionCheckConfigKey: "true",
+			}
+			for k, v := range tc.config {
+				config[k] = v
+			}
+
+			o := newObjectStore(velerotest.NewLogger())
+			require.NoError(t, o.Init(config))
+			assert.Equal(t, tc.expectedGoogleAccessID, o.googleAccessID)
+			assert.Equal(t, externalAccountKey, o.fileCredType)
+
+			if tc.expectedSignURLError {
+				_, err := o.CreateSignedURL("bucket", "key", time.Minute)
+				assert.Error(t, err)
+			} else {
+				assert.NotNil(t, o.iamSvc)
+			}
+		})
+	}
+}
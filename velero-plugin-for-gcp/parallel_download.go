@@ -0,0 +1,299 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"io"
+	"strconv"
+
+	"cloud.google.com/go/storage"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"k8s.io/apimachinery/pkg/api/resource"
+)
+
+const (
+	parallelDownloadThresholdConfigKey   = "parallelDownloadThreshold"
+	parallelDownloadPartSizeConfigKey    = "parallelDownloadPartSize"
+	parallelDownloadConcurrencyConfigKey = "parallelDownloadConcurrency"
+	downloadMaxResumesConfigKey          = "downloadMaxResumes"
+)
+
+const (
+	defaultParallelDownloadPartSize    = 32 * 1024 * 1024
+	defaultParallelDownloadConcurrency = 4
+	defaultDownloadMaxResumes          = 3
+)
+
+// downloadConfig describes how objects are read: large objects are fetched as ranges
+// read concurrently, and interrupted reads are resumed where they stopped.
+type downloadConfig struct {
+	// threshold is the size above which objects are read in parallel, or 0 if they never are.
+	threshold   int64
+	partSize    int64
+	concurrency int
+	// maxResumes is the number of times a read is resumed after a transient error
+	// without receiving any data in between.
+	maxResumes int
+}
+
+// parseDownloadConfig reads the download settings from the BSL config. Parallel
+// downloads are enabled by setting parallelDownloadThreshold.
+func parseDownloadConfig(config map[string]string) (downloadConfig, error) {
+	c := downloadConfig{
+		partSize:    defaultParallelDownloadPartSize,
+		concurrency: defaultParallelDownloadConcurrency,
+		maxResumes:  defaultDownloadMaxResumes,
+	}
+
+	for key, size := range map[string]*int64{
+		parallelDownloadThresholdConfigKey: &c.threshold,
+		parallelDownloadPartSizeConfigKey:  &c.partSize,
+	} {
+		value, ok := config[key]
+		if !ok {
+			continue
+		}
+		q, err := resource.ParseQuantity(value)
+		if err != nil {
+			return c, errors.Wrapf(err, "invalid value for %s", key)
+		}
+		if q.Value() <= 0 {
+			return c, errors.Errorf("invalid value for %s: must be positive", key)
+		}
+		*size = q.Value()
+	}
+
+	if value, ok := config[parallelDownloadConcurrencyConfigKey]; ok {
+		concurrency, err := strconv.Atoi(value)
+		if err != nil {
+			return c, errors.Wrapf(err, "invalid value for %s", parallelDownloadConcurrencyConfigKey)
+		}
+		if concurrency < 1 {
+			return c, errors.Errorf("invalid value for %s: must be at least 1", parallelDownloadConcurrencyConfigKey)
+		}
+		c.concurrency = concurrency
+	}
+
+	if value, ok := config[downloadMaxResumesConfigKey]; ok {
+		maxResumes, err := strconv.Atoi(value)
+		if err != nil {
+			return c, errors.Wrapf(err, "invalid value for %s", downloadMaxResumesConfigKey)
+		}
+		if maxResumes < 0 {
+			return c, errors.Errorf("invalid value for %s: must not be negative", downloadMaxResumesConfigKey)
+		}
+		c.maxResumes = maxResumes
+	}
+
+	return c, nil
+}
+
+// rangeOpener opens a reader for length bytes of an object from offset. It must always
+// read the same generation of the object, so that resumed and parallel reads never mix
+// the data of different versions.
+type rangeOpener func(ctx context.Context, offset, length int64) (io.ReadCloser, error)
+
+// newRangedReader reads the size bytes of an object through open, as concurrently
+// fetched parts if it exceeds the parallel download threshold.
+func newRangedReader(ctx context.Context, log logrus.FieldLogger, size int64, open rangeOpener, config downloadConfig) (io.ReadCloser, error) {
+	if config.threshold > 0 && size > config.threshold {
+		return newParallelReader(ctx, log, size, open, config), nil
+	}
+	return newResumingReader(ctx, log, open, 0, size, config.maxResumes)
+}
+
+// resumingReader reads a range of an object, and reopens it at the offset it stopped at
+// when the read fails with a transient error, such as a dropped connection.
+type resumingReader struct {
+	ctx  context.Context
+	log  logrus.FieldLogger
+	open rangeOpener
+	// offset is the offset of the next byte to read, and end the offset just past the range.
+	offset, end int64
+	maxResumes  int
+	// resumes is the number of times the read was resumed since data was last received.
+	resumes int
+
+	r io.ReadCloser
+}
+
+func newResumingReader(ctx context.Context, log logrus.FieldLogger, open rangeOpener, offset, length int64, maxResumes int) (*resumingReader, error) {
+	r := &resumingReader{
+		ctx:        ctx,
+		log:        log,
+		open:       open,
+		offset:     offset,
+		end:        offset + length,
+		maxResumes: maxResumes,
+	}
+	var err error
+	if r.r, err = open(ctx, offset, length); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *resumingReader) Read(p []byte) (int, error) {
+	for {
+		if r.r == nil {
+			return 0, io.ErrUnexpectedEOF
+		}
+
+		n, err := r.r.Read(p)
+		r.offset += int64(n)
+		if n > 0 {
+			r.resumes = 0
+		}
+		if err == io.EOF && r.offset < r.end {
+			err = io.ErrUnexpectedEOF
+		}
+		if err == nil || err == io.EOF || !r.resumable(err) {
+			return n, err
+		}
+
+		r.resumes++
+		r.log.WithError(err).WithField("offset", r.offset).Warn("Resuming interrupted download")
+		r.r.Close()
+		if r.r, err = r.open(r.ctx, r.offset, r.end-r.offset); err != nil {
+			r.r = nil
+			return n, errors.Wrapf(err, "error resuming download at offset %d", r.offset)
+		}
+		if n > 0 {
+			return n, nil
+		}
+	}
+}
+
+func (r *resumingReader) resumable(err error) bool {
+	return r.resumes < r.maxResumes && r.ctx.Err() == nil && storage.ShouldRetry(err)
+}
+
+func (r *resumingReader) Close() error {
+	if r.r == nil {
+		return nil
+	}
+	return r.r.Close()
+}
+
+// downloadedPart is a part of an object read by a parallelReader.
+type downloadedPart struct {
+	data []byte
+	err  error
+}
+
+// parallelReader reads an object as parts fetched concurrently, and returns them in
+// order. At most concurrency parts are being fetched or waiting to be read at once,
+// which bounds the memory used to concurrency times the part size.
+type parallelReader struct {
+	ctx    context.Context
+	cancel context.CancelFunc
+	// parts receive the parts of the object in order, once fetched.
+	parts []chan downloadedPart
+	// slots limits the number of parts fetched or held at once.
+	slots chan struct{}
+
+	next    int
+	current []byte
+	err     error
+}
+
+func newParallelReader(ctx context.Context, log logrus.FieldLogger, size int64, open rangeOpener, config downloadConfig) *parallelReader {
+	ctx, cancel := context.WithCancel(ctx)
+	p := &parallelReader{
+		ctx:    ctx,
+		cancel: cancel,
+		parts:  make([]chan downloadedPart, (size+config.partSize-1)/config.partSize),
+		slots:  make(chan struct{}, config.concurrency),
+	}
+	for i := range p.parts {
+		p.parts[i] = make(chan downloadedPart, 1)
+	}
+
+	go func() {
+		for i := range p.parts {
+			select {
+			case p.slots <- struct{}{}:
+			case <-ctx.Done():
+				return
+			}
+			offset := int64(i) * config.partSize
+			length := min(config.partSize, size-offset)
+			go func(part chan<- downloadedPart) {
+				part <- fetchPart(ctx, log.WithField("part", i), open, offset, length, config.maxResumes)
+			}(p.parts[i])
+		}
+	}()
+	return p
+}
+
+// fetchPart reads a range of an object in full.
+func fetchPart(ctx context.Context, log logrus.FieldLogger, open rangeOpener, offset, length int64, maxResumes int) downloadedPart {
+	r, err := newResumingReader(ctx, log, open, offset, length, maxResumes)
+	if err != nil {
+		return downloadedPart{err: err}
+	}
+	defer r.Close()
+
+	data := make([]byte, length)
+	if _, err := io.ReadFull(r, data); err != nil {
+		return downloadedPart{err: errors.Wrapf(err, "error reading bytes %d-%d", offset, offset+length-1)}
+	}
+	return downloadedPart{data: data}
+}
+
+func (p *parallelReader) Read(b []byte) (int, error) {
+	if p.err == nil {
+		p.err = p.ctx.Err()
+	}
+	if p.err != nil {
+		return 0, p.err
+	}
+	if len(p.current) == 0 {
+		if p.next == len(p.parts) {
+			return 0, io.EOF
+		}
+		select {
+		case part := <-p.parts[p.next]:
+			if part.err != nil {
+				p.err = part.err
+				return 0, p.err
+			}
+			p.current = part.data
+			p.next++
+		case <-p.ctx.Done():
+			p.err = p.ctx.Err()
+			return 0, p.err
+		}
+	}
+
+	n := copy(b, p.current)
+	p.current = p.current[n:]
+	if len(p.current) == 0 {
+		// The part has been read, let the next one be fetched.
+		p.current = nil
+		<-p.slots
+	}
+	return n, nil
+}
+
+// Close stops fetching parts.
+func (p *parallelReader) Close() error {
+	p.cancel()
+	return nil
+}
@@ -0,0 +1,279 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"sync"
+	"testing"
+	"testing/iotest"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	velerotest "github.com/vmware-tanzu/velero/pkg/test"
+)
+
+func TestParseDownloadConfig(t *testing.T) {
+	tests := []struct {
+		name           string
+		config         map[string]string
+		expectedConfig downloadConfig
+		expectedError  string
+	}{
+		{
+			name:   "parallel downloads disabled by default",
+			config: map[string]string{},
+			expectedConfig: downloadConfig{
+				partSize:    defaultParallelDownloadPartSize,
+				concurrency: defaultParallelDownloadConcurrency,
+				maxResumes:  defaultDownloadMaxResumes,
+			},
+		},
+		{
+			name: "all settings",
+			config: map[string]string{
+				parallelDownloadThresholdConfigKey:   "100Mi",
+				parallelDownloadPartSizeConfigKey:    "8Mi",
+				parallelDownloadConcurrencyConfigKey: "8",
+				downloadMaxResumesConfigKey:          "0",
+			},
+			expectedConfig: downloadConfig{
+				threshold:   100 << 20,
+				partSize:    8 << 20,
+				concurrency: 8,
+			},
+		},
+		{
+			name:          "invalid size",
+			config:        map[string]string{parallelDownloadThresholdConfigKey: "0"},
+			expectedError: "invalid value for parallelDownloadThreshold: must be positive",
+		},
+		{
+			name:          "invalid concurrency",
+			config:        map[string]string{parallelDownloadConcurrencyConfigKey: "0"},
+			expectedError: "invalid value for parallelDownloadConcurrency: must be at least 1",
+		},
+		{
+			name:          "invalid resumes",
+			config:        map[string]string{downloadMaxResumesConfigKey: "-1"},
+			expectedError: "invalid value for downloadMaxResumes: must not be negative",
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			config, err := parseDownloadConfig(tc.config)
+			if tc.expectedError != "" {
+				assert.EqualError(t, err, tc.expectedError)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tc.expectedConfig, config)
+		})
+	}
+}
+
+// flakyObject serves ranges of data, cutting the first failures reads off halfway
+// through with err, or before any data is read if failFast is set.
+type flakyObject struct {
+	data     []byte
+	failures int
+	err      error
+	failFast bool
+
+	mu sync.Mutex
+	// opens are the offsets reads were opened at.
+	opens []int64
+	// open and maxOpen are the number of readers open and the most open at once.
+	open, maxOpen int
+}
+
+func (f *flakyObject) openRange(_ context.Context, offset, length int64) (io.ReadCloser, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.opens = append(f.opens, offset)
+	f.open++
+	f.maxOpen = max(f.maxOpen, f.open)
+
+	data := f.data[offset : offset+length]
+	r := io.Reader(bytes.NewReader(data))
+	if f.failures > 0 && len(data) > 1 {
+		f.failures--
+		cut := len(data) / 2
+		if f.failFast {
+			cut = 0
+		}
+		r = io.MultiReader(bytes.NewReader(data[:cut]), iotest.ErrReader(f.err))
+	}
+	return &flakyReader{Reader: r, object: f}, nil
+}
+
+type flakyReader struct {
+	io.Reader
+	object *flakyObject
+}
+
+func (r *flakyReader) Close() error {
+	r.object.mu.Lock()
+	defer r.object.mu.Unlock()
+	r.object.open--
+	return nil
+}
+
+func TestResumingReader(t *testing.T) {
+	data := randomData(t, 1000)
+
+	tests := []struct {
+		name          string
+		failures      int
+		err           error
+		failFast      bool
+		expectedOpens []int64
+		expectedError error
+	}{
+		{
+			name:          "uninterrupted",
+			expectedOpens: []int64{0},
+		},
+		{
+			name:          "resumes at the offset reached",
+			failures:      2,
+			err:           io.ErrUnexpectedEOF,
+			expectedOpens: []int64{0, 500, 750},
+		},
+		{
+			name:          "resumes after a premature EOF",
+			failures:      1,
+			err:           io.EOF,
+			expectedOpens: []int64{0, 500},
+		},
+		{
+			name:          "keeps resuming while data is received",
+			failures:      5,
+			err:           io.ErrUnexpectedEOF,
+			expectedOpens: []int64{0, 500, 750, 875, 937, 968},
+		},
+		{
+			name:          "gives up after maxResumes without data",
+			failures:      5,
+			err:           io.ErrUnexpectedEOF,
+			failFast:      true,
+			expectedOpens: []int64{0, 0, 0, 0},
+			expectedError: io.ErrUnexpectedEOF,
+		},
+		{
+			name:          "doesn't resume after permanent errors",
+			failures:      1,
+			err:           assert.AnError,
+			expectedOpens: []int64{0},
+			expectedError: assert.AnError,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			object := &flakyObject{data: data, failures: tc.failures, err: tc.err, failFast: tc.failFast}
+			r, err := newResumingReader(context.Background(), velerotest.NewLogger(), object.openRange, 0, int64(len(data)), 3)
+			require.NoError(t, err)
+
+			read, err := io.ReadAll(r)
+			require.NoError(t, r.Close())
+			assert.Equal(t, tc.expectedOpens, object.opens)
+			assert.Zero(t, object.open)
+			if tc.expectedError != nil {
+				assert.ErrorIs(t, err, tc.expectedError)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, data, read)
+		})
+	}
+}
+
+func TestParallelReader(t *testing.T) {
+	data := randomData(t, 1000)
+	config := downloadConfig{threshold: 100, partSize: 64, concurrency: 3, maxResumes: 3}
+
+	object := &flakyObject{data: data, failures: 4, err: io.ErrUnexpectedEOF}
+	r, err := newRangedReader(context.Background(), velerotest.NewLogger(), int64(len(data)), object.openRange, config)
+	require.NoError(t, err)
+	require.IsType(t, &parallelReader{}, r)
+
+	read, err := io.ReadAll(r)
+	require.NoError(t, err)
+	require.NoError(t, r.Close())
+	assert.Equal(t, data, read)
+	assert.Len(t, object.opens, 16+4)
+	assert.LessOrEqual(t, object.maxOpen, config.concurrency)
+}
+
+func TestParallelReaderFailure(t *testing.T) {
+	data := randomData(t, 1000)
+	config := downloadConfig{threshold: 100, partSize: 64, concurrency: 3}
+
+	object := &flakyObject{data: data, failures: 1, err: assert.AnError}
+	r, err := newRangedReader(context.Background(), velerotest.NewLogger(), int64(len(data)), object.openRange, config)
+	require.NoError(t, err)
+
+	_, err = io.ReadAll(r)
+	assert.ErrorIs(t, err, assert.AnError)
+	assert.ErrorContains(t, err, "error reading bytes ")
+	require.NoError(t, r.Close())
+}
+
+func TestParallelReaderClose(t *testing.T) {
+	data := randomData(t, 1000)
+	config := downloadConfig{threshold: 100, partSize: 64, concurrency: 3}
+
+	object := &flakyObject{data: data}
+	r, err := newRangedReader(context.Background(), velerotest.NewLogger(), int64(len(data)), object.openRange, config)
+	require.NoError(t, err)
+
+	buf := make([]byte, 10)
+	_, err = r.Read(buf)
+	require.NoError(t, err)
+	require.NoError(t, r.Close())
+
+	_, err = r.Read(buf)
+	assert.ErrorIs(t, err, context.Canceled)
+}
+
+func TestGetObjectParallelDownload(t *testing.T) {
+	data := randomData(t, 1000)
+
+	o := newObjectStore(velerotest.NewLogger())
+	o.client = newFakeGCSServer(t, map[string]fakeObject{
+		"large":     {data: data},
+		"corrupted": {data: data, crc32c: encodeCRC32C(1)},
+	})
+	o.downloads = downloadConfig{threshold: 100, partSize: 64, concurrency: 3}
+
+	r, err := o.GetObject("bucket", "large")
+	require.NoError(t, err)
+	read, err := io.ReadAll(r)
+	require.NoError(t, err)
+	require.NoError(t, r.Close())
+	assert.Equal(t, data, read)
+
+	r, err = o.GetObject("bucket", "corrupted")
+	require.NoError(t, err)
+	_, err = io.ReadAll(r)
+	assert.ErrorContains(t, err, "CRC32C mismatch for object corrupted: computed ")
+	require.NoError(t, r.Close())
+}
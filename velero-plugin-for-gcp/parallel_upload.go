@@ -0,0 +1,422 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"hash/crc32"
+	"strconv"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/storage"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"k8s.io/apimachinery/pkg/api/resource"
+)
+
+const (
+	parallelUploadThresholdConfigKey   = "parallelUploadThreshold"
+	parallelUploadPartSizeConfigKey    = "parallelUploadPartSize"
+	parallelUploadConcurrencyConfigKey = "parallelUploadConcurrency"
+	parallelUploadMaxMemoryConfigKey   = "parallelUploadMaxMemory"
+)
+
+const (
+	defaultParallelUploadPartSize    = 32 * 1024 * 1024
+	defaultParallelUploadConcurrency = 4
+
+	// maxComposeSources is the most objects GCS composes in one request.
+	maxComposeSources = 32
+)
+
+// parallelUploadConfig describes how large uploads are split into parts that are
+// uploaded concurrently, then composed into the object.
+type parallelUploadConfig struct {
+	// threshold is the size above which uploads are split, or 0 if they never are.
+	threshold   int64
+	partSize    int64
+	concurrency int
+	// maxMemory bounds the memory used to buffer the parts of an upload.
+	maxMemory int64
+}
+
+// parseParallelUploadConfig reads the parallel upload settings from the BSL config.
+// Parallel uploads are enabled by setting parallelUploadThreshold.
+func parseParallelUploadConfig(config map[string]string) (parallelUploadConfig, error) {
+	c := parallelUploadConfig{
+		partSize:    defaultParallelUploadPartSize,
+		concurrency: defaultParallelUploadConcurrency,
+	}
+
+	for key, size := range map[string]*int64{
+		parallelUploadThresholdConfigKey: &c.threshold,
+		parallelUploadPartSizeConfigKey:  &c.partSize,
+		parallelUploadMaxMemoryConfigKey: &c.maxMemory,
+	} {
+		value, ok := config[key]
+		if !ok {
+			continue
+		}
+		q, err := resource.ParseQuantity(value)
+		if err != nil {
+			return c, errors.Wrapf(err, "invalid value for %s", key)
+		}
+		if q.Value() <= 0 {
+			return c, errors.Errorf("invalid value for %s: must be positive", key)
+		}
+		*size = q.Value()
+	}
+
+	if value, ok := config[parallelUploadConcurrencyConfigKey]; ok {
+		concurrency, err := strconv.Atoi(value)
+		if err != nil {
+			return c, errors.Wrapf(err, "invalid value for %s", parallelUploadConcurrencyConfigKey)
+		}
+		if concurrency < 1 {
+			return c, errors.Errorf("invalid value for %s: must be at least 1", parallelUploadConcurrencyConfigKey)
+		}
+		c.concurrency = concurrency
+	}
+
+	if c.maxMemory == 0 {
+		// Enough to buffer the parts being uploaded, the one being filled and the ones held
+		// until the size of the upload is known to exceed the threshold.
+		c.maxMemory = c.partSize * int64(c.concurrency+1)
+		if c.maxMemory < c.threshold+c.partSize {
+			c.maxMemory = c.threshold + c.partSize
+		}
+	}
+	if c.threshold > 0 && c.maxMemory < c.threshold+c.partSize {
+		return c, errors.Errorf("%s must be at least %s plus %s", parallelUploadMaxMemoryConfigKey, parallelUploadThresholdConfigKey, parallelUploadPartSizeConfigKey)
+	}
+	return c, nil
+}
+
+// buffers returns the number of part buffers an upload may allocate.
+func (c parallelUploadConfig) buffers() int {
+	return int(c.maxMemory / c.partSize)
+}
+
+// uploadedPart is an object written while composing an upload.
+type uploadedPart struct {
+	name       string
+	generation int64
+}
+
+// compositeWriter uploads an object as parts written concurrently to temporary objects,
+// which are then composed into the object and deleted. Data is held in memory until it
+// exceeds the threshold, and uploaded as a single object if it doesn't.
+type compositeWriter struct {
+	ctx          context.Context
+	log          logrus.FieldLogger
+	bucketWriter bucketWriter
+	bucket, key  string
+	// partsPrefix is the hidden directory the temporary objects are written under.
+	partsPrefix string
+	opts        writeOptions
+	config      parallelUploadConfig
+	// cleanupTimeout bounds the deletion of temporary objects, which must happen even
+	// when ctx is done.
+	cleanupTimeout time.Duration
+
+	uploadID string
+	size     int64
+	current  []byte
+	// held are the full parts held until the upload is known to exceed the threshold.
+	held    [][]byte
+	started bool
+	// free limits the number of part buffers allocated at once.
+	free  chan []byte
+	queue chan indexedPart
+	wg    sync.WaitGroup
+
+	mu    sync.Mutex
+	parts []uploadedPart
+	// temporary are all the temporary objects written, to delete once done.
+	temporary []uploadedPart
+	err       error
+
+	attrs *storage.ObjectAttrs
+}
+
+type indexedPart struct {
+	index int
+	data  []byte
+}
+
+// newUploadID returns a random ID for the temporary objects of an upload, so that those
+// of concurrent uploads to the same key don't collide.
+func newUploadID() (string, error) {
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		return "", errors.WithStack(err)
+	}
+	return hex.EncodeToString(id), nil
+}
+
+func newCompositeWriter(ctx context.Context, log logrus.FieldLogger, bw bucketWriter, bucket, key, partsPrefix, uploadID string, opts writeOptions, config parallelUploadConfig, cleanupTimeout time.Duration) *compositeWriter {
+	c := &compositeWriter{
+		ctx:            ctx,
+		log:            log,
+		bucketWriter:   bw,
+		bucket:         bucket,
+		key:            key,
+		partsPrefix:    partsPrefix,
+		opts:           opts,
+		config:         config,
+		cleanupTimeout: cleanupTimeout,
+		uploadID:       uploadID,
+		free:           make(chan []byte, config.buffers()),
+	}
+	for i := 0; i < config.buffers(); i++ {
+		c.free <- nil
+	}
+	return c
+}
+
+// partName returns the name of a temporary object of the upload. Temporary objects are
+// written to the hidden directory rather than next to the object, so that listings skip
+// them and those left over from a crash are swept.
+func (c *compositeWriter) partName(name string) string {
+	return fmt.Sprintf("%s%s.parts/%s", c.partsPrefix, c.uploadID, name)
+}
+
+func (c *compositeWriter) Write(p []byte) (int, error) {
+	var n int
+	for len(p) > 0 {
+		if err := c.failure(); err != nil {
+			return n, err
+		}
+		if c.current == nil {
+			buf, err := c.buffer()
+			if err != nil {
+				return n, err
+			}
+			c.current = buf
+		}
+
+		copied := copy(c.current[len(c.current):cap(c.current)], p)
+		c.current = c.current[:len(c.current)+copied]
+		c.size += int64(copied)
+		p = p[copied:]
+		n += copied
+
+		if len(c.current) == cap(c.current) {
+			c.flushPart()
+		}
+	}
+	return n, nil
+}
+
+// buffer returns a part buffer once one is available.
+func (c *compositeWriter) buffer() ([]byte, error) {
+	select {
+	case buf := <-c.free:
+		if buf == nil {
+			buf = make([]byte, 0, c.config.partSize)
+		}
+		return buf[:0], nil
+	case <-c.ctx.Done():
+		return nil, c.ctx.Err()
+	}
+}
+
+// flushPart queues the current part for upload, or holds it while the upload is under
+// the threshold.
+func (c *compositeWriter) flushPart() {
+	part := c.current
+	c.current = nil
+
+	if c.started {
+		c.enqueue(part)
+		return
+	}
+	c.held = append(c.held, part)
+	if c.size > c.config.threshold {
+		c.start()
+	}
+}
+
+// start starts the workers uploading parts, and queues the held parts.
+func (c *compositeWriter) start() {
+	c.started = true
+	c.queue = make(chan indexedPart)
+	for i := 0; i < c.config.concurrency; i++ {
+		c.wg.Add(1)
+		go c.uploadParts()
+	}
+	for _, part := range c.held {
+		c.enqueue(part)
+	}
+	c.held = nil
+}
+
+// enqueue numbers a part and queues it for upload.
+func (c *compositeWriter) enqueue(data []byte) {
+	c.mu.Lock()
+	index := len(c.parts)
+	c.parts = append(c.parts, uploadedPart{name: c.partName(fmt.Sprintf("part-%05d", index))})
+	c.mu.Unlock()
+	c.queue <- indexedPart{index: index, data: data}
+}
+
+func (c *compositeWriter) uploadParts() {
+	defer c.wg.Done()
+	for part := range c.queue {
+		if c.failure() == nil {
+			if err := c.uploadPart(part); err != nil {
+				c.fail(err)
+			}
+		}
+		c.free <- part.data
+	}
+}
+
+func (c *compositeWriter) uploadPart(part indexedPart) error {
+	c.mu.Lock()
+	name := c.parts[part.index].name
+	c.mu.Unlock()
+
+	crc := crc32.Checksum(part.data, crc32cTable)
+	w := c.bucketWriter.getWriteCloser(c.ctx, c.bucket, name, writeOptions{temporary: true, crc32c: &crc})
+	if _, err := w.Write(part.data); err != nil {
+		w.Close()
+		return errors.Wrapf(err, "error uploading part %d of %s", part.index, c.key)
+	}
+	if err := w.Close(); err != nil {
+		return errors.Wrapf(err, "error uploading part %d of %s", part.index, c.key)
+	}
+
+	var generation int64
+	if attrs := w.Attrs(); attrs != nil {
+		generation = attrs.Generation
+	}
+	c.mu.Lock()
+	c.parts[part.index].generation = generation
+	c.temporary = append(c.temporary, c.parts[part.index])
+	c.mu.Unlock()
+	return nil
+}
+
+func (c *compositeWriter) fail(err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.err == nil {
+		c.err = err
+	}
+}
+
+func (c *compositeWriter) failure() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.err
+}
+
+// Close uploads the remaining data and composes the object, or uploads it as a single
+// object if it doesn't exceed the threshold. Temporary objects are deleted either way.
+func (c *compositeWriter) Close() error {
+	if !c.started {
+		if c.size <= c.config.threshold || c.ctx.Err() != nil {
+			return c.uploadSingle()
+		}
+		c.start()
+	}
+
+	if len(c.current) > 0 && c.failure() == nil && c.ctx.Err() == nil {
+		c.enqueue(c.current)
+		c.current = nil
+	}
+	close(c.queue)
+	c.wg.Wait()
+	defer c.cleanup()
+
+	if err := c.failure(); err != nil {
+		return err
+	}
+	if err := c.ctx.Err(); err != nil {
+		return err
+	}
+
+	names := make([]string, 0, len(c.parts))
+	for _, part := range c.parts {
+		names = append(names, part.name)
+	}
+	attrs, err := c.composeParts(names)
+	if err != nil {
+		return err
+	}
+	c.attrs = attrs
+	c.log.WithFields(logrus.Fields{"key": c.key, "parts": len(c.parts), "size": c.size}).Info("Composed parallel upload")
+	return nil
+}
+
+// uploadSingle uploads the held data as a single object.
+func (c *compositeWriter) uploadSingle() error {
+	w := c.bucketWriter.getWriteCloser(c.ctx, c.bucket, c.key, c.opts)
+	for _, part := range append(c.held, c.current) {
+		if _, err := w.Write(part); err != nil {
+			w.Close()
+			return err
+		}
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	c.attrs = w.Attrs()
+	return nil
+}
+
+// composeParts composes the named objects into the object, going through intermediate
+// objects if there are more than GCS composes at once.
+func (c *compositeWriter) composeParts(names []string) (*storage.ObjectAttrs, error) {
+	for level := 0; len(names) > maxComposeSources; level++ {
+		var next []string
+		for i := 0; i < len(names); i += maxComposeSources {
+			name := c.partName(fmt.Sprintf("compose-%d-%05d", level, i/maxComposeSources))
+			attrs, err := c.bucketWriter.compose(c.ctx, c.bucket, name, names[i:min(i+maxComposeSources, len(names))], writeOptions{temporary: true})
+			if err != nil {
+				return nil, errors.Wrapf(err, "error composing parts of %s", c.key)
+			}
+			c.temporary = append(c.temporary, uploadedPart{name: name, generation: attrs.Generation})
+			next = append(next, name)
+		}
+		names = next
+	}
+
+	attrs, err := c.bucketWriter.compose(c.ctx, c.bucket, c.key, names, c.opts)
+	return attrs, errors.Wrapf(err, "error composing parts of %s", c.key)
+}
+
+// cleanup deletes the temporary objects of the upload.
+func (c *compositeWriter) cleanup() {
+	ctx, cancel := operationContext(c.cleanupTimeout)
+	defer cancel()
+
+	for _, part := range c.temporary {
+		if err := c.bucketWriter.deleteGeneration(ctx, c.bucket, part.name, part.generation); err != nil && !errors.Is(err, storage.ErrObjectNotExist) {
+			c.log.WithError(err).WithField("key", part.name).Warn("Error deleting temporary object of a parallel upload")
+		}
+	}
+}
+
+func (c *compositeWriter) Attrs() *storage.ObjectAttrs {
+	return c.attrs
+}
@@ -0,0 +1,200 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	velerotest "github.com/vmware-tanzu/velero/pkg/test"
+)
+
+func TestParseParallelUploadConfig(t *testing.T) {
+	tests := []struct {
+		name           string
+		config         map[string]string
+		expectedConfig parallelUploadConfig
+		expectedError  string
+	}{
+		{
+			name:   "disabled by default",
+			config: map[string]string{},
+			expectedConfig: parallelUploadConfig{
+				partSize:    defaultParallelUploadPartSize,
+				concurrency: defaultParallelUploadConcurrency,
+				maxMemory:   5 * defaultParallelUploadPartSize,
+			},
+		},
+		{
+			name: "all settings",
+			config: map[string]string{
+				parallelUploadThresholdConfigKey:   "100Mi",
+				parallelUploadPartSizeConfigKey:    "8Mi",
+				parallelUploadConcurrencyConfigKey: "8",
+				parallelUploadMaxMemoryConfigKey:   "1Gi",
+			},
+			expectedConfig: parallelUploadConfig{
+				threshold:   100 << 20,
+				partSize:    8 << 20,
+				concurrency: 8,
+				maxMemory:   1 << 30,
+			},
+		},
+		{
+			name:   "memory defaults to cover the threshold",
+			config: map[string]string{parallelUploadThresholdConfigKey: "1Gi"},
+			expectedConfig: parallelUploadConfig{
+				threshold:   1 << 30,
+				partSize:    defaultParallelUploadPartSize,
+				concurrency: defaultParallelUploadConcurrency,
+				maxMemory:   1<<30 + defaultParallelUploadPartSize,
+			},
+		},
+		{
+			name:          "invalid size",
+			config:        map[string]string{parallelUploadPartSizeConfigKey: "big"},
+			expectedError: "invalid value for parallelUploadPartSize: quantities must match the regular expression '^([+-]?[0-9.]+)([eEinumkKMGTP]*[-+]?[0-9]*)$'",
+		},
+		{
+			name:          "invalid concurrency",
+			config:        map[string]string{parallelUploadConcurrencyConfigKey: "0"},
+			expectedError: "invalid value for parallelUploadConcurrency: must be at least 1",
+		},
+		{
+			name: "memory below threshold",
+			config: map[string]string{
+				parallelUploadThresholdConfigKey: "1Gi",
+				parallelUploadMaxMemoryConfigKey: "512Mi",
+			},
+			expectedError: "parallelUploadMaxMemory must be at least parallelUploadThreshold plus parallelUploadPartSize",
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			config, err := parseParallelUploadConfig(tc.config)
+			if tc.expectedError != "" {
+				assert.EqualError(t, err, tc.expectedError)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tc.expectedConfig, config)
+		})
+	}
+}
+
+func randomData(t *testing.T, size int) []byte {
+	t.Helper()
+	data := make([]byte, size)
+	_, err := rand.Read(data)
+	require.NoError(t, err)
+	return data
+}
+
+func newTestCompositeWriter(ctx context.Context, bucket *memoryBucket, config parallelUploadConfig) *compositeWriter {
+	return newCompositeWriter(ctx, velerotest.NewLogger(), bucket, "bucket", "backups/b1/b1.tar.gz", ".velero-staging/", "0123456789abcdef", writeOptions{}, config, time.Minute)
+}
+
+func TestCompositeWriter(t *testing.T) {
+	config := parallelUploadConfig{threshold: 1000, partSize: 100, concurrency: 3, maxMemory: 1100}
+
+	tests := []struct {
+		name             string
+		size             int
+		expectedComposes int
+	}{
+		{name: "under the threshold is uploaded as is", size: 1000},
+		{name: "composed in one request", size: 1001, expectedComposes: 1},
+		{name: "composed recursively", size: 100*maxComposeSources*2 + 50, expectedComposes: 4},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			bucket := newMemoryBucket()
+			data := randomData(t, tc.size)
+
+			w := newTestCompositeWriter(context.Background(), bucket, config)
+			_, err := io.Copy(w, bytes.NewReader(data))
+			require.NoError(t, err)
+			require.NoError(t, w.Close())
+
+			assert.Equal(t, []string{"backups/b1/b1.tar.gz"}, bucket.keys())
+			assert.True(t, bytes.Equal(data, bucket.data("backups/b1/b1.tar.gz")))
+			assert.Len(t, bucket.composed, tc.expectedComposes)
+			require.NotNil(t, w.Attrs())
+			assert.Equal(t, int64(tc.size), w.Attrs().Size)
+		})
+	}
+}
+
+func TestCompositeWriterCleansUpOnFailure(t *testing.T) {
+	bucket := newMemoryBucket()
+	bucket.failKeys = func(key string) bool { return strings.HasSuffix(key, "part-00007") }
+
+	w := newTestCompositeWriter(context.Background(), bucket, parallelUploadConfig{threshold: 100, partSize: 100, concurrency: 2, maxMemory: 300})
+	_, writeErr := io.Copy(w, bytes.NewReader(randomData(t, 2000)))
+	closeErr := w.Close()
+	if writeErr == nil {
+		writeErr = closeErr
+	}
+	assert.ErrorContains(t, writeErr, "error uploading part 7 of backups/b1/b1.tar.gz: upload failed")
+	assert.Error(t, closeErr)
+	assert.Empty(t, bucket.keys())
+}
+
+func TestCompositeWriterAbort(t *testing.T) {
+	bucket := newMemoryBucket()
+	ctx, cancel := context.WithCancel(context.Background())
+
+	w := newTestCompositeWriter(ctx, bucket, parallelUploadConfig{threshold: 100, partSize: 100, concurrency: 2, maxMemory: 300})
+	_, err := w.Write(randomData(t, 1000))
+	require.NoError(t, err)
+	cancel()
+	assert.ErrorIs(t, w.Close(), context.Canceled)
+	assert.Empty(t, bucket.keys())
+}
+
+func TestPutObjectParallelUpload(t *testing.T) {
+	bucket := newMemoryBucket()
+	o := newObjectStore(velerotest.NewLogger())
+	o.bucketWriter = bucket
+	o.parallelUploads = parallelUploadConfig{threshold: 1 << 20, partSize: 256 << 10, concurrency: 4, maxMemory: 2 << 20}
+	o.staging = stagingConfig{prefix: "cluster-a/.velero-staging/"}
+	o.objectMetadata = map[string]string{"cluster": "prod-east"}
+
+	data := randomData(t, checksumBufferSize+(4<<20))
+	require.NoError(t, o.PutObject("bucket", "backups/b1/b1.tar.gz", bytes.NewReader(data)))
+
+	assert.Equal(t, []string{"backups/b1/b1.tar.gz"}, bucket.keys())
+	assert.True(t, bytes.Equal(data, bucket.data("backups/b1/b1.tar.gz")))
+	attrs, err := bucket.getAttrs(context.Background(), "bucket", "backups/b1/b1.tar.gz")
+	require.NoError(t, err)
+	assert.Equal(t, "prod-east", attrs.Metadata["cluster"])
+	assert.NotEmpty(t, bucket.composed)
+	// Parts are written to the staging directory, which listings skip and sweeps clean up.
+	for _, sources := range bucket.composed {
+		for _, source := range sources {
+			assert.True(t, o.isHidden(source), source)
+		}
+	}
+}
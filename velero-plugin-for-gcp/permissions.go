@@ -0,0 +1,139 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+	"google.golang.org/api/cloudresourcemanager/v1"
+	"google.golang.org/api/iam/v1"
+	"google.golang.org/api/option"
+)
+
+const skipPermissionCheckConfigKey = "skipPermissionCheck"
+
+// Permissions the object store needs on the BSL bucket.
+var objectStorePermissions = []string{
+	"storage.objects.create",
+	"storage.objects.delete",
+	"storage.objects.get",
+	"storage.objects.list",
+}
+
+// Permission needed on the signing service account when signed URLs are created
+// through the IAM credentials API.
+const signBlobPermission = "iam.serviceAccounts.signBlob"
+
+// Permissions the volume snapshotter needs on the project holding the volumes.
+var volumeProjectPermissions = []string{
+	"compute.disks.create",
+	"compute.disks.createSnapshot",
+	"compute.disks.get",
+	"compute.projects.get",
+	"compute.zones.get",
+}
+
+// Permissions the volume snapshotter needs on the project holding the snapshots.
+var snapshotProjectPermissions = []string{
+	"compute.snapshots.create",
+	"compute.snapshots.delete",
+	"compute.snapshots.get",
+	"compute.snapshots.useReadOnly",
+}
+
+// missingPermissionsError is returned by the Init preflight checks when the
+// identity in use lacks permissions the plugin needs.
+type missingPermissionsError struct {
+	resource string
+	missing  []string
+}
+
+func (e *missingPermissionsError) Error() string {
+	return fmt.Sprintf("missing permissions on %s: %s (set %s=true in the location's config to skip this check)",
+		e.resource, strings.Join(e.missing, ", "), skipPermissionCheckConfigKey)
+}
+
+// checkGrantedPermissions returns a *missingPermissionsError listing every permission in
+// required that is not in granted, or nil if all of them were granted.
+func checkGrantedPermissions(resource string, required, granted []string) error {
+	grantedSet := make(map[string]bool, len(granted))
+	for _, p := range granted {
+		grantedSet[p] = true
+	}
+
+	var missing []string
+	for _, p := range required {
+		if !grantedSet[p] {
+			missing = append(missing, p)
+		}
+	}
+	if len(missing) > 0 {
+		return &missingPermissionsError{resource: resource, missing: missing}
+	}
+	return nil
+}
+
+// permissionCheckEnabled returns whether the Init preflight permission checks should run.
+// They are on unless the location's config opts out.
+func permissionCheckEnabled(config map[string]string) (bool, error) {
+	value, ok := config[skipPermissionCheckConfigKey]
+	if !ok {
+		return true, nil
+	}
+	skip, err := strconv.ParseBool(value)
+	if err != nil {
+		return false, errors.Wrapf(err, "invalid value for %s", skipPermissionCheckConfigKey)
+	}
+	return !skip, nil
+}
+
+// checkSignBlobPermission verifies that the caller may sign blobs as the given service account,
+// which is what SignBytes does when no private key is available.
+func checkSignBlobPermission(ctx context.Context, serviceAccount string, clientOptions ...option.ClientOption) error {
+	svc, err := iam.NewService(ctx, clientOptions...)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	resp, err := svc.Projects.ServiceAccounts.TestIamPermissions(serviceAccountResourceName(serviceAccount), &iam.TestIamPermissionsRequest{
+		Permissions: []string{signBlobPermission},
+	}).Context(ctx).Do()
+	if err != nil {
+		return wrapErrorf(err, "error checking permissions on service account %s", serviceAccount)
+	}
+	return checkGrantedPermissions("service account "+serviceAccount, []string{signBlobPermission}, resp.Permissions)
+}
+
+// checkProjectPermissions verifies that the caller holds the required permissions on the project.
+func checkProjectPermissions(ctx context.Context, project string, required []string, clientOptions ...option.ClientOption) error {
+	svc, err := cloudresourcemanager.NewService(ctx, clientOptions...)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	resp, err := svc.Projects.TestIamPermissions(project, &cloudresourcemanager.TestIamPermissionsRequest{
+		Permissions: required,
+	}).Context(ctx).Do()
+	if err != nil {
+		return wrapErrorf(err, "error checking permissions on project %s", project)
+	}
+	return checkGrantedPermissions("project "+project, required, resp.Permissions)
+}
@@ -0,0 +1,135 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	logtest "github.com/sirupsen/logrus/hooks/test"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	velerotest "github.com/vmware-tanzu/velero/pkg/test"
+	"google.golang.org/api/iamcredentials/v1"
+	"google.golang.org/api/option"
+)
+
+func TestPermissionCheckEnabled(t *testing.T) {
+	enabled, err := permissionCheckEnabled(map[string]string{})
+	require.NoError(t, err)
+	assert.True(t, enabled)
+
+	enabled, err = permissionCheckEnabled(map[string]string{skipPermissionCheckConfigKey: "true"})
+	require.NoError(t, err)
+	assert.False(t, enabled)
+
+	_, err = permissionCheckEnabled(map[string]string{skipPermissionCheckConfigKey: "maybe"})
+	assert.Error(t, err)
+}
+
+func TestObjectStoreCheckPermissions(t *testing.T) {
+	tests := []struct {
+		name          string
+		retention     retentionConfig
+		granted       []string
+		testErr       error
+		expectedError string
+	}{
+		{
+			name:    "all permissions granted",
+			granted: objectStorePermissions,
+		},
+		{
+			name:          "object retention needs setRetention",
+			retention:     retentionConfig{mode: "Locked", duration: time.Hour},
+			granted:       objectStorePermissions,
+			expectedError: "missing permissions on bucket b: storage.objects.setRetention (set skipPermissionCheck=true in the location's config to skip this check)",
+		},
+		{
+			name:          "holds need update",
+			retention:     retentionConfig{eventBasedHold: true},
+			granted:       objectStorePermissions,
+			expectedError: "missing permissions on bucket b: storage.objects.update (set skipPermissionCheck=true in the location's config to skip this check)",
+		},
+		{
+			name:      "retention and holds granted",
+			retention: retentionConfig{mode: "Unlocked", duration: time.Hour, temporaryHold: true},
+			granted:   append([]string{"storage.objects.setRetention", "storage.objects.update"}, objectStorePermissions...),
+		},
+		{
+			name:          "missing permissions are listed",
+			granted:       []string{"storage.objects.get", "storage.objects.list"},
+			expectedError: "missing permissions on bucket b: storage.objects.create, storage.objects.delete (set skipPermissionCheck=true in the location's config to skip this check)",
+		},
+		{
+			name:          "errors testing permissions are returned",
+			testErr:       errors.New("bad"),
+			expectedError: "error checking permissions on bucket b: bad",
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			o := newObjectStore(velerotest.NewLogger())
+			w := newFakeWriter(nil)
+			w.grantedPermissions = tc.granted
+			w.permissionsErr = tc.testErr
+			o.bucketWriter = w
+
+			err := o.checkPermissions("b", tc.retention)
+			if tc.expectedError != "" {
+				assert.EqualError(t, err, tc.expectedError)
+				return
+			}
+			assert.NoError(t, err)
+		})
+	}
+}
+
+func TestObjectStoreCheckPermissionsWithoutSignBlob(t *testing.T) {
+	// The IAM API grants none of the permissions tested.
+	var resource string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		resource = r.URL.Path
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{}`))
+	}))
+	defer srv.Close()
+
+	logger, hook := logtest.NewNullLogger()
+	o := newObjectStore(logger)
+	w := newFakeWriter(nil)
+	w.grantedPermissions = objectStorePermissions
+	o.bucketWriter = w
+	o.googleAccessID = "velero@project.iam.gserviceaccount.com"
+	o.iamClientOptions = []option.ClientOption{option.WithEndpoint(srv.URL), option.WithoutAuthentication()}
+	var err error
+	o.iamSvc, err = iamcredentials.NewService(context.Background(), o.iamClientOptions...)
+	require.NoError(t, err)
+
+	// Locations that never serve download requests stay available.
+	require.NoError(t, o.checkPermissions("b", retentionConfig{}))
+	assert.Equal(t, "/v1/projects/-/serviceAccounts/velero@project.iam.gserviceaccount.com:testIamPermissions", resource)
+	entry := hook.LastEntry()
+	require.NotNil(t, entry)
+	assert.Equal(t, logrus.WarnLevel, entry.Level)
+	assert.Contains(t, entry.Data[logrus.ErrorKey].(error).Error(), "missing permissions on service account velero@project.iam.gserviceaccount.com: iam.serviceAccounts.signBlob")
+}
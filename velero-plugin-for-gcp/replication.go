@@ -0,0 +1,189 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"io"
+	"net/http"
+
+	"cloud.google.com/go/storage"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"google.golang.org/api/googleapi"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	secondaryBucketConfigKey          = "secondaryBucket"
+	secondaryCredentialsFileConfigKey = "secondaryCredentialsFile"
+	secondaryStoreEndpointConfigKey   = "secondaryStoreEndpoint"
+)
+
+// replication mirrors the writes to the bucket to a secondary bucket, which reads fall
+// back to when the primary bucket is unavailable. Writes are mirrored synchronously, since
+// the plugin process can exit as soon as an operation returns, but on a best-effort basis:
+// a write the secondary bucket misses is logged as divergence rather than failing the
+// write to the primary bucket, which has committed it already.
+type replication struct {
+	log    logrus.FieldLogger
+	bucket string
+	// secondary is the object store of the secondary bucket.
+	secondary *ObjectStore
+}
+
+// newReplication sets up replication to the secondary bucket named in the BSL config, if
+// any. The secondary object store is configured as the primary one, except for its
+// bucket and, optionally, its credentials and endpoint.
+func newReplication(log logrus.FieldLogger, config map[string]string) (*replication, error) {
+	bucket, ok := config[secondaryBucketConfigKey]
+	if !ok {
+		return nil, nil
+	}
+
+	r := &replication{
+		log:    log.WithField("secondaryBucket", bucket),
+		bucket: bucket,
+	}
+
+	secondaryConfig := map[string]string{}
+	for k, v := range config {
+		switch k {
+		case secondaryBucketConfigKey, secondaryCredentialsFileConfigKey, secondaryStoreEndpointConfigKey:
+		default:
+			secondaryConfig[k] = v
+		}
+	}
+	secondaryConfig["bucket"] = bucket
+	if credentialsFile, ok := config[secondaryCredentialsFileConfigKey]; ok {
+		delete(secondaryConfig, credentialsBase64ConfigKey)
+		delete(secondaryConfig, credentialsSecretVersionConfigKey)
+		secondaryConfig[credentialsFileConfigKey] = credentialsFile
+	}
+	if endpoint, ok := config[secondaryStoreEndpointConfigKey]; ok {
+		secondaryConfig[storeEndpointConfigKey] = endpoint
+	}
+
+	r.secondary = newObjectStore(r.log)
+	if err := r.secondary.Init(secondaryConfig); err != nil {
+		return nil, errors.WithMessagef(err, "error initializing secondary bucket %s", bucket)
+	}
+	return r, nil
+}
+
+// close stops the sweeps of the secondary bucket and releases its clients, once the
+// object store is initialized again.
+func (r *replication) close() {
+	if r == nil {
+		return
+	}
+	// The reloader closes the clients it hands out once they are unused.
+	reloading := r.secondary.reload != nil
+	r.secondary.stop()
+	if reloading || r.secondary.client == nil {
+		return
+	}
+	if err := r.secondary.client.Close(); err != nil {
+		r.log.WithError(err).Debug("Error closing the client of the secondary bucket")
+	}
+}
+
+// put uploads an object to the primary bucket with upload, and mirrors it to the
+// secondary bucket. The body is streamed to both buckets at once.
+func (r *replication) put(key string, body io.Reader, upload func(io.Reader) error) error {
+	pr, pw := io.Pipe()
+	secondaryErr := make(chan error, 1)
+	go func() {
+		err := r.secondary.PutObject(r.bucket, key, pr)
+		// Unblock the primary upload if the secondary one stopped reading.
+		pr.CloseWithError(err)
+		secondaryErr <- err
+	}()
+
+	// Closing the pipe with an error aborts the secondary upload, so it is only committed
+	// once the primary one is.
+	err := upload(io.TeeReader(body, &mirrorWriter{w: pw}))
+	if err != nil {
+		pw.CloseWithError(err)
+	} else {
+		pw.Close()
+	}
+	if err2 := <-secondaryErr; err == nil && err2 != nil {
+		r.diverged(key, "upload", err2)
+	}
+	return err
+}
+
+// delete mirrors the deletion of an object from the primary bucket.
+func (r *replication) delete(key string) {
+	// The object may never have been replicated.
+	if err := r.secondary.DeleteObject(r.bucket, key); err != nil && !errors.Is(err, storage.ErrObjectNotExist) {
+		r.diverged(key, "deletion", err)
+	}
+}
+
+// diverged logs a write that the secondary bucket is missing.
+func (r *replication) diverged(key, operation string, err error) {
+	r.log.WithError(err).WithFields(logrus.Fields{"key": key, "operation": operation}).Error("Secondary bucket diverged from the primary bucket")
+}
+
+// failover returns whether a read that failed with err should be retried on the secondary
+// bucket, which is when the primary bucket is unavailable or timed out.
+func (r *replication) failover(err error, operation, key string) bool {
+	if r == nil || err == nil || !isUnavailable(err) {
+		return false
+	}
+	r.log.WithError(err).WithFields(logrus.Fields{"key": key, "operation": operation}).Warn("Primary bucket unavailable, reading from the secondary bucket")
+	return true
+}
+
+// isUnavailable returns whether err is a server error or a timeout.
+func isUnavailable(err error) bool {
+	if errors.Is(err, context.DeadlineExceeded) {
+		return true
+	}
+	var gErr *googleapi.Error
+	if errors.As(err, &gErr) {
+		return gErr.Code >= http.StatusInternalServerError
+	}
+	st, ok := status.FromError(err)
+	if !ok {
+		return false
+	}
+	switch st.Code() {
+	case codes.Unavailable, codes.Internal, codes.DeadlineExceeded:
+		return true
+	}
+	return false
+}
+
+// mirrorWriter copies the data read by the primary upload to the secondary one, and
+// stops when the secondary upload fails, so that the primary upload carries on.
+type mirrorWriter struct {
+	w      io.Writer
+	failed bool
+}
+
+func (m *mirrorWriter) Write(p []byte) (int, error) {
+	if !m.failed {
+		if _, err := m.w.Write(p); err != nil {
+			m.failed = true
+		}
+	}
+	return len(p), nil
+}
@@ -0,0 +1,226 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"path/filepath"
+	"testing"
+
+	"cloud.google.com/go/storage"
+	"github.com/sirupsen/logrus"
+	logtest "github.com/sirupsen/logrus/hooks/test"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	velerotest "github.com/vmware-tanzu/velero/pkg/test"
+	"google.golang.org/api/googleapi"
+)
+
+// newTestReplication returns a primary object store replicating to a secondary one, each
+// writing to its own memory bucket.
+func newTestReplication(log logrus.FieldLogger) (primary, secondary *ObjectStore, primaryBucket, secondaryBucket *memoryBucket) {
+	primaryBucket, secondaryBucket = newMemoryBucket(), newMemoryBucket()
+	primary = newObjectStore(log)
+	primary.bucketWriter = primaryBucket
+	secondary = newObjectStore(log)
+	secondary.bucketWriter = secondaryBucket
+	primary.replication = &replication{log: log, bucket: "secondary", secondary: secondary}
+	return primary, secondary, primaryBucket, secondaryBucket
+}
+
+func TestPutObjectReplicatesSynchronously(t *testing.T) {
+	tests := []struct {
+		name              string
+		failPrimary       bool
+		failSecondary     bool
+		expectedError     string
+		expectedPrimary   []string
+		expectedSecondary []string
+	}{
+		{
+			name:              "both buckets are written",
+			expectedPrimary:   []string{"backups/b1/b1.tar.gz"},
+			expectedSecondary: []string{"backups/b1/b1.tar.gz"},
+		},
+		{
+			name:            "secondary failures don't fail the upload",
+			failSecondary:   true,
+			expectedPrimary: []string{"backups/b1/b1.tar.gz"},
+		},
+		{
+			name:          "primary failures abort the secondary upload",
+			failPrimary:   true,
+			expectedError: "upload failed",
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			primary, _, primaryBucket, secondaryBucket := newTestReplication(velerotest.NewLogger())
+			primaryBucket.failKeys = func(string) bool { return tc.failPrimary }
+			secondaryBucket.failKeys = func(string) bool { return tc.failSecondary }
+
+			data := randomData(t, checksumBufferSize+1000)
+			err := primary.PutObject("bucket", "backups/b1/b1.tar.gz", bytes.NewReader(data))
+			if tc.expectedError != "" {
+				assert.EqualError(t, err, tc.expectedError)
+			} else {
+				require.NoError(t, err)
+			}
+
+			assert.Equal(t, tc.expectedPrimary, primaryBucket.keys())
+			assert.Equal(t, tc.expectedSecondary, secondaryBucket.keys())
+			for _, key := range tc.expectedSecondary {
+				assert.True(t, bytes.Equal(data, secondaryBucket.data(key)))
+			}
+		})
+	}
+}
+
+func TestReplicationLogsDivergence(t *testing.T) {
+	tests := []struct {
+		name      string
+		operation string
+		write     func(o *ObjectStore) error
+	}{
+		{
+			name:      "upload",
+			operation: "upload",
+			write: func(o *ObjectStore) error {
+				return o.PutObject("bucket", "backups/b1/b1.tar.gz", bytes.NewReader([]byte("new backup contents")))
+			},
+		},
+		{
+			name:      "deletion",
+			operation: "deletion",
+			write: func(o *ObjectStore) error {
+				return o.DeleteObject("bucket", "backups/b1/b1.tar.gz")
+			},
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			logger, hook := logtest.NewNullLogger()
+			primary, secondary, _, secondaryBucket := newTestReplication(logger)
+			// Deletions go through the memory buckets when they are conditional.
+			primary.retry.conditionalWrites = true
+			secondary.retry.conditionalWrites = true
+			require.NoError(t, primary.PutObject("bucket", "backups/b1/b1.tar.gz", bytes.NewReader([]byte("backup contents"))))
+			secondaryBucket.failKeys = func(string) bool { return true }
+
+			require.NoError(t, tc.write(primary))
+			assert.Equal(t, []string{"backups/b1/b1.tar.gz"}, secondaryBucket.keys())
+			assert.Equal(t, []byte("backup contents"), secondaryBucket.data("backups/b1/b1.tar.gz"))
+
+			entry := hook.LastEntry()
+			require.NotNil(t, entry)
+			assert.Equal(t, logrus.ErrorLevel, entry.Level)
+			assert.Equal(t, "Secondary bucket diverged from the primary bucket", entry.Message)
+			assert.Equal(t, "backups/b1/b1.tar.gz", entry.Data["key"])
+			assert.Equal(t, tc.operation, entry.Data["operation"])
+		})
+	}
+}
+
+func TestInitReplacesReplication(t *testing.T) {
+	credentialsFile := writeTestCredentials(t, string(serviceAccountKeyJSON(t, "velero@project.iam.gserviceaccount.com", "https://oauth2.googleapis.com/token")))
+	o := newObjectStore(velerotest.NewLogger())
+	config := map[string]string{
+		credentialsFileConfigKey:     credentialsFile,
+		skipPermissionCheckConfigKey: "true",
+		secondaryBucketConfigKey:     "secondary",
+	}
+	require.NoError(t, o.Init(config))
+	require.NotNil(t, o.replication)
+	previous := o.replication
+
+	require.NoError(t, o.Init(config))
+	assert.NotSame(t, previous, o.replication)
+
+	delete(config, secondaryBucketConfigKey)
+	require.NoError(t, o.Init(config))
+	assert.Nil(t, o.replication)
+}
+
+func TestInitStopsWhenReplicationFails(t *testing.T) {
+	credentialsFile := writeTestCredentials(t, string(serviceAccountKeyJSON(t, "velero@project.iam.gserviceaccount.com", "https://oauth2.googleapis.com/token")))
+	o := newObjectStore(velerotest.NewLogger())
+	err := o.Init(map[string]string{
+		credentialsFileConfigKey:          credentialsFile,
+		skipPermissionCheckConfigKey:      "true",
+		secondaryBucketConfigKey:          "secondary",
+		secondaryCredentialsFileConfigKey: filepath.Join(t.TempDir(), "missing"),
+	})
+	assert.ErrorContains(t, err, "error initializing secondary bucket secondary")
+	// The reloading and sweeps started for the primary bucket are stopped.
+	assert.Nil(t, o.reload)
+	assert.Nil(t, o.stopSweeps)
+	assert.Nil(t, o.replication)
+}
+
+func TestDeleteObjectReplicates(t *testing.T) {
+	primary, secondary, _, _ := newTestReplication(velerotest.NewLogger())
+	primaryObjects := map[string]fakeObject{"backups/b1/b1.tar.gz": {data: []byte("backup contents")}}
+	secondaryObjects := map[string]fakeObject{"backups/b1/b1.tar.gz": {data: []byte("backup contents")}}
+	primary.client = newFakeGCSServer(t, primaryObjects)
+	secondary.client = newFakeGCSServer(t, secondaryObjects)
+	primary.replication.bucket = "bucket"
+
+	require.NoError(t, primary.DeleteObject("bucket", "backups/b1/b1.tar.gz"))
+	assert.Empty(t, primaryObjects)
+	assert.Empty(t, secondaryObjects)
+}
+
+func TestReadsFailOverToSecondary(t *testing.T) {
+	primary, secondary, _, _ := newTestReplication(velerotest.NewLogger())
+	primary.client = newFakeGCSServer(t, map[string]fakeObject{
+		"backups/b1/b1.tar.gz": {status: http.StatusServiceUnavailable},
+	})
+	primary.client.SetRetry(storage.WithPolicy(storage.RetryNever))
+	primary.bucketWriter = &writer{client: primary.client}
+	secondary.client = newFakeGCSServer(t, map[string]fakeObject{
+		"backups/b1/b1.tar.gz": {data: []byte("backup contents")},
+	})
+	secondary.bucketWriter = &writer{client: secondary.client}
+	primary.replication.bucket = "bucket"
+
+	r, err := primary.GetObject("bucket", "backups/b1/b1.tar.gz")
+	require.NoError(t, err)
+	data, err := io.ReadAll(r)
+	require.NoError(t, err)
+	require.NoError(t, r.Close())
+	assert.Equal(t, "backup contents", string(data))
+
+	exists, err := primary.ObjectExists("bucket", "backups/b1/b1.tar.gz")
+	require.NoError(t, err)
+	assert.True(t, exists)
+
+	// Missing objects aren't looked for in the secondary bucket.
+	exists, err = primary.ObjectExists("bucket", "backups/b2/b2.tar.gz")
+	require.NoError(t, err)
+	assert.False(t, exists)
+}
+
+func TestIsUnavailable(t *testing.T) {
+	assert.True(t, isUnavailable(&googleapi.Error{Code: http.StatusServiceUnavailable}))
+	assert.True(t, isUnavailable(context.DeadlineExceeded))
+	assert.False(t, isUnavailable(&googleapi.Error{Code: http.StatusForbidden}))
+	assert.False(t, isUnavailable(storage.ErrObjectNotExist))
+}
@@ -0,0 +1,209 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/storage"
+	"github.com/pkg/errors"
+)
+
+const (
+	objectRetentionModeConfigKey     = "objectRetentionMode"
+	objectRetentionDurationConfigKey = "objectRetentionDuration"
+	objectHoldConfigKey              = "objectHold"
+	bucketRetentionPolicyConfigKey   = "bucketRetentionPolicy"
+)
+
+// retentionConfig describes the retention applied to the objects the object store uploads,
+// so that backups can't be deleted or overwritten with the BSL's credentials.
+type retentionConfig struct {
+	// mode is the object retention mode, "Unlocked" or "Locked", or "" for none.
+	mode     string
+	duration time.Duration
+
+	temporaryHold  bool
+	eventBasedHold bool
+
+	// bucketPolicy is "required" if the bucket must have a retention policy, "locked" if
+	// that policy must also be locked with Bucket Lock, or "" if it isn't checked.
+	bucketPolicy string
+
+	// rewritten are the keys Velero uploads again, which are exempt from retention and
+	// holds since Cloud Storage refuses to replace a retained or held object.
+	rewritten writeOnceConfig
+}
+
+// parseRetentionConfig reads the retention settings from the BSL config.
+func parseRetentionConfig(config map[string]string) (retentionConfig, error) {
+	var c retentionConfig
+
+	switch strings.ToLower(config[objectRetentionModeConfigKey]) {
+	case "":
+	case "unlocked":
+		c.mode = "Unlocked"
+	case "locked":
+		c.mode = "Locked"
+	default:
+		return c, errors.Errorf("unsupported %s %q, must be Unlocked or Locked", objectRetentionModeConfigKey, config[objectRetentionModeConfigKey])
+	}
+
+	if value, ok := config[objectRetentionDurationConfigKey]; ok {
+		d, err := parseRetentionDuration(value)
+		if err != nil {
+			return c, errors.Wrapf(err, "invalid value for %s", objectRetentionDurationConfigKey)
+		}
+		c.duration = d
+	}
+	if (c.mode == "") != (c.duration == 0) {
+		return c, errors.Errorf("%s and %s must be set together", objectRetentionModeConfigKey, objectRetentionDurationConfigKey)
+	}
+
+	switch strings.ToLower(config[objectHoldConfigKey]) {
+	case "":
+	case "temporary":
+		c.temporaryHold = true
+	case "eventbased":
+		c.eventBasedHold = true
+	default:
+		return c, errors.Errorf("unsupported %s %q, must be temporary or eventBased", objectHoldConfigKey, config[objectHoldConfigKey])
+	}
+
+	switch strings.ToLower(config[bucketRetentionPolicyConfigKey]) {
+	case "":
+	case "required":
+		c.bucketPolicy = "required"
+	case "locked":
+		c.bucketPolicy = "locked"
+	default:
+		return c, errors.Errorf("unsupported %s %q, must be required or locked", bucketRetentionPolicyConfigKey, config[bucketRetentionPolicyConfigKey])
+	}
+
+	return c, nil
+}
+
+// parseRetentionDuration parses a Go duration, or a number of days such as "30d".
+func parseRetentionDuration(value string) (time.Duration, error) {
+	var d time.Duration
+	if days, ok := strings.CutSuffix(value, "d"); ok {
+		n, err := strconv.Atoi(days)
+		if err != nil {
+			return 0, errors.WithStack(err)
+		}
+		d = time.Duration(n) * 24 * time.Hour
+	} else {
+		var err error
+		if d, err = time.ParseDuration(value); err != nil {
+			return 0, errors.WithStack(err)
+		}
+	}
+	if d <= 0 {
+		return 0, errors.Errorf("%s must be positive", value)
+	}
+	return d, nil
+}
+
+// enabled reports whether any retention is applied to uploaded objects.
+func (c retentionConfig) enabled() bool {
+	return c.mode != "" || c.temporaryHold || c.eventBasedHold
+}
+
+// permissions returns the permissions needed, besides objectStorePermissions, to upload
+// objects with the configured retention and holds.
+func (c retentionConfig) permissions() []string {
+	var permissions []string
+	if c.mode != "" {
+		permissions = append(permissions, "storage.objects.setRetention")
+	}
+	if c.temporaryHold || c.eventBasedHold {
+		permissions = append(permissions, "storage.objects.update")
+	}
+	return permissions
+}
+
+// apply sets the configured retention and holds on the attributes of an object being
+// uploaded at now, unless Velero rewrites its key.
+func (c retentionConfig) apply(attrs *storage.ObjectAttrs, key string, now time.Time) {
+	if c.rewritten.isMutable(key) {
+		return
+	}
+	if c.mode != "" {
+		attrs.Retention = &storage.ObjectRetention{
+			Mode:        c.mode,
+			RetainUntil: now.Add(c.duration),
+		}
+	}
+	attrs.TemporaryHold = c.temporaryHold
+	attrs.EventBasedHold = c.eventBasedHold
+}
+
+// verifyBucket checks that the bucket supports the configured retention.
+func (c retentionConfig) verifyBucket(bucket string, attrs *storage.BucketAttrs) error {
+	if c.mode != "" && attrs.ObjectRetentionMode != "Enabled" {
+		return errors.Errorf("%s is set but object retention is not enabled on bucket %s", objectRetentionModeConfigKey, bucket)
+	}
+
+	switch c.bucketPolicy {
+	case "required":
+		if attrs.RetentionPolicy == nil {
+			return errors.Errorf("bucket %s has no retention policy", bucket)
+		}
+	case "locked":
+		if attrs.RetentionPolicy == nil || !attrs.RetentionPolicy.IsLocked {
+			return errors.Errorf("bucket %s has no retention policy locked with Bucket Lock", bucket)
+		}
+	}
+	return nil
+}
+
+// retainedObjectError is returned when an object can't be deleted because it is retained.
+type retainedObjectError struct {
+	key    string
+	reason string
+	err    error
+}
+
+func (e *retainedObjectError) Error() string {
+	return fmt.Sprintf("object %s cannot be deleted: %s: %v", e.key, e.reason, e.err)
+}
+
+func (e *retainedObjectError) Unwrap() error {
+	return e.err
+}
+
+// retentionError explains why an object with the given attributes failed to be deleted
+// at now with err, or returns nil if the object isn't retained.
+func retentionError(key string, attrs *storage.ObjectAttrs, now time.Time, err error) error {
+	var reason string
+	switch {
+	case attrs.Retention != nil && attrs.Retention.RetainUntil.After(now):
+		reason = fmt.Sprintf("retained until %s (%s object retention)", attrs.Retention.RetainUntil.UTC().Format(time.RFC3339), attrs.Retention.Mode)
+	case attrs.RetentionExpirationTime.After(now):
+		reason = fmt.Sprintf("retained until %s by the bucket's retention policy", attrs.RetentionExpirationTime.UTC().Format(time.RFC3339))
+	case attrs.TemporaryHold:
+		reason = "a temporary hold is set on it"
+	case attrs.EventBasedHold:
+		reason = "an event-based hold is set on it"
+	default:
+		return nil
+	}
+	return &retainedObjectError{key: key, reason: reason, err: err}
+}
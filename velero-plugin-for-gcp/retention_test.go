@@ -0,0 +1,215 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/storage"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	velerotest "github.com/vmware-tanzu/velero/pkg/test"
+)
+
+func TestParseRetentionConfig(t *testing.T) {
+	tests := []struct {
+		name          string
+		config        map[string]string
+		expected      retentionConfig
+		expectedError string
+	}{
+		{
+			name:   "no retention",
+			config: map[string]string{},
+		},
+		{
+			name: "locked retention in days with an event-based hold",
+			config: map[string]string{
+				objectRetentionModeConfigKey:     "locked",
+				objectRetentionDurationConfigKey: "30d",
+				objectHoldConfigKey:              "eventBased",
+				bucketRetentionPolicyConfigKey:   "Locked",
+			},
+			expected: retentionConfig{
+				mode:           "Locked",
+				duration:       30 * 24 * time.Hour,
+				eventBasedHold: true,
+				bucketPolicy:   "locked",
+			},
+		},
+		{
+			name: "unlocked retention as a duration",
+			config: map[string]string{
+				objectRetentionModeConfigKey:     "Unlocked",
+				objectRetentionDurationConfigKey: "720h",
+			},
+			expected: retentionConfig{mode: "Unlocked", duration: 720 * time.Hour},
+		},
+		{
+			name:          "mode without duration",
+			config:        map[string]string{objectRetentionModeConfigKey: "Locked"},
+			expectedError: "objectRetentionMode and objectRetentionDuration must be set together",
+		},
+		{
+			name: "negative duration",
+			config: map[string]string{
+				objectRetentionModeConfigKey:     "Locked",
+				objectRetentionDurationConfigKey: "-1d",
+			},
+			expectedError: "invalid value for objectRetentionDuration: -1d must be positive",
+		},
+		{
+			name:          "unknown hold",
+			config:        map[string]string{objectHoldConfigKey: "legal"},
+			expectedError: `unsupported objectHold "legal", must be temporary or eventBased`,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			c, err := parseRetentionConfig(tc.config)
+			if tc.expectedError != "" {
+				assert.EqualError(t, err, tc.expectedError)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tc.expected, c)
+		})
+	}
+}
+
+func TestRetentionApply(t *testing.T) {
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	c := retentionConfig{mode: "Locked", duration: 24 * time.Hour, temporaryHold: true}
+
+	var attrs storage.ObjectAttrs
+	c.apply(&attrs, "backups/b/b-logs.gz", now)
+	assert.Equal(t, &storage.ObjectRetention{Mode: "Locked", RetainUntil: now.Add(24 * time.Hour)}, attrs.Retention)
+	assert.True(t, attrs.TemporaryHold)
+	assert.False(t, attrs.EventBasedHold)
+}
+
+func TestRetentionApplyExemptsRewrittenKeys(t *testing.T) {
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	writeOnce, err := parseWriteOnceConfig(map[string]string{"prefix": "velero"})
+	require.NoError(t, err)
+	c := retentionConfig{mode: "Locked", duration: 24 * time.Hour, eventBasedHold: true, rewritten: writeOnce}
+
+	tests := []struct {
+		key      string
+		retained bool
+	}{
+		{key: "velero/backups/b/b-logs.gz", retained: true},
+		{key: "velero/backups/b/b-resource-list.json.gz", retained: true},
+		{key: "velero/backups/b/b-volumesnapshots.json.gz", retained: true},
+		{key: "velero/metadata/revision"},
+		{key: "velero/backups/b/velero-backup.json"},
+		{key: "velero/backups/b/b.tar.gz"},
+		{key: "velero/backups/b/b-itemoperations.json.gz"},
+		{key: "velero/restores/r/restore-r-results.gz"},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.key, func(t *testing.T) {
+			var attrs storage.ObjectAttrs
+			c.apply(&attrs, tc.key, now)
+			assert.Equal(t, tc.retained, attrs.Retention != nil)
+			assert.Equal(t, tc.retained, attrs.EventBasedHold)
+		})
+	}
+}
+
+func TestVerifyBucketRetention(t *testing.T) {
+	tests := []struct {
+		name          string
+		retention     retentionConfig
+		bucketAttrs   *storage.BucketAttrs
+		expectedError string
+	}{
+		{
+			name:        "nothing to verify",
+			retention:   retentionConfig{temporaryHold: true},
+			bucketAttrs: nil,
+		},
+		{
+			name:        "object retention enabled",
+			retention:   retentionConfig{mode: "Locked", duration: time.Hour},
+			bucketAttrs: &storage.BucketAttrs{ObjectRetentionMode: "Enabled"},
+		},
+		{
+			name:          "object retention not enabled",
+			retention:     retentionConfig{mode: "Locked", duration: time.Hour},
+			bucketAttrs:   &storage.BucketAttrs{},
+			expectedError: "objectRetentionMode is set but object retention is not enabled on bucket b",
+		},
+		{
+			name:        "locked bucket retention policy",
+			retention:   retentionConfig{bucketPolicy: "locked"},
+			bucketAttrs: &storage.BucketAttrs{RetentionPolicy: &storage.RetentionPolicy{RetentionPeriod: time.Hour, IsLocked: true}},
+		},
+		{
+			name:          "unlocked bucket retention policy",
+			retention:     retentionConfig{bucketPolicy: "locked"},
+			bucketAttrs:   &storage.BucketAttrs{RetentionPolicy: &storage.RetentionPolicy{RetentionPeriod: time.Hour}},
+			expectedError: "bucket b has no retention policy locked with Bucket Lock",
+		},
+		{
+			name:          "missing bucket retention policy",
+			retention:     retentionConfig{bucketPolicy: "required"},
+			bucketAttrs:   &storage.BucketAttrs{},
+			expectedError: "bucket b has no retention policy",
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			w := newFakeWriter(nil)
+			w.bucketAttrs = tc.bucketAttrs
+			o := newObjectStore(velerotest.NewLogger())
+			o.bucketWriter = w
+
+			err := o.verifyBucketRetention("b", tc.retention)
+			if tc.expectedError != "" {
+				assert.EqualError(t, err, tc.expectedError)
+				return
+			}
+			assert.NoError(t, err)
+		})
+	}
+}
+
+func TestRetentionError(t *testing.T) {
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	deleteErr := errors.New("forbidden")
+
+	err := retentionError("k", &storage.ObjectAttrs{
+		Retention: &storage.ObjectRetention{Mode: "Locked", RetainUntil: now.Add(time.Hour)},
+	}, now, deleteErr)
+	assert.EqualError(t, err, "object k cannot be deleted: retained until 2024-01-01T01:00:00Z (Locked object retention): forbidden")
+	assert.ErrorIs(t, err, deleteErr)
+
+	err = retentionError("k", &storage.ObjectAttrs{RetentionExpirationTime: now.Add(time.Hour)}, now, deleteErr)
+	assert.EqualError(t, err, "object k cannot be deleted: retained until 2024-01-01T01:00:00Z by the bucket's retention policy: forbidden")
+
+	err = retentionError("k", &storage.ObjectAttrs{EventBasedHold: true}, now, deleteErr)
+	assert.EqualError(t, err, "object k cannot be deleted: an event-based hold is set on it: forbidden")
+
+	assert.NoError(t, retentionError("k", &storage.ObjectAttrs{
+		Retention: &storage.ObjectRetention{Mode: "Unlocked", RetainUntil: now.Add(-time.Hour)},
+	}, now, deleteErr))
+}
@@ -0,0 +1,117 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"strconv"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/storage"
+	gax "github.com/googleapis/gax-go/v2"
+	"github.com/pkg/errors"
+)
+
+const (
+	retryPolicyConfigKey            = "retryPolicy"
+	retryMaxAttemptsConfigKey       = "retryMaxAttempts"
+	retryInitialBackoffConfigKey    = "retryInitialBackoff"
+	retryMaxBackoffConfigKey        = "retryMaxBackoff"
+	retryBackoffMultiplierConfigKey = "retryBackoffMultiplier"
+)
+
+// retryConfig holds the retry behavior of the storage client configured on the BSL.
+type retryConfig struct {
+	options []storage.RetryOption
+	// conditionalWrites makes PutObject and DeleteObject send a generation
+	// precondition, which lets the client retry them under the idempotent-only policy.
+	conditionalWrites bool
+}
+
+// parseRetryConfig reads the retry settings from the BSL config. Settings that aren't
+// configured keep the storage client's defaults.
+func parseRetryConfig(config map[string]string) (retryConfig, error) {
+	var c retryConfig
+
+	switch strings.ToLower(config[retryPolicyConfigKey]) {
+	case "":
+		// The storage client retries idempotent requests only by default.
+		c.conditionalWrites = true
+	case "always":
+		c.options = append(c.options, storage.WithPolicy(storage.RetryAlways))
+	case "idempotent":
+		c.options = append(c.options, storage.WithPolicy(storage.RetryIdempotent))
+		c.conditionalWrites = true
+	case "never":
+		c.options = append(c.options, storage.WithPolicy(storage.RetryNever))
+	default:
+		return c, errors.Errorf("unsupported %s %q, must be always, idempotent or never", retryPolicyConfigKey, config[retryPolicyConfigKey])
+	}
+
+	if value, ok := config[retryMaxAttemptsConfigKey]; ok {
+		attempts, err := strconv.Atoi(value)
+		if err != nil {
+			return c, errors.Wrapf(err, "invalid value for %s", retryMaxAttemptsConfigKey)
+		}
+		if attempts < 1 {
+			return c, errors.Errorf("invalid value for %s: must be at least 1", retryMaxAttemptsConfigKey)
+		}
+		c.options = append(c.options, storage.WithMaxAttempts(attempts))
+	}
+
+	var backoff gax.Backoff
+	var hasBackoff bool
+	for key, d := range map[string]*time.Duration{
+		retryInitialBackoffConfigKey: &backoff.Initial,
+		retryMaxBackoffConfigKey:     &backoff.Max,
+	} {
+		value, ok := config[key]
+		if !ok {
+			continue
+		}
+		parsed, err := time.ParseDuration(value)
+		if err != nil {
+			return c, errors.Wrapf(err, "invalid value for %s", key)
+		}
+		if parsed <= 0 {
+			return c, errors.Errorf("invalid value for %s: must be positive", key)
+		}
+		*d = parsed
+		hasBackoff = true
+	}
+	if backoff.Initial > 0 && backoff.Max > 0 && backoff.Initial > backoff.Max {
+		return c, errors.Errorf("%s must not be greater than %s", retryInitialBackoffConfigKey, retryMaxBackoffConfigKey)
+	}
+
+	if value, ok := config[retryBackoffMultiplierConfigKey]; ok {
+		multiplier, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return c, errors.Wrapf(err, "invalid value for %s", retryBackoffMultiplierConfigKey)
+		}
+		if multiplier <= 1 {
+			return c, errors.Errorf("invalid value for %s: must be greater than 1", retryBackoffMultiplierConfigKey)
+		}
+		backoff.Multiplier = multiplier
+		hasBackoff = true
+	}
+
+	if hasBackoff {
+		c.options = append(c.options, storage.WithBackoff(backoff))
+	}
+
+	return c, nil
+}
@@ -0,0 +1,201 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"hash/crc32"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"cloud.google.com/go/storage"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	velerotest "github.com/vmware-tanzu/velero/pkg/test"
+	"google.golang.org/api/option"
+)
+
+func TestParseRetryConfig(t *testing.T) {
+	tests := []struct {
+		name                      string
+		config                    map[string]string
+		expectedOptions           int
+		expectedConditionalWrites bool
+		expectedError             string
+	}{
+		{
+			name:                      "defaults",
+			config:                    map[string]string{},
+			expectedConditionalWrites: true,
+		},
+		{
+			name: "idempotent policy with backoff",
+			config: map[string]string{
+				retryPolicyConfigKey:            "idempotent",
+				retryMaxAttemptsConfigKey:       "5",
+				retryInitialBackoffConfigKey:    "500ms",
+				retryMaxBackoffConfigKey:        "1m",
+				retryBackoffMultiplierConfigKey: "1.5",
+			},
+			expectedOptions:           3,
+			expectedConditionalWrites: true,
+		},
+		{
+			name:            "never retry",
+			config:          map[string]string{retryPolicyConfigKey: "Never"},
+			expectedOptions: 1,
+		},
+		{
+			name:          "unknown policy",
+			config:        map[string]string{retryPolicyConfigKey: "sometimes"},
+			expectedError: `unsupported retryPolicy "sometimes", must be always, idempotent or never`,
+		},
+		{
+			name:          "zero attempts",
+			config:        map[string]string{retryMaxAttemptsConfigKey: "0"},
+			expectedError: "invalid value for retryMaxAttempts: must be at least 1",
+		},
+		{
+			name: "initial backoff greater than max",
+			config: map[string]string{
+				retryInitialBackoffConfigKey: "1m",
+				retryMaxBackoffConfigKey:     "1s",
+			},
+			expectedError: "retryInitialBackoff must not be greater than retryMaxBackoff",
+		},
+		{
+			name:          "multiplier must grow",
+			config:        map[string]string{retryBackoffMultiplierConfigKey: "1"},
+			expectedError: "invalid value for retryBackoffMultiplier: must be greater than 1",
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			c, err := parseRetryConfig(tc.config)
+			if tc.expectedError != "" {
+				assert.EqualError(t, err, tc.expectedError)
+				return
+			}
+			require.NoError(t, err)
+			assert.Len(t, c.options, tc.expectedOptions)
+			assert.Equal(t, tc.expectedConditionalWrites, c.conditionalWrites)
+		})
+	}
+}
+
+// newPreconditionServer serves a bucket holding key at generation 7 if exists is set, and
+// records the ifGenerationMatch parameter of every upload and deletion. Uploads must
+// contain "contents".
+func newPreconditionServer(t *testing.T, exists bool) (*storage.Client, func() []string) {
+	t.Helper()
+	var mu sync.Mutex
+	var preconditions []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPost || r.Method == http.MethodDelete {
+			mu.Lock()
+			precondition := "none"
+			if r.URL.Query().Has("ifGenerationMatch") {
+				precondition = r.URL.Query().Get("ifGenerationMatch")
+			}
+			preconditions = append(preconditions, r.Method+" "+precondition)
+			mu.Unlock()
+		}
+		switch {
+		case r.Method == http.MethodDelete:
+			w.WriteHeader(http.StatusNoContent)
+		case r.Method == http.MethodPost && strings.HasPrefix(r.URL.Path, "/upload/storage/v1/b/bucket/o"):
+			w.Header().Set("Content-Type", "application/json")
+			require.NoError(t, json.NewEncoder(w).Encode(map[string]string{
+				"bucket":     "bucket",
+				"name":       "key",
+				"generation": "8",
+				"crc32c":     encodeCRC32C(crc32.Checksum([]byte("contents"), crc32cTable)),
+			}))
+		case r.URL.Path == "/storage/v1/b/bucket/o/key" && exists:
+			w.Header().Set("Content-Type", "application/json")
+			require.NoError(t, json.NewEncoder(w).Encode(map[string]string{"bucket": "bucket", "name": "key", "generation": "7"}))
+		default:
+			http.Error(w, `{"error": {"code": 404, "message": "not found"}}`, http.StatusNotFound)
+		}
+	}))
+	t.Cleanup(srv.Close)
+
+	client, err := storage.NewClient(context.Background(), option.WithEndpoint(srv.URL+"/storage/v1/"), option.WithoutAuthentication())
+	require.NoError(t, err)
+	return client, func() []string {
+		mu.Lock()
+		defer mu.Unlock()
+		return preconditions
+	}
+}
+
+func TestRetryPolicyPreconditions(t *testing.T) {
+	tests := []struct {
+		name                  string
+		policy                string
+		exists                bool
+		expectedPreconditions []string
+	}{
+		{
+			name:                  "default policy conditions on the current generation",
+			exists:                true,
+			expectedPreconditions: []string{"POST 7", "DELETE 7"},
+		},
+		{
+			name:                  "default policy uploads new objects only if they don't exist",
+			expectedPreconditions: []string{"POST 0"},
+		},
+		{
+			name:                  "idempotent policy conditions on the current generation",
+			policy:                "idempotent",
+			exists:                true,
+			expectedPreconditions: []string{"POST 7", "DELETE 7"},
+		},
+		{
+			name:                  "never policy sends no preconditions",
+			policy:                "never",
+			exists:                true,
+			expectedPreconditions: []string{"POST none", "DELETE none"},
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			client, preconditions := newPreconditionServer(t, tc.exists)
+			o := newObjectStore(velerotest.NewLogger())
+			o.client = client
+			o.bucketWriter = &writer{client: client}
+			var err error
+			o.retry, err = parseRetryConfig(map[string]string{retryPolicyConfigKey: tc.policy})
+			require.NoError(t, err)
+
+			require.NoError(t, o.PutObject("bucket", "key", strings.NewReader("contents")))
+			err = o.DeleteObject("bucket", "key")
+			if !tc.exists {
+				// The server doesn't keep uploads, so the object still doesn't exist.
+				assert.ErrorIs(t, err, storage.ErrObjectNotExist)
+			} else {
+				require.NoError(t, err)
+			}
+			assert.Equal(t, tc.expectedPreconditions, preconditions())
+		})
+	}
+}
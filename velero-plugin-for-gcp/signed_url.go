@@ -0,0 +1,170 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"net/url"
+	"strconv"
+	"strings"
+
+	"cloud.google.com/go/storage"
+	"github.com/pkg/errors"
+)
+
+const (
+	signedURLSchemeConfigKey              = "signedURLScheme"
+	signedURLHostnameConfigKey            = "signedURLHostname"
+	signedURLStyleConfigKey               = "signedURLStyle"
+	signedURLBucketBoundHostnameConfigKey = "signedURLBucketBoundHostname"
+	signedURLInsecureConfigKey            = "signedURLInsecure"
+	signedURLContentDispositionConfigKey  = "signedURLContentDisposition"
+	signedURLContentTypeConfigKey         = "signedURLContentType"
+)
+
+// signedURLConfig holds the BSL settings that shape the URLs returned by CreateSignedURL.
+// The zero value signs V2, path-style URLs for storage.googleapis.com.
+type signedURLConfig struct {
+	scheme          storage.SigningScheme
+	hostname        string
+	style           storage.URLStyle
+	insecure        bool
+	queryParameters url.Values
+	// userProject, if set, is added to V2 URLs once they are signed.
+	userProject string
+}
+
+// parseSignedURLConfig reads the signed URL settings from the BSL config. URLs are V4
+// signed by default and, unless signedURLHostname overrides it, point at the host of
+// storeEndpoint or at the storage host of universeDomain when those are set.
+func parseSignedURLConfig(config map[string]string) (signedURLConfig, error) {
+	c := signedURLConfig{
+		scheme: storage.SigningSchemeV4,
+		style:  storage.PathStyle(),
+	}
+
+	switch strings.ToLower(config[signedURLSchemeConfigKey]) {
+	case "", "v4":
+	case "v2":
+		c.scheme = storage.SigningSchemeV2
+	default:
+		return c, errors.Errorf("unsupported %s %q, must be v2 or v4", signedURLSchemeConfigKey, config[signedURLSchemeConfigKey])
+	}
+
+	switch {
+	case config[signedURLHostnameConfigKey] != "":
+		c.hostname = config[signedURLHostnameConfigKey]
+	case config[storeEndpointConfigKey] != "":
+		c.hostname = endpointHost(config[storeEndpointConfigKey])
+	case config[universeDomainKey] != "":
+		c.hostname = "storage." + config[universeDomainKey]
+	}
+
+	switch strings.ToLower(config[signedURLStyleConfigKey]) {
+	case "", "path":
+	case "virtualhosted":
+		c.style = storage.VirtualHostedStyle()
+	default:
+		return c, errors.Errorf("unsupported %s %q, must be path or virtualHosted", signedURLStyleConfigKey, config[signedURLStyleConfigKey])
+	}
+
+	if hostname := config[signedURLBucketBoundHostnameConfigKey]; hostname != "" {
+		if config[signedURLStyleConfigKey] != "" {
+			return c, errors.Errorf("%s and %s cannot both be set", signedURLStyleConfigKey, signedURLBucketBoundHostnameConfigKey)
+		}
+		c.style = storage.BucketBoundHostname(hostname)
+	}
+
+	if value, ok := config[signedURLInsecureConfigKey]; ok {
+		insecure, err := strconv.ParseBool(value)
+		if err != nil {
+			return c, errors.Wrapf(err, "invalid value for %s", signedURLInsecureConfigKey)
+		}
+		c.insecure = insecure
+	}
+
+	// Response header overrides are passed as query parameters, which only V4 signing supports.
+	for configKey, param := range map[string]string{
+		signedURLContentDispositionConfigKey: "response-content-disposition",
+		signedURLContentTypeConfigKey:        "response-content-type",
+	} {
+		if value := config[configKey]; value != "" {
+			if c.scheme != storage.SigningSchemeV4 {
+				return c, errors.Errorf("%s requires %s to be v4", configKey, signedURLSchemeConfigKey)
+			}
+			if c.queryParameters == nil {
+				c.queryParameters = url.Values{}
+			}
+			c.queryParameters.Set(param, value)
+		}
+	}
+
+	// Downloads from Requester Pays buckets must name the project billed. V2 signatures
+	// don't cover query parameters, so it is added to V2 URLs once they are signed.
+	if userProject := config[userProjectConfigKey]; userProject != "" {
+		if c.scheme == storage.SigningSchemeV4 {
+			if c.queryParameters == nil {
+				c.queryParameters = url.Values{}
+			}
+			c.queryParameters.Set(userProjectQueryParameter, userProject)
+		} else {
+			c.userProject = userProject
+		}
+	}
+
+	if c.insecure && c.scheme != storage.SigningSchemeV4 {
+		return c, errors.Errorf("%s requires %s to be v4", signedURLInsecureConfigKey, signedURLSchemeConfigKey)
+	}
+
+	return c, nil
+}
+
+// endpointHost returns the host part of a storeEndpoint, which may be a bare host name
+// such as "storage-example.p.googleapis.com" or a URL such as
+// "https://storage-example.p.googleapis.com/storage/v1/".
+func endpointHost(endpoint string) string {
+	if strings.Contains(endpoint, "://") {
+		if u, err := url.Parse(endpoint); err == nil && u.Host != "" {
+			return u.Host
+		}
+	}
+	host, _, _ := strings.Cut(endpoint, "/")
+	return host
+}
+
+// apply sets the URL shape on options.
+func (c signedURLConfig) apply(options *storage.SignedURLOptions) {
+	options.Scheme = c.scheme
+	options.Hostname = c.hostname
+	options.Style = c.style
+	options.Insecure = c.insecure
+	options.QueryParameters = c.queryParameters
+}
+
+// finish adds the query parameters that aren't signed to a signed URL.
+func (c signedURLConfig) finish(signedURL string) (string, error) {
+	if c.userProject == "" {
+		return signedURL, nil
+	}
+	u, err := url.Parse(signedURL)
+	if err != nil {
+		return "", errors.WithStack(err)
+	}
+	q := u.Query()
+	q.Set(userProjectQueryParameter, c.userProject)
+	u.RawQuery = q.Encode()
+	return u.String(), nil
+}
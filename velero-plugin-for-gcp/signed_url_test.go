@@ -0,0 +1,162 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package main
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	velerotest "github.com/vmware-tanzu/velero/pkg/test"
+)
+
+func TestCreateSignedURL(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	privateKey := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})
+
+	tests := []struct {
+		name           string
+		config         map[string]string
+		expectedPrefix string
+		expectedQuery  map[string]string
+		expectedError  string
+	}{
+		{
+			name:           "V4 signing by default",
+			config:         map[string]string{},
+			expectedPrefix: "https://storage.googleapis.com/bucket/backups/b1.tar.gz?",
+			expectedQuery:  map[string]string{"X-Goog-Algorithm": "GOOG4-RSA-SHA256"},
+		},
+		{
+			name:           "V2 signing",
+			config:         map[string]string{signedURLSchemeConfigKey: "v2"},
+			expectedPrefix: "https://storage.googleapis.com/bucket/backups/b1.tar.gz?",
+			expectedQuery:  map[string]string{"GoogleAccessId": "velero@p.iam.gserviceaccount.com"},
+		},
+		{
+			name:           "storeEndpoint host is used",
+			config:         map[string]string{storeEndpointConfigKey: "https://storage-example.p.googleapis.com/storage/v1/"},
+			expectedPrefix: "https://storage-example.p.googleapis.com/bucket/backups/b1.tar.gz?",
+		},
+		{
+			name:           "universeDomain host is used",
+			config:         map[string]string{universeDomainKey: "example-universe.goog"},
+			expectedPrefix: "https://storage.example-universe.goog/bucket/backups/b1.tar.gz?",
+		},
+		{
+			name: "explicit hostname takes precedence with virtual hosted style",
+			config: map[string]string{
+				storeEndpointConfigKey:     "storage-example.p.googleapis.com",
+				signedURLHostnameConfigKey: "downloads.example.com",
+				signedURLStyleConfigKey:    "virtualHosted",
+			},
+			expectedPrefix: "https://bucket.downloads.example.com/backups/b1.tar.gz?",
+		},
+		{
+			name: "bucket bound hostname over HTTP",
+			config: map[string]string{
+				signedURLBucketBoundHostnameConfigKey: "backups.example.com",
+				signedURLInsecureConfigKey:            "true",
+			},
+			expectedPrefix: "http://backups.example.com/backups/b1.tar.gz?",
+		},
+		{
+			name: "response header overrides",
+			config: map[string]string{
+				signedURLContentDispositionConfigKey: "attachment",
+				signedURLContentTypeConfigKey:        "application/gzip",
+			},
+			expectedPrefix: "https://storage.googleapis.com/bucket/backups/b1.tar.gz?",
+			expectedQuery: map[string]string{
+				"response-content-disposition": "attachment",
+				"response-content-type":        "application/gzip",
+			},
+		},
+		{
+			name:           "user project on V4 URLs",
+			config:         map[string]string{userProjectConfigKey: "billing-project"},
+			expectedPrefix: "https://storage.googleapis.com/bucket/backups/b1.tar.gz?",
+			expectedQuery: map[string]string{
+				"userProject":          "billing-project",
+				"X-Goog-Algorithm":     "GOOG4-RSA-SHA256",
+				"X-Goog-SignedHeaders": "host",
+			},
+		},
+		{
+			name:           "user project on V2 URLs",
+			config:         map[string]string{signedURLSchemeConfigKey: "v2", userProjectConfigKey: "billing-project"},
+			expectedPrefix: "https://storage.googleapis.com/bucket/backups/b1.tar.gz?",
+			expectedQuery: map[string]string{
+				"userProject":    "billing-project",
+				"GoogleAccessId": "velero@p.iam.gserviceaccount.com",
+			},
+		},
+		{
+			name:          "invalid scheme",
+			config:        map[string]string{signedURLSchemeConfigKey: "v3"},
+			expectedError: `unsupported signedURLScheme "v3", must be v2 or v4`,
+		},
+		{
+			name: "response header overrides require V4",
+			config: map[string]string{
+				signedURLSchemeConfigKey:             "v2",
+				signedURLContentDispositionConfigKey: "attachment",
+			},
+			expectedError: "signedURLContentDisposition requires signedURLScheme to be v4",
+		},
+		{
+			name: "style and bucket bound hostname conflict",
+			config: map[string]string{
+				signedURLStyleConfigKey:               "path",
+				signedURLBucketBoundHostnameConfigKey: "backups.example.com",
+			},
+			expectedError: "signedURLStyle and signedURLBucketBoundHostname cannot both be set",
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			signedURL, err := parseSignedURLConfig(tc.config)
+			if tc.expectedError != "" {
+				assert.EqualError(t, err, tc.expectedError)
+				return
+			}
+			require.NoError(t, err)
+
+			o := newObjectStore(velerotest.NewLogger())
+			o.googleAccessID = "velero@p.iam.gserviceaccount.com"
+			o.privateKey = privateKey
+			o.signedURL = signedURL
+
+			res, err := o.CreateSignedURL("bucket", "backups/b1.tar.gz", time.Minute)
+			require.NoError(t, err)
+			assert.Contains(t, res, tc.expectedPrefix)
+
+			u, err := url.Parse(res)
+			require.NoError(t, err)
+			for k, v := range tc.expectedQuery {
+				assert.Equal(t, v, u.Query().Get(k))
+			}
+		})
+	}
+}
@@ -0,0 +1,243 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"strconv"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/storage"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	atomicUploadsConfigKey        = "atomicUploads"
+	stagingMaxAgeConfigKey        = "stagingMaxAge"
+	stagingSweepIntervalConfigKey = "stagingSweepInterval"
+)
+
+const (
+	// stagingDir is the hidden directory, under the BSL prefix, that uploads are staged in.
+	stagingDir = ".velero-staging"
+	// sweepMarker is the object, in a hidden directory, whose creation time records when
+	// the directory was last swept.
+	sweepMarker = ".last-sweep"
+
+	defaultStagingMaxAge        = 24 * time.Hour
+	defaultStagingSweepInterval = time.Hour
+)
+
+// stagingConfig describes atomic uploads, which are written to a staging key, verified,
+// then published to their key, so that a failed upload never leaves a truncated object
+// at the key or replaces the previous version with one.
+type stagingConfig struct {
+	enabled bool
+	// prefix is the prefix of staging keys, which listings skip.
+	prefix string
+	// maxAge is the age from which staging objects are assumed to be left over from
+	// failed uploads, and deleted.
+	maxAge        time.Duration
+	sweepInterval time.Duration
+	// sweep is whether the staging directory is swept, which it is when it holds atomic
+	// uploads or the parts of parallel uploads.
+	sweep bool
+}
+
+// parseStagingConfig reads the atomic upload settings from the BSL config. The staging
+// directory also holds the parts of parallel uploads, if enabled. Staging objects must
+// outlive the longest upload, so maxAge must exceed uploadTimeout.
+func parseStagingConfig(config map[string]string, uploadTimeout time.Duration, parallelUploads bool) (stagingConfig, error) {
+	c := stagingConfig{
+		prefix:        stagingDir + "/",
+		maxAge:        defaultStagingMaxAge,
+		sweepInterval: defaultStagingSweepInterval,
+	}
+	if prefix := strings.Trim(config["prefix"], "/"); prefix != "" {
+		c.prefix = prefix + "/" + c.prefix
+	}
+
+	if value, ok := config[atomicUploadsConfigKey]; ok {
+		enabled, err := strconv.ParseBool(value)
+		if err != nil {
+			return c, errors.Wrapf(err, "invalid value for %s", atomicUploadsConfigKey)
+		}
+		c.enabled = enabled
+	}
+
+	for key, d := range map[string]*time.Duration{
+		stagingMaxAgeConfigKey:        &c.maxAge,
+		stagingSweepIntervalConfigKey: &c.sweepInterval,
+	} {
+		value, ok := config[key]
+		if !ok {
+			continue
+		}
+		parsed, err := time.ParseDuration(value)
+		if err != nil {
+			return c, errors.Wrapf(err, "invalid value for %s", key)
+		}
+		if parsed <= 0 {
+			return c, errors.Errorf("invalid value for %s: %s must be positive", key, value)
+		}
+		*d = parsed
+	}
+
+	c.sweep = c.enabled || parallelUploads
+	if c.sweep && uploadTimeout > 0 && c.maxAge <= uploadTimeout {
+		return c, errors.Errorf("%s must be longer than %s, so that uploads in progress aren't swept", stagingMaxAgeConfigKey, uploadTimeoutConfigKey)
+	}
+	return c, nil
+}
+
+// stagingKey returns a new staging key for an upload to key.
+func (c stagingConfig) stagingKey(key string) (string, error) {
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		return "", errors.WithStack(err)
+	}
+	return c.prefix + hex.EncodeToString(id) + "/" + key, nil
+}
+
+// isStaging returns whether name is, or is a directory of, staging keys.
+func (c stagingConfig) isStaging(name string) bool {
+	if c.prefix == "" {
+		return false
+	}
+	return strings.HasPrefix(name, c.prefix) || name == strings.TrimSuffix(c.prefix, "/")
+}
+
+// publish promotes an upload verified to have been stored intact under a staging key
+// to its key, and deletes the staging object. The object at the key is only replaced
+// if it still is at the generation opts.conds expects.
+func (o *ObjectStore) publish(ctx context.Context, bucket, key string, staged *storage.ObjectAttrs, size int64, opts writeOptions) (*storage.ObjectAttrs, error) {
+	defer func() {
+		// The context of the upload may be done.
+		ctx, cancel := operationContext(o.timeouts.request)
+		defer cancel()
+		if err := o.bucketWriter.deleteGeneration(ctx, bucket, staged.Name, staged.Generation); err != nil && !errors.Is(err, storage.ErrObjectNotExist) {
+			o.log.WithError(err).WithField("key", staged.Name).Warn("Error deleting staged upload, it will be swept later")
+		}
+	}()
+
+	if staged.Size != size {
+		return nil, errors.Errorf("size mismatch for staged upload of %s: wrote %d bytes, Cloud Storage has %d", key, size, staged.Size)
+	}
+	attrs, err := o.bucketWriter.compose(ctx, bucket, key, []string{staged.Name}, opts)
+	if conflict := o.writeConflict(bucket, key, opts.conds, err); conflict != nil {
+		return nil, errors.WithStack(conflict)
+	}
+	if err != nil {
+		return nil, errors.Wrapf(classifyError(err), "error publishing staged upload of %s", key)
+	}
+	return attrs, nil
+}
+
+// startSweep sweeps the hidden directory at prefix of the bucket with sweep, in the
+// background until ctx is done, unless it was swept less than interval ago. Velero
+// starts a plugin process for most operations and stops it soon after, so when the
+// directory was last swept is recorded in the bucket rather than in the process, and
+// whichever process initializes the object store first once interval has passed sweeps
+// it.
+func (o *ObjectStore) startSweep(ctx context.Context, bucket, prefix string, interval time.Duration, sweep func(s *ObjectStore, ctx context.Context, bucket string, now time.Time) int) {
+	// The sweep runs on a copy, so that the object store can be initialized again
+	// meanwhile, and keeps its clients open until it is done.
+	current, release := o.acquire()
+	s := *current
+	go func() {
+		defer release()
+		now := time.Now()
+		claimed, err := s.claimSweep(ctx, bucket, prefix+sweepMarker, interval, now)
+		if err != nil {
+			if ctx.Err() == nil {
+				s.log.WithError(classifyError(err)).WithFields(logrus.Fields{"bucket": bucket, "prefix": prefix}).Warn("Error checking when the directory was last swept")
+			}
+			return
+		}
+		if claimed {
+			sweep(&s, ctx, bucket, now)
+		}
+	}()
+}
+
+// claimSweep returns whether the directory whose sweep marker is at key is to be swept at
+// now, which is when it wasn't swept in the last interval, and records that it is. Only
+// one of the processes claiming the sweep at once gets it.
+func (o *ObjectStore) claimSweep(ctx context.Context, bucket, key string, interval time.Duration, now time.Time) (bool, error) {
+	ctx, cancel := withOperationTimeout(ctx, o.timeouts.request)
+	defer cancel()
+
+	conds := storage.Conditions{DoesNotExist: true}
+	attrs, err := o.bucketWriter.getAttrs(ctx, bucket, key)
+	switch {
+	case errors.Is(err, storage.ErrObjectNotExist):
+	case err != nil:
+		return false, err
+	case now.Sub(attrs.Created) < interval:
+		return false, nil
+	default:
+		conds = storage.Conditions{GenerationMatch: attrs.Generation}
+	}
+
+	w := o.bucketWriter.getWriteCloser(ctx, bucket, key, writeOptions{conds: &conds, temporary: true})
+	if _, err := w.Write([]byte(now.UTC().Format(time.RFC3339))); err != nil {
+		w.Close()
+		return false, err
+	}
+	if err := w.Close(); err != nil {
+		if isPreconditionFailed(err) {
+			// Another process claimed the sweep.
+			return false, nil
+		}
+		return false, err
+	}
+	return true, nil
+}
+
+// sweepStaging deletes the staging objects left over from uploads that failed before
+// they were published, and returns the number deleted.
+func (o *ObjectStore) sweepStaging(ctx context.Context, bucket string, now time.Time) int {
+	ctx, cancel := withOperationTimeout(ctx, o.timeouts.list)
+	defer cancel()
+
+	log := o.log.WithFields(logrus.Fields{"bucket": bucket, "prefix": o.staging.prefix})
+	objects, err := o.bucketWriter.listObjects(ctx, bucket, o.staging.prefix)
+	if err != nil {
+		log.WithError(classifyError(err)).Warn("Error listing staged uploads to sweep")
+		return 0
+	}
+
+	var deleted int
+	for _, attrs := range objects {
+		if attrs.Name == o.staging.prefix+sweepMarker || now.Sub(attrs.Created) < o.staging.maxAge {
+			continue
+		}
+		if err := o.bucketWriter.deleteGeneration(ctx, bucket, attrs.Name, attrs.Generation); err != nil && !errors.Is(err, storage.ErrObjectNotExist) {
+			log.WithError(classifyError(err)).WithField("key", attrs.Name).Warn("Error deleting stale staged upload")
+			continue
+		}
+		deleted++
+	}
+	if deleted > 0 {
+		log.WithField("count", deleted).Info("Deleted stale staged uploads")
+	}
+	return deleted
+}
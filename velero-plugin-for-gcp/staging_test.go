@@ -0,0 +1,295 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"strings"
+	"testing"
+	"testing/iotest"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	velerotest "github.com/vmware-tanzu/velero/pkg/test"
+)
+
+func TestParseStagingConfig(t *testing.T) {
+	tests := []struct {
+		name            string
+		config          map[string]string
+		uploadTimeout   time.Duration
+		parallelUploads bool
+		expectedConfig  stagingConfig
+		expectedError   string
+	}{
+		{
+			name:   "disabled by default",
+			config: map[string]string{},
+			expectedConfig: stagingConfig{
+				prefix:        ".velero-staging/",
+				maxAge:        defaultStagingMaxAge,
+				sweepInterval: defaultStagingSweepInterval,
+			},
+		},
+		{
+			name: "all settings under a prefix",
+			config: map[string]string{
+				"prefix":                      "cluster-a/",
+				atomicUploadsConfigKey:        "true",
+				stagingMaxAgeConfigKey:        "6h",
+				stagingSweepIntervalConfigKey: "10m",
+			},
+			uploadTimeout: 2 * time.Hour,
+			expectedConfig: stagingConfig{
+				enabled:       true,
+				prefix:        "cluster-a/.velero-staging/",
+				maxAge:        6 * time.Hour,
+				sweepInterval: 10 * time.Minute,
+				sweep:         true,
+			},
+		},
+		{
+			name:            "swept for the parts of parallel uploads",
+			config:          map[string]string{},
+			parallelUploads: true,
+			expectedConfig: stagingConfig{
+				prefix:        ".velero-staging/",
+				maxAge:        defaultStagingMaxAge,
+				sweepInterval: defaultStagingSweepInterval,
+				sweep:         true,
+			},
+		},
+		{
+			name:          "invalid boolean",
+			config:        map[string]string{atomicUploadsConfigKey: "yes please"},
+			expectedError: `invalid value for atomicUploads: strconv.ParseBool: parsing "yes please": invalid syntax`,
+		},
+		{
+			name:          "invalid duration",
+			config:        map[string]string{stagingSweepIntervalConfigKey: "0s"},
+			expectedError: "invalid value for stagingSweepInterval: 0s must be positive",
+		},
+		{
+			name:          "max age within the upload timeout",
+			config:        map[string]string{atomicUploadsConfigKey: "true", stagingMaxAgeConfigKey: "1h"},
+			uploadTimeout: 2 * time.Hour,
+			expectedError: "stagingMaxAge must be longer than uploadTimeout, so that uploads in progress aren't swept",
+		},
+		{
+			name:            "max age within the upload timeout of parallel uploads",
+			config:          map[string]string{stagingMaxAgeConfigKey: "1h"},
+			uploadTimeout:   2 * time.Hour,
+			parallelUploads: true,
+			expectedError:   "stagingMaxAge must be longer than uploadTimeout, so that uploads in progress aren't swept",
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			config, err := parseStagingConfig(tc.config, tc.uploadTimeout, tc.parallelUploads)
+			if tc.expectedError != "" {
+				assert.EqualError(t, err, tc.expectedError)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tc.expectedConfig, config)
+		})
+	}
+}
+
+func TestStagingConfigIsStaging(t *testing.T) {
+	c := stagingConfig{prefix: "cluster-a/.velero-staging/"}
+
+	key, err := c.stagingKey("cluster-a/backups/b1/b1.tar.gz")
+	require.NoError(t, err)
+	assert.True(t, c.isStaging(key))
+	assert.True(t, c.isStaging("cluster-a/.velero-staging/"))
+	assert.True(t, c.isStaging("cluster-a/.velero-staging"))
+	assert.False(t, c.isStaging("cluster-a/backups/"))
+	assert.False(t, c.isStaging("cluster-a/.velero-staging-not/"))
+}
+
+func newTestAtomicObjectStore(bucket *memoryBucket) *ObjectStore {
+	o := newObjectStore(velerotest.NewLogger())
+	o.bucketWriter = bucket
+	o.staging = stagingConfig{enabled: true, prefix: ".velero-staging/", maxAge: time.Hour}
+	return o
+}
+
+func TestPutObjectAtomicUpload(t *testing.T) {
+	tests := []struct {
+		name            string
+		size            int
+		parallelUploads parallelUploadConfig
+	}{
+		{
+			name: "single request",
+			size: 1000,
+		},
+		{
+			name: "resumable upload",
+			size: checksumBufferSize + 1000,
+		},
+		{
+			name:            "parallel upload",
+			size:            checksumBufferSize + (2 << 20),
+			parallelUploads: parallelUploadConfig{threshold: 1 << 20, partSize: 256 << 10, concurrency: 4, maxMemory: 2 << 20},
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			bucket := newMemoryBucket()
+			o := newTestAtomicObjectStore(bucket)
+			o.parallelUploads = tc.parallelUploads
+			o.objectMetadata = map[string]string{"cluster": "prod-east"}
+
+			data := randomData(t, tc.size)
+			require.NoError(t, o.PutObject("bucket", "backups/b1/b1.tar.gz", bytes.NewReader(data)))
+
+			assert.Equal(t, []string{"backups/b1/b1.tar.gz"}, bucket.keys())
+			assert.True(t, bytes.Equal(data, bucket.data("backups/b1/b1.tar.gz")))
+			attrs, err := bucket.getAttrs(context.Background(), "bucket", "backups/b1/b1.tar.gz")
+			require.NoError(t, err)
+			assert.Equal(t, "prod-east", attrs.Metadata["cluster"])
+
+			published := bucket.composed[len(bucket.composed)-1]
+			require.Len(t, published, 1)
+			assert.True(t, strings.HasPrefix(published[0], ".velero-staging/"))
+			assert.True(t, strings.HasSuffix(published[0], "/backups/b1/b1.tar.gz"))
+		})
+	}
+}
+
+func TestPutObjectAtomicUploadFailureKeepsPreviousVersion(t *testing.T) {
+	bucket := newMemoryBucket()
+	_, err := bucket.put("backups/b1/b1.tar.gz", []byte("previous"), writeOptions{})
+	require.NoError(t, err)
+	o := newTestAtomicObjectStore(bucket)
+
+	body := io.MultiReader(bytes.NewReader(randomData(t, 1000)), iotest.ErrReader(assert.AnError))
+	assert.ErrorIs(t, o.PutObject("bucket", "backups/b1/b1.tar.gz", body), assert.AnError)
+
+	assert.Equal(t, []string{"backups/b1/b1.tar.gz"}, bucket.keys())
+	assert.Equal(t, "previous", string(bucket.data("backups/b1/b1.tar.gz")))
+}
+
+// writingReader writes an object to a bucket once it has been read, as a concurrent
+// writer would.
+type writingReader struct {
+	io.Reader
+	bucket *memoryBucket
+	key    string
+}
+
+func (r *writingReader) Read(p []byte) (int, error) {
+	n, err := r.Reader.Read(p)
+	if err == io.EOF {
+		if _, putErr := r.bucket.put(r.key, []byte("concurrent"), writeOptions{}); putErr != nil {
+			return n, putErr
+		}
+	}
+	return n, err
+}
+
+func TestPutObjectAtomicUploadConcurrentWrite(t *testing.T) {
+	bucket := newMemoryBucket()
+	o := newTestAtomicObjectStore(bucket)
+
+	body := &writingReader{Reader: bytes.NewReader(randomData(t, 1000)), bucket: bucket, key: "backups/b1/b1.tar.gz"}
+	err := o.PutObject("bucket", "backups/b1/b1.tar.gz", body)
+	var conflict *writeConflictError
+	require.ErrorAs(t, err, &conflict)
+	assert.Equal(t, int64(0), conflict.expected)
+
+	assert.Equal(t, []string{"backups/b1/b1.tar.gz"}, bucket.keys())
+	assert.Equal(t, "concurrent", string(bucket.data("backups/b1/b1.tar.gz")))
+}
+
+func TestSweepStaging(t *testing.T) {
+	bucket := newMemoryBucket()
+	o := newTestAtomicObjectStore(bucket)
+
+	for _, key := range []string{".velero-staging/.last-sweep", ".velero-staging/a/backups/b1.tar.gz", ".velero-staging/b/backups/b2.tar.gz", "backups/b3.tar.gz"} {
+		_, err := bucket.put(key, []byte(key), writeOptions{})
+		require.NoError(t, err)
+	}
+	bucket.objects[".velero-staging/a/backups/b1.tar.gz"].attrs.Created = time.Now().Add(-2 * time.Hour)
+	bucket.objects["backups/b3.tar.gz"].attrs.Created = time.Now().Add(-2 * time.Hour)
+
+	ctx := context.Background()
+	assert.Equal(t, 1, o.sweepStaging(ctx, "bucket", time.Now()))
+	assert.Equal(t, []string{".velero-staging/.last-sweep", ".velero-staging/b/backups/b2.tar.gz", "backups/b3.tar.gz"}, bucket.keys())
+
+	// The sweep marker is kept.
+	assert.Equal(t, 1, o.sweepStaging(ctx, "bucket", time.Now().Add(time.Hour)))
+	assert.Equal(t, []string{".velero-staging/.last-sweep", "backups/b3.tar.gz"}, bucket.keys())
+}
+
+func TestClaimSweep(t *testing.T) {
+	bucket := newMemoryBucket()
+	o := newTestAtomicObjectStore(bucket)
+	ctx := context.Background()
+	key := ".velero-staging/.last-sweep"
+	now := time.Now()
+
+	claimed, err := o.claimSweep(ctx, "bucket", key, time.Hour, now)
+	require.NoError(t, err)
+	assert.True(t, claimed, "never swept")
+
+	claimed, err = o.claimSweep(ctx, "bucket", key, time.Hour, now.Add(time.Minute))
+	require.NoError(t, err)
+	assert.False(t, claimed, "swept less than an interval ago")
+
+	bucket.objects[key].attrs.Created = now.Add(-2 * time.Hour)
+	claimed, err = o.claimSweep(ctx, "bucket", key, time.Hour, now)
+	require.NoError(t, err)
+	assert.True(t, claimed, "swept more than an interval ago")
+	assert.Equal(t, now.UTC().Format(time.RFC3339), string(bucket.data(key)))
+}
+
+func TestStartSweep(t *testing.T) {
+	bucket := newMemoryBucket()
+	o := newTestAtomicObjectStore(bucket)
+
+	swept := make(chan string, 1)
+	sweep := func(s *ObjectStore, ctx context.Context, bucket string, now time.Time) int {
+		swept <- bucket
+		return 0
+	}
+	o.startSweep(context.Background(), "bucket", o.staging.prefix, time.Hour, sweep)
+	select {
+	case b := <-swept:
+		assert.Equal(t, "bucket", b)
+	case <-time.After(5 * time.Second):
+		t.Fatal("the directory wasn't swept")
+	}
+	assert.Equal(t, []string{".velero-staging/.last-sweep"}, bucket.keys())
+
+	// Sweeps stop once the object store is initialized again.
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	bucket.objects[".velero-staging/.last-sweep"].attrs.Created = time.Now().Add(-2 * time.Hour)
+	o.startSweep(ctx, "bucket", o.staging.prefix, time.Hour, sweep)
+	select {
+	case <-swept:
+		t.Fatal("the directory was swept after the sweeps were stopped")
+	case <-time.After(100 * time.Millisecond):
+	}
+}
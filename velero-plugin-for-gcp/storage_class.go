@@ -0,0 +1,109 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"path"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+const storageClassRulesConfigKey = "storageClassRules"
+
+var storageClasses = map[string]bool{
+	"STANDARD":                     true,
+	"NEARLINE":                     true,
+	"COLDLINE":                     true,
+	"ARCHIVE":                      true,
+	"MULTI_REGIONAL":               true,
+	"REGIONAL":                     true,
+	"DURABLE_REDUCED_AVAILABILITY": true,
+}
+
+type storageClassRule struct {
+	pattern      string
+	storageClass string
+}
+
+// storageClassRules selects the storage class of uploaded objects from their keys. Objects
+// that match no rule get the bucket's default storage class.
+type storageClassRules struct {
+	// prefix is the BSL prefix, which patterns are relative to.
+	prefix string
+	rules  []storageClassRule
+}
+
+// parseStorageClassRules reads the storage class rules from the BSL config. Rules are
+// comma-separated pattern=class pairs, and the first rule that matches a key applies.
+func parseStorageClassRules(config map[string]string) (storageClassRules, error) {
+	r := storageClassRules{prefix: config["prefix"]}
+
+	for _, rule := range strings.Split(config[storageClassRulesConfigKey], ",") {
+		if rule = strings.TrimSpace(rule); rule == "" {
+			continue
+		}
+		pattern, class, ok := strings.Cut(rule, "=")
+		pattern, class = strings.Trim(strings.TrimSpace(pattern), "/"), strings.ToUpper(strings.TrimSpace(class))
+		if !ok || pattern == "" {
+			return r, errors.Errorf("invalid %s rule %q, must be pattern=storageClass", storageClassRulesConfigKey, rule)
+		}
+		if _, err := path.Match(pattern, ""); err != nil {
+			return r, errors.Wrapf(err, "invalid %s pattern %q", storageClassRulesConfigKey, pattern)
+		}
+		if !storageClasses[class] {
+			return r, errors.Errorf("unsupported storage class %q in %s", class, storageClassRulesConfigKey)
+		}
+		r.rules = append(r.rules, storageClassRule{pattern: pattern, storageClass: class})
+	}
+	return r, nil
+}
+
+// classFor returns the storage class of the object uploaded to key, or "" for the
+// bucket's default.
+func (r storageClassRules) classFor(key string) string {
+	key, ok := relativeKey(r.prefix, key)
+	if !ok {
+		return ""
+	}
+
+	for _, rule := range r.rules {
+		if keyMatches(rule.pattern, key) {
+			return rule.storageClass
+		}
+	}
+	return ""
+}
+
+// relativeKey returns key relative to the BSL prefix, or false if it isn't under it.
+func relativeKey(prefix, key string) (string, bool) {
+	if prefix == "" {
+		return key, true
+	}
+	return strings.CutPrefix(key, strings.TrimSuffix(prefix, "/")+"/")
+}
+
+// keyMatches returns whether a pattern, in the syntax of path.Match, matches a key or
+// one of its parent directories, so that "kopia/*" matches everything under kopia.
+func keyMatches(pattern, key string) bool {
+	for p := key; p != "." && p != "/" && p != ""; p = path.Dir(p) {
+		if matched, _ := path.Match(pattern, p); matched {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,123 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package main
+
+import (
+	"context"
+	"hash/crc32"
+	"strings"
+	"testing"
+
+	"cloud.google.com/go/storage"
+	"github.com/sirupsen/logrus"
+	logtest "github.com/sirupsen/logrus/hooks/test"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/api/option"
+)
+
+func TestParseStorageClassRules(t *testing.T) {
+	tests := []struct {
+		name          string
+		value         string
+		expectedRules []storageClassRule
+		expectedError string
+	}{
+		{
+			name:  "empty",
+			value: "",
+		},
+		{
+			name:  "rules in order",
+			value: "backups/*/*.tar.gz=nearline, /kopia/*/ = COLDLINE,",
+			expectedRules: []storageClassRule{
+				{pattern: "backups/*/*.tar.gz", storageClass: "NEARLINE"},
+				{pattern: "kopia/*", storageClass: "COLDLINE"},
+			},
+		},
+		{
+			name:          "missing class",
+			value:         "kopia/*",
+			expectedError: `invalid storageClassRules rule "kopia/*", must be pattern=storageClass`,
+		},
+		{
+			name:          "bad pattern",
+			value:         "kopia/[=COLDLINE",
+			expectedError: `invalid storageClassRules pattern "kopia/[": syntax error in pattern`,
+		},
+		{
+			name:          "unknown class",
+			value:         "kopia/*=COOL",
+			expectedError: `unsupported storage class "COOL" in storageClassRules`,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			rules, err := parseStorageClassRules(map[string]string{storageClassRulesConfigKey: tc.value})
+			if tc.expectedError != "" {
+				assert.EqualError(t, err, tc.expectedError)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tc.expectedRules, rules.rules)
+		})
+	}
+}
+
+func TestStorageClassFor(t *testing.T) {
+	rules, err := parseStorageClassRules(map[string]string{
+		"prefix":                   "cluster-a",
+		storageClassRulesConfigKey: "backups/*/*.tar.gz=NEARLINE,kopia/*=COLDLINE,backups/*=STANDARD",
+	})
+	require.NoError(t, err)
+
+	for key, expected := range map[string]string{
+		"cluster-a/backups/b1/b1.tar.gz":          "NEARLINE",
+		"cluster-a/backups/b1/velero-backup.json": "STANDARD",
+		"cluster-a/kopia/ns/p0123":                "COLDLINE",
+		"cluster-a/restores/r1/r1-logs.gz":        "",
+		"cluster-b/backups/b1/b1.tar.gz":          "",
+	} {
+		assert.Equal(t, expected, rules.classFor(key), key)
+	}
+}
+
+func TestWriterStorageClass(t *testing.T) {
+	client, err := storage.NewClient(context.Background(), option.WithoutAuthentication())
+	require.NoError(t, err)
+	rules, err := parseStorageClassRules(map[string]string{storageClassRulesConfigKey: "backups/*/*.tar.gz=NEARLINE"})
+	require.NoError(t, err)
+	w := &writer{client: client, storageClasses: rules}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	assert.Equal(t, "NEARLINE", w.getWriteCloser(ctx, "bucket", "backups/b1/b1.tar.gz", writeOptions{}).(*storage.Writer).StorageClass)
+	assert.Equal(t, "", w.getWriteCloser(ctx, "bucket", "backups/b1/velero-backup.json", writeOptions{}).(*storage.Writer).StorageClass)
+}
+
+func TestPutObjectLogsStorageClass(t *testing.T) {
+	logger, hook := logtest.NewNullLogger()
+	wc := newMockWriteCloser(nil, nil)
+	wc.attrs = &storage.ObjectAttrs{StorageClass: "NEARLINE", CRC32C: crc32.Checksum([]byte("contents"), crc32cTable)}
+	o := newObjectStore(logger)
+	o.bucketWriter = newFakeWriter(wc)
+	o.storageClasses.rules = []storageClassRule{{pattern: "backups/*/*.tar.gz", storageClass: "NEARLINE"}}
+
+	require.NoError(t, o.PutObject("bucket", "backups/b1/b1.tar.gz", strings.NewReader("contents")))
+	require.NotNil(t, hook.LastEntry())
+	assert.Equal(t, logrus.Fields{"key": "backups/b1/b1.tar.gz", "storageClass": "NEARLINE"}, hook.LastEntry().Data)
+}
@@ -0,0 +1,148 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"io"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	requestTimeoutConfigKey      = "requestTimeout"
+	uploadTimeoutConfigKey       = "uploadTimeout"
+	downloadTimeoutConfigKey     = "downloadTimeout"
+	listTimeoutConfigKey         = "listTimeout"
+	downloadIdleTimeoutConfigKey = "downloadIdleTimeout"
+)
+
+// objectStoreTimeouts bounds how long each kind of object store operation may take.
+// A zero duration means no limit.
+type objectStoreTimeouts struct {
+	request      time.Duration
+	upload       time.Duration
+	download     time.Duration
+	list         time.Duration
+	downloadIdle time.Duration
+}
+
+// parseTimeouts reads the operation timeouts from the BSL config. uploadTimeout,
+// downloadTimeout and listTimeout default to requestTimeout.
+func parseTimeouts(config map[string]string) (objectStoreTimeouts, error) {
+	var t objectStoreTimeouts
+	for key, d := range map[string]*time.Duration{
+		requestTimeoutConfigKey:      &t.request,
+		uploadTimeoutConfigKey:       &t.upload,
+		downloadTimeoutConfigKey:     &t.download,
+		listTimeoutConfigKey:         &t.list,
+		downloadIdleTimeoutConfigKey: &t.downloadIdle,
+	} {
+		value, ok := config[key]
+		if !ok {
+			continue
+		}
+		parsed, err := time.ParseDuration(value)
+		if err != nil {
+			return t, errors.Wrapf(err, "invalid value for %s", key)
+		}
+		if parsed < 0 {
+			return t, errors.Errorf("invalid value for %s: %s must not be negative", key, value)
+		}
+		*d = parsed
+	}
+
+	for _, d := range []*time.Duration{&t.upload, &t.download, &t.list} {
+		if *d == 0 {
+			*d = t.request
+		}
+	}
+	return t, nil
+}
+
+// operationContext returns a context that is cancelled after timeout, or only when the
+// returned cancel function is called if timeout is zero.
+func operationContext(timeout time.Duration) (context.Context, context.CancelFunc) {
+	return withOperationTimeout(context.Background(), timeout)
+}
+
+// withOperationTimeout is operationContext for an operation that also stops when ctx is
+// done.
+func withOperationTimeout(ctx context.Context, timeout time.Duration) (context.Context, context.CancelFunc) {
+	if timeout > 0 {
+		return context.WithTimeout(ctx, timeout)
+	}
+	return context.WithCancel(ctx)
+}
+
+// wrapTimeoutError annotates err with the operation and timeout when ctx hit its deadline.
+func wrapTimeoutError(ctx context.Context, err error, timeout time.Duration, format string, args ...interface{}) error {
+	if err != nil && errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return errors.Wrapf(err, format+" timed out after %v", append(args, timeout)...)
+	}
+	return err
+}
+
+// idleTimeoutReader cancels the context of a download when a Read makes no progress
+// within the idle timeout, so a stalled stream fails instead of hanging. It also
+// releases the context when closed.
+type idleTimeoutReader struct {
+	r        io.ReadCloser
+	cancel   context.CancelFunc
+	idle     time.Duration
+	timer    *time.Timer
+	timedOut atomic.Bool
+}
+
+func newIdleTimeoutReader(r io.ReadCloser, cancel context.CancelFunc, idle time.Duration) *idleTimeoutReader {
+	t := &idleTimeoutReader{r: r, cancel: cancel, idle: idle}
+	if idle > 0 {
+		t.timer = time.AfterFunc(idle, func() {
+			t.timedOut.Store(true)
+			cancel()
+		})
+		t.timer.Stop()
+	}
+	return t
+}
+
+func (t *idleTimeoutReader) Read(p []byte) (int, error) {
+	// Only time the Read itself, so a slow consumer doesn't look like a stalled stream.
+	if t.timer != nil {
+		t.timer.Reset(t.idle)
+	}
+	n, err := t.r.Read(p)
+	if t.timer != nil {
+		t.timer.Stop()
+	}
+
+	if err != nil && err != io.EOF && t.timedOut.Load() {
+		return n, errors.Wrapf(err, "download stalled, no data received for %v", t.idle)
+	}
+	return n, err
+}
+
+func (t *idleTimeoutReader) Close() error {
+	if t.timer != nil {
+		t.timer.Stop()
+	}
+	err := t.r.Close()
+	t.cancel()
+	return err
+}
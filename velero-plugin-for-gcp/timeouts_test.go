@@ -0,0 +1,94 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package main
+
+import (
+	"context"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseTimeouts(t *testing.T) {
+	timeouts, err := parseTimeouts(map[string]string{})
+	require.NoError(t, err)
+	assert.Equal(t, objectStoreTimeouts{}, timeouts)
+
+	timeouts, err = parseTimeouts(map[string]string{
+		requestTimeoutConfigKey:      "1m",
+		uploadTimeoutConfigKey:       "2h",
+		downloadIdleTimeoutConfigKey: "30s",
+	})
+	require.NoError(t, err)
+	assert.Equal(t, objectStoreTimeouts{
+		request:      time.Minute,
+		upload:       2 * time.Hour,
+		download:     time.Minute,
+		list:         time.Minute,
+		downloadIdle: 30 * time.Second,
+	}, timeouts)
+
+	_, err = parseTimeouts(map[string]string{listTimeoutConfigKey: "soon"})
+	assert.ErrorContains(t, err, "invalid value for listTimeout")
+
+	_, err = parseTimeouts(map[string]string{requestTimeoutConfigKey: "-1s"})
+	assert.ErrorContains(t, err, "must not be negative")
+}
+
+// stallingReader blocks every Read until its context is cancelled.
+type stallingReader struct {
+	ctx context.Context
+}
+
+func (r *stallingReader) Read(p []byte) (int, error) {
+	<-r.ctx.Done()
+	return 0, r.ctx.Err()
+}
+
+func (r *stallingReader) Close() error {
+	return nil
+}
+
+func TestIdleTimeoutReader(t *testing.T) {
+	t.Run("stalled stream is aborted", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		r := newIdleTimeoutReader(&stallingReader{ctx: ctx}, cancel, 10*time.Millisecond)
+
+		_, err := r.Read(make([]byte, 10))
+		assert.ErrorContains(t, err, "download stalled, no data received for 10ms")
+		assert.ErrorIs(t, err, context.Canceled)
+	})
+
+	t.Run("slow consumer is not aborted", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		r := newIdleTimeoutReader(io.NopCloser(strings.NewReader("contents")), cancel, 10*time.Millisecond)
+
+		buf := make([]byte, 4)
+		_, err := r.Read(buf)
+		require.NoError(t, err)
+		time.Sleep(30 * time.Millisecond)
+		_, err = r.Read(buf)
+		require.NoError(t, err)
+		assert.NoError(t, ctx.Err())
+
+		require.NoError(t, r.Close())
+		assert.ErrorIs(t, ctx.Err(), context.Canceled)
+	})
+}
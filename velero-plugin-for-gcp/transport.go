@@ -0,0 +1,145 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"net/url"
+	"slices"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/storage"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"google.golang.org/api/option"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const transportConfigKey = "transport"
+
+// Transports that GCS is accessed with.
+const (
+	// transportHTTP uses the JSON API, and the XML API for reads.
+	transportHTTP = "http"
+	// transportGRPC uses the gRPC API, over DirectPath when the plugin runs in GCP.
+	transportGRPC = "grpc"
+)
+
+// parseTransport reads the transport that GCS is accessed with from the BSL config.
+func parseTransport(config map[string]string) (string, error) {
+	switch transport := strings.ToLower(config[transportConfigKey]); transport {
+	case "", transportHTTP:
+		return transportHTTP, nil
+	case transportGRPC:
+		return transportGRPC, nil
+	default:
+		return "", errors.Errorf("invalid value for %s: %q, must be %s or %s", transportConfigKey, transport, transportHTTP, transportGRPC)
+	}
+}
+
+// storeEndpointOptions returns the option to reach the storeEndpoint in config, if set,
+// with transport. gRPC endpoints are a host and port, so the scheme and path of an
+// endpoint of the JSON API are left out.
+func storeEndpointOptions(config map[string]string, transport string) []option.ClientOption {
+	endpoint, ok := config[storeEndpointConfigKey]
+	if !ok {
+		return nil
+	}
+	if transport == transportGRPC {
+		if u, err := url.Parse(endpoint); err == nil && u.Host != "" {
+			endpoint = u.Host
+			if u.Port() == "" {
+				endpoint += ":443"
+			}
+		}
+	}
+	return []option.ClientOption{option.WithEndpoint(endpoint)}
+}
+
+// newStorageClient creates a storage client with transport, reaching the storeEndpoint in
+// config if set, with the retry policy of the object store.
+func (o *ObjectStore) newStorageClient(ctx context.Context, config map[string]string, transport string, clientOptions []option.ClientOption) (*storage.Client, error) {
+	clientOptions = append(slices.Clip(clientOptions), storeEndpointOptions(config, transport)...)
+
+	var client *storage.Client
+	var err error
+	if transport == transportGRPC {
+		// Client metrics would be exported to Cloud Monitoring, which the credentials of
+		// the location needn't be allowed to write to.
+		client, err = storage.NewGRPCClient(ctx, append(clientOptions, storage.WithDisabledClientMetrics())...)
+	} else {
+		client, err = storage.NewClient(ctx, clientOptions...)
+	}
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	if len(o.retry.options) > 0 {
+		client.SetRetry(o.retry.options...)
+	}
+	return client, nil
+}
+
+// grpcProbeTimeout bounds the request that checks whether GCS can be accessed with gRPC,
+// or requestTimeout if shorter.
+var grpcProbeTimeout = 10 * time.Second
+
+// grpcSupported lists the bucket over gRPC with client, and returns false if the endpoint
+// doesn't serve the gRPC API or can't be reached with it, such as when a proxy or
+// firewall only lets HTTP/1.1 through. Other errors are left to the operations that
+// follow to report. The request isn't retried, since the client retries unavailable
+// endpoints for as long as the context allows.
+func (o *ObjectStore) grpcSupported(client *storage.Client, bucket string) bool {
+	if bucket == "" {
+		return true
+	}
+	timeout := grpcProbeTimeout
+	if o.timeouts.request > 0 {
+		timeout = min(timeout, o.timeouts.request)
+	}
+	ctx, cancel := operationContext(timeout)
+	defer cancel()
+
+	handle := bucketHandle(client, bucket, o.userProject).Retryer(storage.WithPolicy(storage.RetryNever))
+	iter := handle.Objects(ctx, &storage.Query{Prefix: o.scope.prefix})
+	iter.PageInfo().MaxSize = 1
+	_, err := iter.Next()
+	if !isGRPCUnsupported(err) {
+		return true
+	}
+	o.log.WithError(err).WithFields(logrus.Fields{"bucket": bucket, transportConfigKey: transportGRPC}).
+		Warn("GCS can't be accessed with gRPC, falling back to HTTP")
+	return false
+}
+
+// isGRPCUnsupported returns whether err, from a request over gRPC, means that the gRPC
+// API isn't available at all rather than that the request failed.
+func isGRPCUnsupported(err error) bool {
+	if errors.Is(err, context.DeadlineExceeded) {
+		return true
+	}
+	st, ok := status.FromError(err)
+	if !ok {
+		return false
+	}
+	switch st.Code() {
+	case codes.Unimplemented, codes.Unavailable, codes.DeadlineExceeded:
+		return true
+	}
+	return false
+}
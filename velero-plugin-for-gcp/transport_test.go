@@ -0,0 +1,210 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"maps"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	velerotest "github.com/vmware-tanzu/velero/pkg/test"
+	"google.golang.org/api/googleapi"
+	"google.golang.org/api/option"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestParseTransport(t *testing.T) {
+	tests := []struct {
+		name              string
+		config            map[string]string
+		expectedTransport string
+		expectedError     string
+	}{
+		{
+			name:              "HTTP by default",
+			config:            map[string]string{},
+			expectedTransport: transportHTTP,
+		},
+		{
+			name:              "gRPC",
+			config:            map[string]string{transportConfigKey: "gRPC"},
+			expectedTransport: transportGRPC,
+		},
+		{
+			name:          "invalid",
+			config:        map[string]string{transportConfigKey: "quic"},
+			expectedError: `invalid value for transport: "quic", must be http or grpc`,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			transport, err := parseTransport(tc.config)
+			if tc.expectedError != "" {
+				assert.EqualError(t, err, tc.expectedError)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tc.expectedTransport, transport)
+		})
+	}
+}
+
+func TestStoreEndpointOptions(t *testing.T) {
+	tests := []struct {
+		name            string
+		endpoint        string
+		transport       string
+		expectedOptions []option.ClientOption
+	}{
+		{
+			name:            "HTTP",
+			endpoint:        "https://storage-example.p.googleapis.com/storage/v1/",
+			transport:       transportHTTP,
+			expectedOptions: []option.ClientOption{option.WithEndpoint("https://storage-example.p.googleapis.com/storage/v1/")},
+		},
+		{
+			name:            "gRPC from a JSON API endpoint",
+			endpoint:        "https://storage-example.p.googleapis.com/storage/v1/",
+			transport:       transportGRPC,
+			expectedOptions: []option.ClientOption{option.WithEndpoint("storage-example.p.googleapis.com:443")},
+		},
+		{
+			name:            "gRPC with a port",
+			endpoint:        "http://localhost:9000",
+			transport:       transportGRPC,
+			expectedOptions: []option.ClientOption{option.WithEndpoint("localhost:9000")},
+		},
+		{
+			name:            "gRPC endpoint",
+			endpoint:        "storage-example.p.googleapis.com:443",
+			transport:       transportGRPC,
+			expectedOptions: []option.ClientOption{option.WithEndpoint("storage-example.p.googleapis.com:443")},
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			assert.Equal(t, tc.expectedOptions, storeEndpointOptions(map[string]string{storeEndpointConfigKey: tc.endpoint}, tc.transport))
+		})
+	}
+	assert.Empty(t, storeEndpointOptions(map[string]string{}, transportGRPC))
+}
+
+func TestIsGRPCUnsupported(t *testing.T) {
+	tests := []struct {
+		name     string
+		err      error
+		expected bool
+	}{
+		{name: "no error", err: nil},
+		{name: "unimplemented", err: status.Error(codes.Unimplemented, "unknown service google.storage.v2.Storage"), expected: true},
+		{name: "unavailable", err: errors.Wrap(status.Error(codes.Unavailable, "connection refused"), "listing"), expected: true},
+		{name: "timed out", err: errors.Wrap(context.DeadlineExceeded, "listing"), expected: true},
+		{name: "permission denied", err: status.Error(codes.PermissionDenied, "denied")},
+		{name: "bucket not found", err: status.Error(codes.NotFound, "no such bucket")},
+		{name: "HTTP error", err: &googleapi.Error{Code: http.StatusServiceUnavailable}},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			assert.Equal(t, tc.expected, isGRPCUnsupported(tc.err))
+		})
+	}
+}
+
+func TestInitFallsBackToHTTPWithoutGRPC(t *testing.T) {
+	tests := []struct {
+		name   string
+		config map[string]string
+	}{
+		{name: "default timeouts", config: map[string]string{}},
+		{name: "request timeout", config: map[string]string{requestTimeoutConfigKey: "2s"}},
+	}
+	// The probe isn't retried, so it fails well before its timeout.
+	defer func(timeout time.Duration) { grpcProbeTimeout = timeout }(grpcProbeTimeout)
+	grpcProbeTimeout = time.Minute
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			testInitFallsBackToHTTPWithoutGRPC(t, tc.config)
+		})
+	}
+}
+
+func testInitFallsBackToHTTPWithoutGRPC(t *testing.T, extraConfig map[string]string) {
+	var listed atomic.Int32
+	// The endpoint only serves the JSON API, over plain HTTP.
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		switch r.URL.Path {
+		case "/token":
+			json.NewEncoder(w).Encode(map[string]any{"access_token": "access-token", "token_type": "Bearer", "expires_in": 3600})
+		case "/storage/v1/b/bucket/o":
+			listed.Add(1)
+			w.Write([]byte(`{"kind": "storage#objects", "items": [{"name": "backups/b1/velero-backup.json", "bucket": "bucket"}]}`))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer srv.Close()
+
+	credentialsFile := filepath.Join(t.TempDir(), "credentials.json")
+	require.NoError(t, os.WriteFile(credentialsFile, serviceAccountKeyJSON(t, "velero@project.iam.gserviceaccount.com", srv.URL+"/token"), 0600))
+
+	config := map[string]string{
+		"bucket":                     "bucket",
+		credentialsFileConfigKey:     credentialsFile,
+		storeEndpointConfigKey:       srv.URL + "/storage/v1/",
+		transportConfigKey:           transportGRPC,
+		skipPermissionCheckConfigKey: "true",
+	}
+	maps.Copy(config, extraConfig)
+
+	o := newObjectStore(velerotest.NewLogger())
+	start := time.Now()
+	require.NoError(t, o.Init(config))
+	assert.Less(t, time.Since(start), 30*time.Second, "the gRPC probe was retried")
+	assert.Zero(t, listed.Load(), "the gRPC probe reached the JSON API")
+
+	objects, err := o.ListObjects("bucket", "backups/")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"backups/b1/velero-backup.json"}, objects)
+	assert.Equal(t, int32(1), listed.Load())
+}
+
+func TestInitUsesHTTPForObjectRetention(t *testing.T) {
+	o := newObjectStore(velerotest.NewLogger())
+	require.NoError(t, o.Init(map[string]string{
+		credentialsFileConfigKey:         writeTestCredentials(t, string(serviceAccountKeyJSON(t, "velero@project.iam.gserviceaccount.com", "https://oauth2.googleapis.com/token"))),
+		transportConfigKey:               transportGRPC,
+		objectRetentionModeConfigKey:     "Unlocked",
+		objectRetentionDurationConfigKey: "30d",
+		skipPermissionCheckConfigKey:     "true",
+	}))
+	assert.Equal(t, transportHTTP, o.transport)
+}
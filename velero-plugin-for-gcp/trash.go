@@ -0,0 +1,303 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/storage"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/pflag"
+)
+
+const (
+	softDeleteConfigKey         = "softDelete"
+	trashRetentionConfigKey     = "trashRetention"
+	trashPurgeIntervalConfigKey = "trashPurgeInterval"
+)
+
+const (
+	// trashDir is the hidden directory, under the BSL prefix, that deleted objects are
+	// moved to.
+	trashDir = ".trash"
+	// trashTimeFormat is the format of the time objects were deleted at, which names the
+	// directory of the trash they are moved to.
+	trashTimeFormat = "20060102T150405.000Z"
+
+	defaultTrashRetention     = 7 * 24 * time.Hour
+	defaultTrashPurgeInterval = time.Hour
+
+	// restoreTrashCommand is the command of the plugin binary that restores objects from
+	// the trash.
+	restoreTrashCommand = "restore-trash"
+)
+
+// trashConfig describes soft deletion, which moves deleted objects to a trash directory
+// that they can be restored from until they are purged after the retention period.
+type trashConfig struct {
+	enabled bool
+	// keyPrefix is the BSL prefix, which keys are stored relative to in the trash.
+	keyPrefix string
+	// prefix is the prefix of trashed keys, which listings skip.
+	prefix        string
+	retention     time.Duration
+	purgeInterval time.Duration
+}
+
+// parseTrashConfig reads the soft deletion settings from the BSL config. trashRetention
+// is a Go duration or a number of days such as "30d".
+func parseTrashConfig(config map[string]string) (trashConfig, error) {
+	c := trashConfig{
+		prefix:        trashDir + "/",
+		retention:     defaultTrashRetention,
+		purgeInterval: defaultTrashPurgeInterval,
+	}
+	if prefix := strings.Trim(config["prefix"], "/"); prefix != "" {
+		c.keyPrefix = prefix + "/"
+		c.prefix = c.keyPrefix + c.prefix
+	}
+
+	if value, ok := config[softDeleteConfigKey]; ok {
+		enabled, err := strconv.ParseBool(value)
+		if err != nil {
+			return c, errors.Wrapf(err, "invalid value for %s", softDeleteConfigKey)
+		}
+		c.enabled = enabled
+	}
+
+	if value, ok := config[trashRetentionConfigKey]; ok {
+		d, err := parseRetentionDuration(value)
+		if err != nil {
+			return c, errors.Wrapf(err, "invalid value for %s", trashRetentionConfigKey)
+		}
+		c.retention = d
+	}
+
+	if value, ok := config[trashPurgeIntervalConfigKey]; ok {
+		d, err := time.ParseDuration(value)
+		if err != nil {
+			return c, errors.Wrapf(err, "invalid value for %s", trashPurgeIntervalConfigKey)
+		}
+		if d <= 0 {
+			return c, errors.Errorf("invalid value for %s: %s must be positive", trashPurgeIntervalConfigKey, value)
+		}
+		c.purgeInterval = d
+	}
+	return c, nil
+}
+
+// trashKey returns the key that the object at key is moved to when it is deleted at
+// now, or false if key isn't under the BSL prefix.
+func (c trashConfig) trashKey(key string, now time.Time) (string, bool) {
+	rel, ok := relativeKey(c.keyPrefix, key)
+	if !ok || c.isTrash(key) {
+		return "", false
+	}
+	return c.prefix + now.UTC().Format(trashTimeFormat) + "/" + rel, true
+}
+
+// parseTrashKey returns the key that the object trashed at name was deleted from, and
+// when it was deleted.
+func (c trashConfig) parseTrashKey(name string) (string, time.Time, bool) {
+	rest, ok := strings.CutPrefix(name, c.prefix)
+	if !ok {
+		return "", time.Time{}, false
+	}
+	stamp, rel, ok := strings.Cut(rest, "/")
+	if !ok || rel == "" {
+		return "", time.Time{}, false
+	}
+	deleted, err := time.Parse(trashTimeFormat, stamp)
+	if err != nil {
+		return "", time.Time{}, false
+	}
+	return c.keyPrefix + rel, deleted, true
+}
+
+// isTrash returns whether name is, or is a directory of, trashed keys.
+func (c trashConfig) isTrash(name string) bool {
+	if c.prefix == "" {
+		return false
+	}
+	return strings.HasPrefix(name, c.prefix) || name == strings.TrimSuffix(c.prefix, "/")
+}
+
+// trashObject moves the current version of the object at key to the trash with a
+// server-side copy. Only that version is deleted, as with a plain deletion, so that the
+// bucket's object versioning or soft delete policy still applies to it.
+func (o *ObjectStore) trashObject(ctx context.Context, bucket, key string) error {
+	trashKey, ok := o.trash.trashKey(key, time.Now())
+	if !ok {
+		// Velero only writes under the BSL prefix.
+		return o.bucketHandle(bucket).Object(key).Delete(ctx)
+	}
+
+	attrs, err := o.bucketWriter.getAttrs(ctx, bucket, key)
+	if err != nil {
+		return err
+	}
+	trashed, err := o.bucketWriter.copyGeneration(ctx, bucket, key, attrs.Generation, trashKey, storage.Conditions{DoesNotExist: true})
+	if err != nil {
+		return errors.WithMessagef(err, "error moving it to %s", trashKey)
+	}
+
+	if err := o.bucketWriter.deleteIf(ctx, bucket, key, storage.Conditions{GenerationMatch: attrs.Generation}); err != nil {
+		// The object wasn't deleted, so it mustn't be restorable over a later version.
+		if deleteErr := o.bucketWriter.deleteGeneration(ctx, bucket, trashed.Name, trashed.Generation); deleteErr != nil {
+			o.log.WithError(deleteErr).WithField("key", trashed.Name).Error("Error deleting the trashed copy of an object that failed to be deleted")
+		}
+		return err
+	}
+	o.log.WithFields(logrus.Fields{"key": key, "trashKey": trashKey}).Debug("Moved object to the trash")
+	return nil
+}
+
+// purgeTrash deletes the objects that were moved to the trash longer than the retention
+// period ago, and returns the number deleted.
+func (o *ObjectStore) purgeTrash(ctx context.Context, bucket string, now time.Time) int {
+	ctx, cancel := withOperationTimeout(ctx, o.timeouts.list)
+	defer cancel()
+
+	log := o.log.WithFields(logrus.Fields{"bucket": bucket, "prefix": o.trash.prefix})
+	objects, err := o.bucketWriter.listObjects(ctx, bucket, o.trash.prefix)
+	if err != nil {
+		log.WithError(classifyError(err)).Warn("Error listing trashed objects to purge")
+		return 0
+	}
+
+	var purged int
+	for _, attrs := range objects {
+		if attrs.Name == o.trash.prefix+sweepMarker {
+			continue
+		}
+		_, deleted, ok := o.trash.parseTrashKey(attrs.Name)
+		if !ok {
+			deleted = attrs.Created
+		}
+		if now.Sub(deleted) < o.trash.retention {
+			continue
+		}
+		err := o.bucketWriter.deleteIf(ctx, bucket, attrs.Name, storage.Conditions{GenerationMatch: attrs.Generation})
+		if err != nil && !errors.Is(err, storage.ErrObjectNotExist) {
+			log.WithError(classifyError(err)).WithField("key", attrs.Name).Warn("Error purging trashed object")
+			continue
+		}
+		purged++
+	}
+	if purged > 0 {
+		log.WithField("count", purged).Info("Purged trashed objects")
+	}
+	return purged
+}
+
+// restoreTrash moves the trashed objects whose keys, relative to the BSL prefix, start
+// with keyPrefix back to their keys, and returns the keys restored. An object trashed
+// more than once is restored to its latest version. Objects whose key has been written
+// again since are left in the trash.
+func (o *ObjectStore) restoreTrash(bucket, keyPrefix string) ([]string, error) {
+	ctx, cancel := operationContext(o.timeouts.list)
+	defer cancel()
+
+	objects, err := o.bucketWriter.listObjects(ctx, bucket, o.trash.prefix)
+	if err != nil {
+		return nil, wrapErrorf(err, "error listing the trash of bucket %s", bucket)
+	}
+
+	type trashed struct {
+		attrs   *storage.ObjectAttrs
+		deleted time.Time
+	}
+	latest := map[string]trashed{}
+	for _, attrs := range objects {
+		key, deleted, ok := o.trash.parseTrashKey(attrs.Name)
+		if !ok || !strings.HasPrefix(strings.TrimPrefix(key, o.trash.keyPrefix), keyPrefix) {
+			continue
+		}
+		if t, ok := latest[key]; !ok || deleted.After(t.deleted) {
+			latest[key] = trashed{attrs: attrs, deleted: deleted}
+		}
+	}
+	keys := make([]string, 0, len(latest))
+	for key := range latest {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	var restored []string
+	for _, key := range keys {
+		attrs := latest[key].attrs
+		_, err := o.bucketWriter.copyGeneration(ctx, bucket, attrs.Name, attrs.Generation, key, storage.Conditions{DoesNotExist: true})
+		if isPreconditionFailed(err) {
+			o.log.WithFields(logrus.Fields{"key": key, "trashKey": attrs.Name}).Warn("Object exists again, leaving its trashed version in the trash")
+			continue
+		}
+		if err != nil {
+			return restored, wrapErrorf(err, "error restoring %s from %s", key, attrs.Name)
+		}
+		restored = append(restored, key)
+
+		if err := o.bucketWriter.deleteIf(ctx, bucket, attrs.Name, storage.Conditions{GenerationMatch: attrs.Generation}); err != nil {
+			o.log.WithError(classifyError(err)).WithField("key", attrs.Name).Warn("Error deleting restored object from the trash, it will be purged later")
+		}
+	}
+	return restored, nil
+}
+
+// runRestoreTrash restores trashed objects of a backup storage location from the command
+// line, printing the keys restored to out. Other settings of the location, such as the
+// credentials file, are passed with --config.
+func runRestoreTrash(args []string, out io.Writer) error {
+	flags := pflag.NewFlagSet(restoreTrashCommand, pflag.ContinueOnError)
+	bucket := flags.String("bucket", "", "bucket of the backup storage location")
+	prefix := flags.String("prefix", "", "prefix of the backup storage location")
+	config := flags.StringToString("config", map[string]string{}, "other settings of the backup storage location, as key=value pairs")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if *bucket == "" || flags.NArg() == 0 {
+		return errors.Errorf("usage: %s --bucket BUCKET [--prefix PREFIX] [--config key=value,...] KEY_PREFIX...", restoreTrashCommand)
+	}
+
+	(*config)["bucket"] = *bucket
+	if *prefix != "" {
+		(*config)["prefix"] = *prefix
+	}
+	// Don't purge the trash while restoring from it.
+	delete(*config, softDeleteConfigKey)
+
+	o := newObjectStore(logrus.New())
+	if err := o.Init(*config); err != nil {
+		return err
+	}
+	for _, keyPrefix := range flags.Args() {
+		restored, err := o.restoreTrash(*bucket, keyPrefix)
+		for _, key := range restored {
+			fmt.Fprintln(out, key)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
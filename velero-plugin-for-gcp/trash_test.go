@@ -0,0 +1,216 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	velerotest "github.com/vmware-tanzu/velero/pkg/test"
+)
+
+func TestParseTrashConfig(t *testing.T) {
+	tests := []struct {
+		name           string
+		config         map[string]string
+		expectedConfig trashConfig
+		expectedError  string
+	}{
+		{
+			name:   "disabled by default",
+			config: map[string]string{},
+			expectedConfig: trashConfig{
+				prefix:        ".trash/",
+				retention:     defaultTrashRetention,
+				purgeInterval: defaultTrashPurgeInterval,
+			},
+		},
+		{
+			name: "all settings under a prefix",
+			config: map[string]string{
+				"prefix":                    "cluster-a/",
+				softDeleteConfigKey:         "true",
+				trashRetentionConfigKey:     "30d",
+				trashPurgeIntervalConfigKey: "10m",
+			},
+			expectedConfig: trashConfig{
+				enabled:       true,
+				keyPrefix:     "cluster-a/",
+				prefix:        "cluster-a/.trash/",
+				retention:     30 * 24 * time.Hour,
+				purgeInterval: 10 * time.Minute,
+			},
+		},
+		{
+			name:          "invalid boolean",
+			config:        map[string]string{softDeleteConfigKey: "sometimes"},
+			expectedError: `invalid value for softDelete: strconv.ParseBool: parsing "sometimes": invalid syntax`,
+		},
+		{
+			name:          "invalid retention",
+			config:        map[string]string{trashRetentionConfigKey: "0d"},
+			expectedError: "invalid value for trashRetention: 0d must be positive",
+		},
+		{
+			name:          "invalid purge interval",
+			config:        map[string]string{trashPurgeIntervalConfigKey: "-1h"},
+			expectedError: "invalid value for trashPurgeInterval: -1h must be positive",
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			config, err := parseTrashConfig(tc.config)
+			if tc.expectedError != "" {
+				assert.EqualError(t, err, tc.expectedError)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tc.expectedConfig, config)
+		})
+	}
+}
+
+func TestTrashKeys(t *testing.T) {
+	c := trashConfig{keyPrefix: "cluster-a/", prefix: "cluster-a/.trash/"}
+	deleted := time.Date(2026, 3, 14, 15, 9, 26, 535e6, time.UTC)
+
+	trashKey, ok := c.trashKey("cluster-a/backups/b1/b1.tar.gz", deleted)
+	require.True(t, ok)
+	assert.Equal(t, "cluster-a/.trash/20260314T150926.535Z/backups/b1/b1.tar.gz", trashKey)
+	assert.True(t, c.isTrash(trashKey))
+
+	key, at, ok := c.parseTrashKey(trashKey)
+	require.True(t, ok)
+	assert.Equal(t, "cluster-a/backups/b1/b1.tar.gz", key)
+	assert.True(t, deleted.Equal(at))
+
+	_, ok = c.trashKey("cluster-b/backups/b1/b1.tar.gz", deleted)
+	assert.False(t, ok)
+	_, ok = c.trashKey(trashKey, deleted)
+	assert.False(t, ok)
+	_, _, ok = c.parseTrashKey("cluster-a/.trash/not-a-time/backups/b1/b1.tar.gz")
+	assert.False(t, ok)
+
+	assert.True(t, c.isTrash("cluster-a/.trash/"))
+	assert.False(t, c.isTrash("cluster-a/.trash-not/"))
+	assert.False(t, trashConfig{}.isTrash("backups/"))
+}
+
+func newTestSoftDeleteObjectStore(bucket *memoryBucket) *ObjectStore {
+	o := newObjectStore(velerotest.NewLogger())
+	o.bucketWriter = bucket
+	o.trash = trashConfig{enabled: true, prefix: ".trash/", retention: time.Hour}
+	return o
+}
+
+func TestDeleteObjectMovesToTrash(t *testing.T) {
+	bucket := newMemoryBucket()
+	_, err := bucket.put("backups/b1/b1.tar.gz", []byte("backup contents"), writeOptions{metadata: map[string]string{"cluster": "prod-east"}})
+	require.NoError(t, err)
+	o := newTestSoftDeleteObjectStore(bucket)
+
+	require.NoError(t, o.DeleteObject("bucket", "backups/b1/b1.tar.gz"))
+
+	keys := bucket.keys()
+	require.Len(t, keys, 1)
+	key, _, ok := o.trash.parseTrashKey(keys[0])
+	require.True(t, ok)
+	assert.Equal(t, "backups/b1/b1.tar.gz", key)
+	assert.Equal(t, "backup contents", string(bucket.data(keys[0])))
+	attrs, err := bucket.getAttrs(context.Background(), "bucket", keys[0])
+	require.NoError(t, err)
+	assert.Equal(t, "prod-east", attrs.Metadata["cluster"])
+}
+
+func TestDeleteObjectTrashFailureKeepsObject(t *testing.T) {
+	bucket := newMemoryBucket()
+	_, err := bucket.put("backups/b1/b1.tar.gz", []byte("backup contents"), writeOptions{})
+	require.NoError(t, err)
+	o := newTestSoftDeleteObjectStore(bucket)
+	bucket.failKeys = func(key string) bool { return key == "backups/b1/b1.tar.gz" }
+
+	assert.EqualError(t, o.DeleteObject("bucket", "backups/b1/b1.tar.gz"), "error deleting object backups/b1/b1.tar.gz: delete failed")
+	assert.Equal(t, []string{"backups/b1/b1.tar.gz"}, bucket.keys())
+}
+
+func TestPurgeTrash(t *testing.T) {
+	bucket := newMemoryBucket()
+	o := newTestSoftDeleteObjectStore(bucket)
+	now := time.Now()
+
+	old, _ := o.trash.trashKey("backups/b1/b1.tar.gz", now.Add(-2*time.Hour))
+	recent, _ := o.trash.trashKey("backups/b2/b2.tar.gz", now.Add(-time.Minute))
+	for _, key := range []string{".trash/.last-sweep", old, recent, "backups/b3/b3.tar.gz"} {
+		_, err := bucket.put(key, []byte(key), writeOptions{})
+		require.NoError(t, err)
+	}
+	bucket.objects[".trash/.last-sweep"].attrs.Created = now.Add(-2 * time.Hour)
+
+	ctx := context.Background()
+	assert.Equal(t, 1, o.purgeTrash(ctx, "bucket", now))
+	assert.Equal(t, []string{".trash/.last-sweep", recent, "backups/b3/b3.tar.gz"}, bucket.keys())
+
+	assert.Equal(t, 1, o.purgeTrash(ctx, "bucket", now.Add(time.Hour)))
+	assert.Equal(t, []string{".trash/.last-sweep", "backups/b3/b3.tar.gz"}, bucket.keys())
+}
+
+func TestRestoreTrash(t *testing.T) {
+	bucket := newMemoryBucket()
+	o := newTestSoftDeleteObjectStore(bucket)
+	now := time.Now()
+
+	trash := func(key, data string, deleted time.Time) string {
+		trashKey, ok := o.trash.trashKey(key, deleted)
+		require.True(t, ok)
+		_, err := bucket.put(trashKey, []byte(data), writeOptions{})
+		require.NoError(t, err)
+		return trashKey
+	}
+	trash("backups/b1/b1.tar.gz", "first version", now.Add(-time.Hour))
+	trash("backups/b1/b1.tar.gz", "second version", now.Add(-time.Minute))
+	trash("backups/b1/velero-backup.json", "backup", now.Add(-time.Minute))
+	rewritten := trash("backups/b1/b1-logs.gz", "logs", now.Add(-time.Minute))
+	other := trash("backups/b10/b10.tar.gz", "other backup", now.Add(-time.Minute))
+	_, err := bucket.put("backups/b1/b1-logs.gz", []byte("new logs"), writeOptions{})
+	require.NoError(t, err)
+
+	restored, err := o.restoreTrash("bucket", "backups/b1/")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"backups/b1/b1.tar.gz", "backups/b1/velero-backup.json"}, restored)
+
+	assert.Equal(t, "second version", string(bucket.data("backups/b1/b1.tar.gz")))
+	assert.Equal(t, "backup", string(bucket.data("backups/b1/velero-backup.json")))
+	assert.Equal(t, "new logs", string(bucket.data("backups/b1/b1-logs.gz")))
+
+	var trashed []string
+	for _, key := range bucket.keys() {
+		if o.trash.isTrash(key) {
+			trashed = append(trashed, key)
+		}
+	}
+	// Older versions are left to be purged.
+	require.Len(t, trashed, 3)
+	assert.Contains(t, trashed, rewritten)
+	assert.Contains(t, trashed, other)
+	for _, key := range trashed {
+		assert.False(t, strings.HasSuffix(key, "/velero-backup.json"))
+	}
+}
@@ -20,17 +20,16 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
-	"net/http"
-	"os"
 	"regexp"
 	"strings"
+	"time"
 
 	uuid "github.com/gofrs/uuid"
 	"github.com/pkg/errors"
 	"github.com/sirupsen/logrus"
 	"golang.org/x/oauth2/google"
+	"google.golang.org/api/cloudresourcemanager/v1"
 	"google.golang.org/api/compute/v1"
-	"google.golang.org/api/googleapi"
 	"google.golang.org/api/option"
 	v1 "k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
@@ -61,13 +60,29 @@ type VolumeSnapshotter struct {
 	volumeProject    string
 	snapshotProject  string
 	snapshotType     string
+	// reload, if not nil, holds the volume snapshotter with the compute client built
+	// from the current contents of the credentials files.
+	reload *reloader[VolumeSnapshotter]
 }
 
 func newVolumeSnapshotter(logger logrus.FieldLogger) *VolumeSnapshotter {
 	return &VolumeSnapshotter{log: logger}
 }
 
+// active returns the volume snapshotter to run an operation with, whose compute client
+// uses the latest credentials.
+func (b *VolumeSnapshotter) active() *VolumeSnapshotter {
+	if b.reload == nil {
+		return b
+	}
+	return b.reload.active()
+}
+
 func (b *VolumeSnapshotter) Init(config map[string]string) error {
+	// The volume snapshotter may be initialized again with another config.
+	b.reload.stop()
+	b.reload = nil
+
 	if err := veleroplugin.ValidateVolumeSnapshotterConfigKeys(
 		config,
 		snapshotLocationKey,
@@ -75,39 +90,32 @@ func (b *VolumeSnapshotter) Init(config map[string]string) error {
 		projectKey,
 		credentialsFileConfigKey,
 		volumeProjectKey,
+		skipPermissionCheckConfigKey,
+		impersonateServiceAccountConfigKey,
+		impersonateDelegatesConfigKey,
+		quotaProjectConfigKey,
+		credentialsReloadIntervalConfigKey,
+		credentialsBase64ConfigKey,
+		credentialsSecretVersionConfigKey,
+		secretManagerEndpointConfigKey,
 	); err != nil {
 		return err
 	}
 
-	clientOptions := []option.ClientOption{
-		option.WithScopes(compute.ComputeScope),
+	checkPermissions, err := permissionCheckEnabled(config)
+	if err != nil {
+		return err
 	}
 
-	// Credentials used to connect to GCP compute service.
-	var creds *google.Credentials
-	var err error
-
-	// If credential is provided for the VSL, use it instead of default credential.
-	if credentialsFile, ok := config[credentialsFileConfigKey]; ok {
-		b, err := os.ReadFile(credentialsFile)
-		if err != nil {
-			return errors.Wrapf(err, "error reading provided credentials file %v", credentialsFile)
-		}
-
-		creds, err = google.CredentialsFromJSON(context.TODO(), b)
-		if err != nil {
-			return errors.WithStack(err)
-		}
+	reloadInterval, err := parseCredentialsReloadInterval(config)
+	if err != nil {
+		return err
+	}
+	watcher := newCredentialsWatcher(credentialsPaths(config), reloadInterval, time.Now())
 
-		// If using a credentials file, we also need to pass it when creating the client.
-		clientOptions = append(clientOptions, option.WithCredentialsFile(credentialsFile))
-	} else {
-		/* Use default credential, when no credential is provisioned in VSL. */
-		creds, err = google.FindDefaultCredentials(context.TODO(), compute.ComputeScope)
-		if err != nil {
-			return errors.WithStack(err)
-		}
-		clientOptions = append(clientOptions, option.WithTokenSource(creds.TokenSource))
+	clientOptions, permissionCheckOptions, creds, err := computeClientOptions(b.log, config)
+	if err != nil {
+		return err
 	}
 
 	b.snapshotLocation = config[snapshotLocationKey]
@@ -143,6 +151,106 @@ func (b *VolumeSnapshotter) Init(config map[string]string) error {
 
 	b.gce = gce
 
+	if reloadInterval > 0 {
+		// The client is rebuilt on a copy, so that operations in flight keep theirs. The
+		// projects stay those the snapshotter was initialized with.
+		b.reload = newReloader(b.log, watcher, b, func(current *VolumeSnapshotter) (*VolumeSnapshotter, error) {
+			clientOptions, _, _, err := computeClientOptions(current.log, config)
+			if err != nil {
+				return nil, err
+			}
+			fresh := *current
+			if fresh.gce, err = compute.NewService(context.TODO(), clientOptions...); err != nil {
+				return nil, errors.WithStack(err)
+			}
+			return &fresh, nil
+		}, nil)
+	}
+
+	if checkPermissions {
+		return b.checkPermissions(permissionCheckOptions...)
+	}
+	return nil
+}
+
+// computeClientOptions returns the options of the compute client and of the project
+// permission check, which carry the credentials of the location, and those credentials.
+func computeClientOptions(log logrus.FieldLogger, config map[string]string) ([]option.ClientOption, []option.ClientOption, *google.Credentials, error) {
+	clientOptions := []option.ClientOption{
+		option.WithScopes(compute.ComputeScope),
+	}
+	// The project permission check goes through the Resource Manager API, which the
+	// compute scope doesn't cover.
+	permissionCheckOptions := []option.ClientOption{
+		option.WithScopes(cloudresourcemanager.CloudPlatformReadOnlyScope),
+	}
+
+	// Credentials used to connect to GCP compute service.
+	var creds *google.Credentials
+	// Options carrying the credentials to authenticate with, before any impersonation.
+	var baseOptions []option.ClientOption
+
+	// If credential is provided for the VSL, use it instead of default credential.
+	credsJSON, err := credentialsJSON(context.TODO(), log, config)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	if credsJSON != nil {
+		creds, err = google.CredentialsFromJSON(context.TODO(), credsJSON)
+		if err != nil {
+			return nil, nil, nil, errors.WithStack(err)
+		}
+
+		// If using credentials from the config, we also need to pass them when creating the client.
+		baseOptions = append(baseOptions, option.WithCredentialsJSON(credsJSON))
+	} else {
+		/* Use default credential, when no credential is provisioned in VSL. */
+		creds, err = google.FindDefaultCredentials(context.TODO(), compute.ComputeScope)
+		if err != nil {
+			return nil, nil, nil, errors.WithStack(err)
+		}
+	}
+
+	// When impersonating, both the compute client and the permission check run as the
+	// impersonated service account.
+	ts, err := impersonatedTokenSource(context.TODO(), config, []string{compute.ComputeScope}, baseOptions...)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	if ts != nil {
+		clientOptions = append(clientOptions, option.WithTokenSource(ts))
+
+		checkTS, err := impersonatedTokenSource(context.TODO(), config, []string{cloudresourcemanager.CloudPlatformReadOnlyScope}, baseOptions...)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		permissionCheckOptions = append(permissionCheckOptions, option.WithTokenSource(checkTS))
+	} else if len(baseOptions) > 0 {
+		clientOptions = append(clientOptions, baseOptions...)
+		permissionCheckOptions = append(permissionCheckOptions, baseOptions...)
+	} else {
+		clientOptions = append(clientOptions, option.WithTokenSource(creds.TokenSource))
+	}
+
+	// API quota is charged to quotaProject rather than to the project of the credentials.
+	clientOptions = append(clientOptions, quotaProjectOptions(config)...)
+	permissionCheckOptions = append(permissionCheckOptions, quotaProjectOptions(config)...)
+	return clientOptions, permissionCheckOptions, creds, nil
+}
+
+// checkPermissions verifies up front that the identity in use holds the permissions the
+// volume snapshotter needs, so a misconfigured VSL fails immediately rather than
+// failing the first backup.
+func (b *VolumeSnapshotter) checkPermissions(clientOptions ...option.ClientOption) error {
+	required := map[string][]string{}
+	required[b.volumeProject] = append(required[b.volumeProject], volumeProjectPermissions...)
+	required[b.snapshotProject] = append(required[b.snapshotProject], snapshotProjectPermissions...)
+
+	for project, permissions := range required {
+		if err := checkProjectPermissions(context.TODO(), project, permissions, clientOptions...); err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
@@ -186,7 +294,7 @@ func (b *VolumeSnapshotter) getZoneURLs(volumeAZ string) ([]string, error) {
 	for _, z := range zones {
 		zone, err := b.gce.Zones.Get(b.volumeProject, z).Do()
 		if err != nil {
-			return nil, errors.WithStack(err)
+			return nil, wrapError(err)
 		}
 
 		zoneURLs = append(zoneURLs, zone.SelfLink)
@@ -196,10 +304,11 @@ func (b *VolumeSnapshotter) getZoneURLs(volumeAZ string) ([]string, error) {
 }
 
 func (b *VolumeSnapshotter) CreateVolumeFromSnapshot(snapshotID, volumeType, volumeAZ string, iops *int64) (volumeID string, err error) {
+	b = b.active()
 	// get the snapshot so we can apply its tags to the volume
 	res, err := b.gce.Snapshots.Get(b.snapshotProject, snapshotID).Do()
 	if err != nil {
-		return "", errors.WithStack(err)
+		return "", wrapError(err)
 	}
 
 	// Kubernetes uses the description field of GCP disks to store a JSON doc containing
@@ -234,11 +343,11 @@ func (b *VolumeSnapshotter) CreateVolumeFromSnapshot(snapshotID, volumeType, vol
 		disk.ReplicaZones = zoneURLs
 
 		if _, err = b.gce.RegionDisks.Insert(b.volumeProject, volumeRegion, disk).Do(); err != nil {
-			return "", errors.WithStack(err)
+			return "", wrapError(err)
 		}
 	} else {
 		if _, err = b.gce.Disks.Insert(b.volumeProject, volumeAZ, disk).Do(); err != nil {
-			return "", errors.WithStack(err)
+			return "", wrapError(err)
 		}
 	}
 
@@ -246,6 +355,7 @@ func (b *VolumeSnapshotter) CreateVolumeFromSnapshot(snapshotID, volumeType, vol
 }
 
 func (b *VolumeSnapshotter) GetVolumeInfo(volumeID, volumeAZ string) (string, *int64, error) {
+	b = b.active()
 	var (
 		res *compute.Disk
 		err error
@@ -258,18 +368,19 @@ func (b *VolumeSnapshotter) GetVolumeInfo(volumeID, volumeAZ string) (string, *i
 		}
 		res, err = b.gce.RegionDisks.Get(b.volumeProject, volumeRegion, volumeID).Do()
 		if err != nil {
-			return "", nil, errors.WithStack(err)
+			return "", nil, wrapError(err)
 		}
 	} else {
 		res, err = b.gce.Disks.Get(b.volumeProject, volumeAZ, volumeID).Do()
 		if err != nil {
-			return "", nil, errors.WithStack(err)
+			return "", nil, wrapError(err)
 		}
 	}
 	return res.Type, nil, nil
 }
 
 func (b *VolumeSnapshotter) CreateSnapshot(volumeID, volumeAZ string, tags map[string]string) (string, error) {
+	b = b.active()
 	// snapshot names must adhere to RFC1035 and be 1-63 characters
 	// long
 	var snapshotName string
@@ -284,7 +395,7 @@ func (b *VolumeSnapshotter) CreateSnapshot(volumeID, volumeAZ string, tags map[s
 	// won't get created.
 	p, err := b.gce.Projects.Get(b.volumeProject).Do()
 	if err != nil {
-		return "", errors.WithStack(err)
+		return "", wrapError(err)
 	}
 
 	for _, quota := range p.Quotas {
@@ -317,7 +428,7 @@ func (b *VolumeSnapshotter) CreateSnapshot(volumeID, volumeAZ string, tags map[s
 func (b *VolumeSnapshotter) createSnapshot(snapshotName, volumeID, volumeAZ string, tags map[string]string) (string, error) {
 	disk, err := b.gce.Disks.Get(b.volumeProject, volumeAZ, volumeID).Do()
 	if err != nil {
-		return "", errors.WithStack(err)
+		return "", wrapError(err)
 	}
 
 	snapshot := &compute.Snapshot{
@@ -343,10 +454,10 @@ func (b *VolumeSnapshotter) createSnapshot(snapshotName, volumeID, volumeAZ stri
 		snapshot.Labels = nil
 		_, err = b.gce.Snapshots.Insert(b.snapshotProject, snapshot).Do()
 		if err != nil {
-			return "", errors.WithStack(err)
+			return "", wrapError(err)
 		}
 	} else if err != nil {
-		return "", errors.WithStack(err)
+		return "", wrapError(err)
 	}
 
 	return snapshot.Name, nil
@@ -355,7 +466,7 @@ func (b *VolumeSnapshotter) createSnapshot(snapshotName, volumeID, volumeAZ stri
 func (b *VolumeSnapshotter) createRegionSnapshot(snapshotName, volumeID, volumeRegion string, tags map[string]string) (string, error) {
 	disk, err := b.gce.RegionDisks.Get(b.volumeProject, volumeRegion, volumeID).Do()
 	if err != nil {
-		return "", errors.WithStack(err)
+		return "", wrapError(err)
 	}
 
 	gceSnap := compute.Snapshot{
@@ -372,7 +483,7 @@ func (b *VolumeSnapshotter) createRegionSnapshot(snapshotName, volumeID, volumeR
 
 	_, err = b.gce.Snapshots.Insert(b.snapshotProject, &gceSnap).Do()
 	if err != nil {
-		return "", errors.WithStack(err)
+		return "", wrapError(err)
 	}
 
 	return gceSnap.Name, nil
@@ -417,16 +528,17 @@ func getSnapshotTags(veleroTags map[string]string, diskDescription string, log l
 }
 
 func (b *VolumeSnapshotter) DeleteSnapshot(snapshotID string) error {
+	b = b.active()
 
 	_, err := b.gce.Snapshots.Delete(b.snapshotProject, snapshotID).Do()
 
 	// if it's a 404 (not found) error, we don't need to return an error
 	// since the snapshot is not there.
-	if gcpErr, ok := err.(*googleapi.Error); ok && gcpErr.Code == http.StatusNotFound {
+	if isErrorCategory(err, errorCategoryNotFound) {
 		return nil
 	}
 	if err != nil {
-		return errors.WithStack(err)
+		return wrapError(err)
 	}
 
 	return nil
@@ -514,15 +626,8 @@ func (b *VolumeSnapshotter) IsVolumeCreatedCrossProjects(volumeHandle string) bo
 	return false
 }
 
-// isLabelPermissionError Helper function to detect label permission errors
+// isLabelPermissionError reports whether err was caused by the missing
+// compute.snapshots.setLabels permission.
 func isLabelPermissionError(err error) bool {
-	if err == nil {
-		return false
-	}
-
-	// Check for specific GCP permission error
-	// This might need adjustment based on actual error format
-	errStr := err.Error()
-	return strings.Contains(errStr, "compute.snapshots.setLabels") ||
-		(strings.Contains(errStr, "permission") && strings.Contains(errStr, "label"))
+	return isMissingPermission(err, "compute.snapshots.setLabels")
 }
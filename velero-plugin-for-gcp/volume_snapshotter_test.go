@@ -442,10 +442,11 @@ func TestInit(t *testing.T) {
 		{
 			name: "Init with Credential files.",
 			config: map[string]string{
-				"project":          "project-a",
-				"credentialsFile":  credential_file_name,
-				"snapshotLocation": "default",
-				"volumeProject":    "project-b",
+				"project":             "project-a",
+				"credentialsFile":     credential_file_name,
+				"snapshotLocation":    "default",
+				"volumeProject":       "project-b",
+				"skipPermissionCheck": "true",
 			},
 			expectedVolumeSnapshotter: VolumeSnapshotter{
 				snapshotLocation: "default",
@@ -457,10 +458,11 @@ func TestInit(t *testing.T) {
 		{
 			name: "Init without Credential files.",
 			config: map[string]string{
-				"project":          "project-a",
-				"snapshotLocation": "default",
-				"snapshotType":     "standard",
-				"volumeProject":    "project-b",
+				"project":             "project-a",
+				"snapshotLocation":    "default",
+				"snapshotType":        "standard",
+				"volumeProject":       "project-b",
+				"skipPermissionCheck": "true",
 			},
 			expectedVolumeSnapshotter: VolumeSnapshotter{
 				snapshotLocation: "default",
@@ -472,10 +474,11 @@ func TestInit(t *testing.T) {
 		{
 			name: "Init with archive snapshot type.",
 			config: map[string]string{
-				"project":          "project-a",
-				"snapshotLocation": "default",
-				"snapshotType":     "archive",
-				"volumeProject":    "project-b",
+				"project":             "project-a",
+				"snapshotLocation":    "default",
+				"snapshotType":        "archive",
+				"volumeProject":       "project-b",
+				"skipPermissionCheck": "true",
 			},
 			expectedVolumeSnapshotter: VolumeSnapshotter{
 				snapshotLocation: "default",
@@ -484,6 +487,21 @@ func TestInit(t *testing.T) {
 				snapshotType:     "ARCHIVE",
 			},
 		},
+		{
+			name: "Init with impersonation.",
+			config: map[string]string{
+				"project":                   "project-a",
+				"credentialsFile":           credential_file_name,
+				"volumeProject":             "project-b",
+				"impersonateServiceAccount": "target@project-a.iam.gserviceaccount.com",
+				"skipPermissionCheck":       "true",
+			},
+			expectedVolumeSnapshotter: VolumeSnapshotter{
+				volumeProject:   "project-b",
+				snapshotProject: "project-a",
+				snapshotType:    "STANDARD",
+			},
+		},
 	}
 
 	for _, test := range tests {
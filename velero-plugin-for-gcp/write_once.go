@@ -0,0 +1,152 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+
+	"cloud.google.com/go/storage"
+	"github.com/pkg/errors"
+	"google.golang.org/api/googleapi"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	writeOnceConfigKey   = "writeOnce"
+	mutableKeysConfigKey = "mutableKeys"
+)
+
+// defaultMutableKeys are the keys, relative to the BSL prefix, that Velero rewrites: the
+// backup store revision, and the files of a backup or restore that are uploaded again
+// when it is finalized.
+var defaultMutableKeys = []string{
+	"metadata/revision",
+	"backups/*/velero-backup.json",
+	"backups/*/*.tar.gz",
+	"backups/*/*-itemoperations.json.gz",
+	"backups/*/*-results.gz",
+	"backups/*/*-volumeinfo.json.gz",
+	"restores/*/*-itemoperations.json.gz",
+	"restores/*/*-results.gz",
+}
+
+// writeOnceConfig describes write-once protection, which prevents uploads from
+// overwriting existing objects, except at keys Velero is known to rewrite.
+type writeOnceConfig struct {
+	enabled bool
+	// prefix is the BSL prefix, which patterns are relative to.
+	prefix string
+	// mutable are the patterns of the keys that may be overwritten.
+	mutable []string
+}
+
+// parseWriteOnceConfig reads the write-once settings from the BSL config. mutableKeys
+// replaces the default mutable keys with comma-separated patterns.
+func parseWriteOnceConfig(config map[string]string) (writeOnceConfig, error) {
+	c := writeOnceConfig{prefix: config["prefix"], mutable: defaultMutableKeys}
+
+	if value, ok := config[writeOnceConfigKey]; ok {
+		enabled, err := strconv.ParseBool(value)
+		if err != nil {
+			return c, errors.Wrapf(err, "invalid value for %s", writeOnceConfigKey)
+		}
+		c.enabled = enabled
+	}
+
+	if value, ok := config[mutableKeysConfigKey]; ok {
+		c.mutable = nil
+		for _, pattern := range strings.Split(value, ",") {
+			if pattern = strings.Trim(strings.TrimSpace(pattern), "/"); pattern == "" {
+				continue
+			}
+			if _, err := path.Match(pattern, ""); err != nil {
+				return c, errors.Wrapf(err, "invalid %s pattern %q", mutableKeysConfigKey, pattern)
+			}
+			c.mutable = append(c.mutable, pattern)
+		}
+	}
+	return c, nil
+}
+
+// isMutable returns whether the object at key may be overwritten.
+func (c writeOnceConfig) isMutable(key string) bool {
+	key, ok := relativeKey(c.prefix, key)
+	if !ok {
+		return false
+	}
+	for _, pattern := range c.mutable {
+		if keyMatches(pattern, key) {
+			return true
+		}
+	}
+	return false
+}
+
+// writeConflictError is returned when an upload is rejected because the object isn't at
+// the generation the upload was conditional on.
+type writeConflictError struct {
+	key string
+	// expected is the generation the upload required, or 0 if it required no object.
+	expected int64
+	// found is the generation of the object, or 0 if it isn't known.
+	found int64
+}
+
+func (e *writeConflictError) Error() string {
+	expected := "no object"
+	if e.expected != 0 {
+		expected = fmt.Sprintf("generation %d", e.expected)
+	}
+	found := "a different version"
+	if e.found != 0 {
+		found = fmt.Sprintf("generation %d", e.found)
+	}
+	return fmt.Sprintf("write conflict on object %s: expected %s, found %s; another Velero installation may be writing to the same bucket and prefix",
+		e.key, expected, found)
+}
+
+// isPreconditionFailed returns whether err is the failure of a request's preconditions.
+func isPreconditionFailed(err error) bool {
+	var gErr *googleapi.Error
+	if errors.As(err, &gErr) {
+		return gErr.Code == http.StatusPreconditionFailed
+	}
+	st, ok := status.FromError(err)
+	return ok && st.Code() == codes.FailedPrecondition
+}
+
+// writeConflict returns a *writeConflictError if err is the failure of a write to key
+// that was conditional on conds, or nil otherwise.
+func (o *ObjectStore) writeConflict(bucket, key string, conds *storage.Conditions, err error) error {
+	if conds == nil || !isPreconditionFailed(err) {
+		return nil
+	}
+
+	conflict := &writeConflictError{key: key, expected: conds.GenerationMatch}
+	// The context of the upload may be done.
+	ctx, cancel := operationContext(o.timeouts.request)
+	defer cancel()
+	if attrs, err := o.bucketWriter.getAttrs(ctx, bucket, key); err == nil {
+		conflict.found = attrs.Generation
+	}
+	return conflict
+}
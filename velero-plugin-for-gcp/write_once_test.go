@@ -0,0 +1,137 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package main
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	velerotest "github.com/vmware-tanzu/velero/pkg/test"
+	"google.golang.org/api/googleapi"
+)
+
+func TestParseWriteOnceConfig(t *testing.T) {
+	tests := []struct {
+		name           string
+		config         map[string]string
+		expectedConfig writeOnceConfig
+		expectedError  string
+	}{
+		{
+			name:           "disabled by default",
+			config:         map[string]string{},
+			expectedConfig: writeOnceConfig{mutable: defaultMutableKeys},
+		},
+		{
+			name: "custom mutable keys",
+			config: map[string]string{
+				"prefix":             "cluster-a",
+				writeOnceConfigKey:   "true",
+				mutableKeysConfigKey: "metadata/revision, backups/*/velero-backup.json/",
+			},
+			expectedConfig: writeOnceConfig{
+				enabled: true,
+				prefix:  "cluster-a",
+				mutable: []string{"metadata/revision", "backups/*/velero-backup.json"},
+			},
+		},
+		{
+			name:          "invalid boolean",
+			config:        map[string]string{writeOnceConfigKey: "sometimes"},
+			expectedError: `invalid value for writeOnce: strconv.ParseBool: parsing "sometimes": invalid syntax`,
+		},
+		{
+			name:          "invalid pattern",
+			config:        map[string]string{mutableKeysConfigKey: "backups/["},
+			expectedError: `invalid mutableKeys pattern "backups/[": syntax error in pattern`,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			config, err := parseWriteOnceConfig(tc.config)
+			if tc.expectedError != "" {
+				assert.EqualError(t, err, tc.expectedError)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tc.expectedConfig, config)
+		})
+	}
+}
+
+func TestWriteOnceConfigIsMutable(t *testing.T) {
+	c := writeOnceConfig{enabled: true, prefix: "cluster-a/", mutable: defaultMutableKeys}
+
+	assert.True(t, c.isMutable("cluster-a/metadata/revision"))
+	assert.True(t, c.isMutable("cluster-a/backups/b1/velero-backup.json"))
+	assert.True(t, c.isMutable("cluster-a/backups/b1/b1.tar.gz"))
+	assert.False(t, c.isMutable("cluster-a/backups/b1/b1-logs.gz"))
+	assert.False(t, c.isMutable("cluster-a/kopia/default/p0123"))
+	assert.False(t, c.isMutable("cluster-b/metadata/revision"))
+}
+
+func TestWriteConflictError(t *testing.T) {
+	assert.EqualError(t, &writeConflictError{key: "backups/b1/b1-logs.gz", found: 7},
+		"write conflict on object backups/b1/b1-logs.gz: expected no object, found generation 7; another Velero installation may be writing to the same bucket and prefix")
+	assert.EqualError(t, &writeConflictError{key: "metadata/revision", expected: 3},
+		"write conflict on object metadata/revision: expected generation 3, found a different version; another Velero installation may be writing to the same bucket and prefix")
+}
+
+func TestIsPreconditionFailed(t *testing.T) {
+	assert.True(t, isPreconditionFailed(&googleapi.Error{Code: http.StatusPreconditionFailed}))
+	assert.False(t, isPreconditionFailed(&googleapi.Error{Code: http.StatusNotFound}))
+	assert.False(t, isPreconditionFailed(assert.AnError))
+
+	// As returned by the storage client.
+	client := newFakeGCSServer(t, map[string]fakeObject{"metadata/revision": {status: http.StatusPreconditionFailed}})
+	_, err := client.Bucket("bucket").Object("metadata/revision").Attrs(context.Background())
+	assert.True(t, isPreconditionFailed(err))
+}
+
+func TestPutObjectWriteOnce(t *testing.T) {
+	bucket := newMemoryBucket()
+	for _, key := range []string{"backups/b1/b1-logs.gz", "backups/b1/velero-backup.json"} {
+		_, err := bucket.put(key, []byte("previous"), writeOptions{})
+		require.NoError(t, err)
+	}
+
+	o := newObjectStore(velerotest.NewLogger())
+	o.bucketWriter = bucket
+	o.writeOnce = writeOnceConfig{enabled: true, mutable: defaultMutableKeys}
+
+	// Immutable objects are written once.
+	require.NoError(t, o.PutObject("bucket", "backups/b1/b1-podvolumebackups.json.gz", bytes.NewReader([]byte("new"))))
+	err := o.PutObject("bucket", "backups/b1/b1-logs.gz", bytes.NewReader([]byte("new")))
+	var conflict *writeConflictError
+	require.ErrorAs(t, err, &conflict)
+	assert.Equal(t, &writeConflictError{key: "backups/b1/b1-logs.gz", found: 1}, conflict)
+	assert.Equal(t, "previous", string(bucket.data("backups/b1/b1-logs.gz")))
+
+	// Mutable objects are overwritten, unless they are written meanwhile.
+	require.NoError(t, o.PutObject("bucket", "backups/b1/velero-backup.json", bytes.NewReader([]byte("new"))))
+	assert.Equal(t, "new", string(bucket.data("backups/b1/velero-backup.json")))
+
+	body := &writingReader{Reader: bytes.NewReader([]byte("newer")), bucket: bucket, key: "backups/b1/velero-backup.json"}
+	err = o.PutObject("bucket", "backups/b1/velero-backup.json", body)
+	require.ErrorAs(t, err, &conflict)
+	assert.Equal(t, &writeConflictError{key: "backups/b1/velero-backup.json", expected: 4, found: 5}, conflict)
+	assert.Equal(t, "concurrent", string(bucket.data("backups/b1/velero-backup.json")))
+}